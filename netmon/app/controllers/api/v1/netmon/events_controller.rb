@@ -2,6 +2,14 @@ class Api::V1::Netmon::EventsController < ApplicationController
   skip_before_action :verify_authenticity_token
   before_action :authenticate!
 
+  # Errors worth retrying; the agent spools these events and sends them again.
+  TRANSIENT_ERRORS = [
+    ActiveRecord::ConnectionNotEstablished,
+    ActiveRecord::Deadlocked,
+    ActiveRecord::LockWaitTimeout,
+    ActiveRecord::QueryCanceled
+  ].freeze
+
   def batch
     payload = request.request_parameters
     events = Array(payload["events"])
@@ -9,32 +17,50 @@ class Api::V1::Netmon::EventsController < ApplicationController
     sent_at = parse_time(payload["sent_at"])
 
     accepted = 0
-    rejected = 0
+    rejections = []
 
     NetmonEvent.transaction do
-      events.each do |evt|
+      events.each_with_index do |evt, index|
         event_type = evt["type"].to_s
         ts = parse_time(evt["ts"]) || sent_at || Time.current
         data = evt["data"] || {}
+        event_uid = evt["id"].presence&.to_s
 
         if event_type.empty? || router_id.empty?
-          rejected += 1
+          rejections << { index: index, reason: "missing type or router_id", retryable: false }
+          next
+        end
+
+        # The agent resends batches it could not confirm; an event already
+        # stored is acknowledged without ingesting it again.
+        if event_uid && NetmonEvent.exists?(event_uid: event_uid)
+          accepted += 1
           next
         end
 
-        NetmonEvent.create!(event_type: event_type, ts: ts, router_id: router_id, data: data)
-        Netmon::AgentIngest.ingest_event!(event_type: event_type, router_id: router_id, data: data, ts: ts)
+        # A savepoint per event, so a rejected event leaves no rows behind.
+        NetmonEvent.transaction(requires_new: true) do
+          NetmonEvent.create!(event_type: event_type, ts: ts, router_id: router_id, data: data, event_uid: event_uid)
+          Netmon::AgentIngest.ingest_event!(event_type: event_type, router_id: router_id, data: data, ts: ts)
+        end
+        accepted += 1
+      rescue ActiveRecord::RecordNotUnique
+        # Stored by a concurrent delivery of the same event.
         accepted += 1
       rescue StandardError => e
         Rails.logger.error(
           "[agent_ingest] failed event_type=#{event_type} router_id=#{router_id} error=#{e.class}: #{e.message}"
         )
         Rails.logger.debug(e.backtrace.join("\n")) if e.backtrace
-        rejected += 1
+        rejections << {
+          index: index,
+          reason: "#{e.class}: #{e.message}".truncate(200),
+          retryable: TRANSIENT_ERRORS.any? { |klass| e.is_a?(klass) }
+        }
       end
     end
 
-    render json: { accepted: accepted, rejected: rejected }
+    render json: { accepted: accepted, rejected: rejections.size, rejections: rejections }
   end
 
   private
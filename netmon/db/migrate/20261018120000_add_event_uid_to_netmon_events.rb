@@ -0,0 +1,10 @@
+# frozen_string_literal: true
+
+class AddEventUidToNetmonEvents < ActiveRecord::Migration[8.0]
+  def change
+    # The agent's "<router_id>:<sequence>" event id; replays of a stored event
+    # are skipped.
+    add_column :netmon_events, :event_uid, :string
+    add_index :netmon_events, :event_uid, unique: true
+  end
+end
@@ -10,7 +10,7 @@
 #
 # It's strongly recommended that you check this file into your version control system.
 
-ActiveRecord::Schema[8.0].define(version: 2026_03_14_130000) do
+ActiveRecord::Schema[8.0].define(version: 2026_10_18_120000) do
   create_table "allowlist_rules", force: :cascade do |t|
     t.string "kind", null: false
     t.string "value", null: false
@@ -201,7 +201,9 @@ ActiveRecord::Schema[8.0].define(version: 2026_03_14_130000) do
     t.json "data", default: {}, null: false
     t.datetime "created_at", null: false
     t.datetime "updated_at", null: false
+    t.string "event_uid"
     t.index ["event_type"], name: "index_netmon_events_on_event_type"
+    t.index ["event_uid"], name: "index_netmon_events_on_event_uid", unique: true
     t.index ["router_id"], name: "index_netmon_events_on_router_id"
     t.index ["ts"], name: "index_netmon_events_on_ts"
   end
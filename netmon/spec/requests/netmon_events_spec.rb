@@ -0,0 +1,86 @@
+# frozen_string_literal: true
+
+require "rails_helper"
+
+RSpec.describe "Agent event batches", type: :request do
+  around do |example|
+    token = ENV["NETMON_API_TOKEN"]
+    ENV["NETMON_API_TOKEN"] = "test-token"
+    example.run
+  ensure
+    ENV["NETMON_API_TOKEN"] = token
+  end
+
+  let(:headers) { { "Authorization" => "Bearer test-token" } }
+
+  def post_batch(events, headers: self.headers)
+    post "/api/v1/netmon/events/batch",
+      params: { router_id: "router-01", sent_at: "2026-02-20T14:22:00Z", events: events },
+      headers: headers,
+      as: :json
+  end
+
+  def heartbeat(n)
+    { type: "heartbeat", ts: "2026-02-20T14:21:0#{n}Z", data: { router_id: "router-01", n: n } }
+  end
+
+  it "accepts every event of a clean batch" do
+    post_batch([heartbeat(1), heartbeat(2)])
+
+    expect(response).to have_http_status(:ok)
+    expect(JSON.parse(response.body)).to eq("accepted" => 2, "rejected" => 0, "rejections" => [])
+    expect(NetmonEvent.where(router_id: "router-01").count).to eq(2)
+  end
+
+  it "reports rejections by index and keeps the rest" do
+    allow(Netmon::AgentIngest).to receive(:ingest_event!).and_call_original
+    allow(Netmon::AgentIngest).to receive(:ingest_event!)
+      .with(hash_including(data: hash_including("n" => 3)))
+      .and_raise(ActiveRecord::Deadlocked, "deadlock detected")
+
+    post_batch([heartbeat(1), { ts: "2026-02-20T14:21:02Z", data: {} }, heartbeat(3), heartbeat(4)])
+
+    expect(response).to have_http_status(:ok)
+    body = JSON.parse(response.body)
+    expect(body["accepted"]).to eq(2)
+    expect(body["rejected"]).to eq(2)
+    expect(body["rejections"]).to contain_exactly(
+      { "index" => 1, "reason" => "missing type or router_id", "retryable" => false },
+      hash_including("index" => 2, "retryable" => true)
+    )
+    expect(body["rejections"].last["reason"]).to start_with("ActiveRecord::Deadlocked")
+  end
+
+  it "leaves nothing behind for an event rejected after it was stored" do
+    allow(Netmon::AgentIngest).to receive(:ingest_event!).and_call_original
+    allow(Netmon::AgentIngest).to receive(:ingest_event!)
+      .with(hash_including(data: hash_including("n" => 2)))
+      .and_raise(ActiveRecord::RecordInvalid)
+
+    post_batch([heartbeat(1), heartbeat(2)])
+
+    body = JSON.parse(response.body)
+    expect(body["rejections"]).to match([hash_including("index" => 1, "retryable" => false)])
+    expect(NetmonEvent.where(router_id: "router-01").pluck(:data).map { |d| d["n"] }).to eq([1])
+  end
+
+  it "acknowledges replayed events without storing them again" do
+    events = [heartbeat(1).merge(id: "router-01:1001"), heartbeat(2).merge(id: "router-01:1002")]
+    post_batch(events.first(1))
+    expect(Netmon::AgentIngest).to receive(:ingest_event!).once.and_call_original
+
+    post_batch(events)
+
+    expect(JSON.parse(response.body)).to eq("accepted" => 2, "rejected" => 0, "rejections" => [])
+    expect(NetmonEvent.where(router_id: "router-01").order(:event_uid).pluck(:event_uid)).to eq(
+      ["router-01:1001", "router-01:1002"]
+    )
+  end
+
+  it "rejects a bad token" do
+    post_batch([heartbeat(1)], headers: { "Authorization" => "Bearer wrong" })
+
+    expect(response).to have_http_status(:unauthorized)
+    expect(NetmonEvent.count).to eq(0)
+  end
+end
@@ -2,11 +2,13 @@ package main
 
 import (
   "context"
+  "encoding/json"
   "flag"
   "log"
   "net/http"
   "os"
   "os/signal"
+  "path/filepath"
   "syscall"
   "time"
 
@@ -16,9 +18,11 @@ import (
   "netmon_agent/internal/conntrack"
   "netmon_agent/internal/dns"
   "netmon_agent/internal/event"
+  "netmon_agent/internal/eventid"
   "netmon_agent/internal/httpclient"
   "netmon_agent/internal/metrics"
   "netmon_agent/internal/nflog"
+  "netmon_agent/internal/sink"
   "netmon_agent/internal/spool"
 )
 
@@ -48,43 +52,83 @@ func main() {
 
   m := metrics.New()
 
-  sp := spool.New(cfg.SpoolDir, cfg.SpoolMaxBytes)
-  if err := sp.Ensure(); err != nil {
-    log.Fatalf("spool init failed: %v", err)
-  }
-
-  httpClient := httpclient.New(
-    cfg.RailsBaseURL,
-    cfg.AuthToken,
-    cfg.BatchMaxEvents,
-    cfg.BatchMaxWait,
-    m,
-    sp,
-    cfg.QueueDepth,
-    cfg.HttpTimeout,
-    cfg.HttpRetryMax,
-    cfg.HttpRetryBase,
-    cfg.HTTPFlushWorkers,
-    cfg.SpoolReplayInterval,
-  )
-  httpClient.Start(ctx, cfg.RouterID)
-
-  // Metrics endpoint
-  go func() {
-    mux := http.NewServeMux()
-    mux.Handle("/metrics", promhttp.Handler())
-    srv := &http.Server{Addr: cfg.MetricsBind, Handler: mux}
-    if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-      log.Printf("metrics server error: %v", err)
+  // Sinks run on their own context, stopped only once the fanout has handed
+  // them the last event, so they can drain their queues.
+  sinkCtx, stopSinks := context.WithCancel(context.Background())
+  defer stopSinks()
+  fanout := sink.NewFanout(m)
+  var sinks []sink.Sink
+  var sp *spool.Spool
+  var httpClient *httpclient.Client
+  for _, sc := range cfg.Sinks {
+    var s sink.Sink
+    switch sc.Type {
+    case config.SinkHTTP:
+      sp = spool.New(cfg.SpoolDir, cfg.SpoolMaxBytes, cfg.SpoolCompression, m)
+      if err := sp.Ensure(); err != nil {
+        log.Fatalf("spool init failed: %v", err)
+      }
+      // Dead-lettered events are kept for inspection and never replayed.
+      deadLetter := spool.New(cfg.DeadLetterDir, cfg.DeadLetterMaxBytes, cfg.SpoolCompression, nil)
+      if err := deadLetter.Ensure(); err != nil {
+        log.Fatalf("dead letter init failed: %v", err)
+      }
+      httpClient = httpclient.New(
+        cfg.RailsBaseURL,
+        cfg.AuthToken,
+        cfg.BatchMaxEvents,
+        cfg.BatchMaxWait,
+        m,
+        sp,
+        deadLetter,
+        sc.QueueDepth,
+        cfg.HttpTimeout,
+        cfg.HttpRetryMax,
+        cfg.HttpRetryBase,
+        cfg.HTTPFlushWorkers,
+        cfg.SpoolReplayInterval,
+        cfg.HTTPCompression,
+        cfg.HTTPBreakerThreshold,
+        cfg.HTTPBreakerCooldown,
+      )
+      s = sink.NewHTTP(sc.Name, httpClient, cfg.RouterID)
+    case config.SinkFile:
+      s = sink.NewFile(sc.Name, sc.Path, sc.MaxBytes, sc.MaxFiles, cfg.RouterID, sc.QueueDepth, m)
+    case config.SinkStdout:
+      s = sink.NewStdout(sc.Name, cfg.RouterID, sc.QueueDepth, m)
+    case config.SinkSyslog:
+      s = sink.NewSyslog(sc.Name, sc.Network, sc.Address, sc.SyslogFacility(), cfg.RouterID, sc.QueueDepth, m)
     }
-  }()
+    s.Start(sinkCtx)
+    fanout.Add(s, sc.Types)
+    sinks = append(sinks, s)
+  }
 
-  // Event fanout
+  // Event fanout. eventCh is never closed: producers may still send to it
+  // after ctx ends, and those late events are dropped once the buffer fills.
+  ids := eventid.New(cfg.RouterID, filepath.Join(cfg.StateDir, "event_id.seq"), m)
   eventCh := make(chan event.Event, cfg.QueueDepth)
+  fanoutDone := make(chan struct{})
+  forward := func(ev event.Event) {
+    ev.ID = ids.Next()
+    fanout.Send(ev)
+  }
   go func() {
-    for ev := range eventCh {
-      if !httpClient.Ingest(ev) {
-        log.Printf("http batch queue full; dropped event type=%s", ev.Type)
+    defer close(fanoutDone)
+    for {
+      select {
+      case <-ctx.Done():
+        // Forward what was queued before the stop.
+        for {
+          select {
+          case ev := <-eventCh:
+            forward(ev)
+          default:
+            return
+          }
+        }
+      case ev := <-eventCh:
+        forward(ev)
       }
     }
   }()
@@ -103,13 +147,12 @@ func main() {
         return
       case <-ticker.C:
         ev := event.Event{
+          ID:   ids.Next(),
           Type: "heartbeat",
           TS:   time.Now().UTC(),
           Data: map[string]interface{}{"router_id": cfg.RouterID},
         }
-        if !httpClient.IngestPriority(ev) {
-          log.Printf("http batch queue full; dropped heartbeat")
-        }
+        fanout.Send(ev)
       }
     }
   }()
@@ -117,20 +160,55 @@ func main() {
   // DNS tail + correlate
   dnsLines := make(chan string, cfg.QueueDepth)
   dnsCorr := dns.NewCorrelator(cfg, m)
-  go dns.Tail(ctx, cfg.DNSMasqLogPath, dnsLines, m)
-  go dnsCorr.Start(ctx, dnsLines, eventCh)
+  if cfg.DNSInput == config.DNSInputJournald {
+    go dns.TailJournal(ctx, dns.JournalOptions{
+      Command: cfg.JournalctlPath,
+      Identifier: cfg.DNSJournalIdentifier,
+      CursorPath: filepath.Join(cfg.StateDir, "dns_journal.cursor"),
+    }, dnsLines)
+  } else {
+    go dns.Tail(ctx, dns.TailOptions{
+      Path: cfg.DNSLogPath,
+      OffsetPath: filepath.Join(cfg.StateDir, "dns_tail.offset"),
+      DrainRotated: cfg.DNSLogDrainRotated,
+    }, dnsLines, m)
+  }
+  var dnsPackets chan *dns.ParsedLine
+  for _, group := range cfg.NFLogGroups {
+    if group.Kind == config.NFLogKindDNS {
+      dnsPackets = make(chan *dns.ParsedLine, cfg.QueueDepth)
+      break
+    }
+  }
+  go dnsCorr.Start(ctx, dnsLines, dnsPackets, eventCh)
 
   // NFLOG
+  var nflogHandlers []*nflog.Handler
   for _, group := range cfg.NFLogGroups {
-    hook := "INPUT"
-    if group == 11 {
-      hook = "FORWARD"
-    }
-    if err := nflog.Start(ctx, group, hook, m, eventCh); err != nil {
-      log.Printf("nflog start failed for group %d: %v", group, err)
-    }
+    nflogHandlers = append(nflogHandlers, nflog.Start(ctx, group, m, eventCh, dnsPackets))
   }
 
+  // Metrics + health endpoint
+  go func() {
+    mux := http.NewServeMux()
+    mux.Handle("/metrics", promhttp.Handler())
+    mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+      groups := make([]nflog.GroupHealth, 0, len(nflogHandlers))
+      for _, h := range nflogHandlers {
+        groups = append(groups, h.Health())
+      }
+      w.Header().Set("Content-Type", "application/json")
+      _ = json.NewEncoder(w).Encode(map[string]interface{}{
+        "router_id": cfg.RouterID,
+        "nflog": groups,
+      })
+    })
+    srv := &http.Server{Addr: cfg.MetricsBind, Handler: mux}
+    if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+      log.Printf("metrics server error: %v", err)
+    }
+  }()
+
   // Conntrack
   ctCollector := conntrack.New(cfg, m, dnsCorr)
   if err := ctCollector.Start(ctx, eventCh); err != nil {
@@ -142,15 +220,28 @@ func main() {
   for {
     select {
     case <-ctx.Done():
-      close(eventCh)
+      // Let the sinks write out their queues once the fanout is done; the
+      // signal handler exits after 5s regardless.
+      <-fanoutDone
+      stopSinks()
+      for _, s := range sinks {
+        s.Wait()
+      }
       return
     case <-ticker.C:
-      m.SpoolBytes.Set(float64(sp.SizeBytes()))
-      m.SpoolBatches.Set(float64(sp.Count()))
       m.QueueDepth.WithLabelValues("events").Set(float64(len(eventCh)))
       m.QueueDepth.WithLabelValues("dns_lines").Set(float64(len(dnsLines)))
-      m.QueueDepth.WithLabelValues("http_batch").Set(float64(httpClient.QueueDepth()))
-      m.QueueDepth.WithLabelValues("http_priority").Set(float64(httpClient.PriorityDepth()))
+      m.QueueDepth.WithLabelValues("dns_packets").Set(float64(len(dnsPackets)))
+      if httpClient != nil {
+        m.SpoolBytes.Set(float64(sp.SizeBytes()))
+        m.SpoolBatches.Set(float64(sp.Count()))
+        m.QueueDepth.WithLabelValues("http_batch").Set(float64(httpClient.QueueDepth()))
+        m.QueueDepth.WithLabelValues("http_priority").Set(float64(httpClient.PriorityDepth()))
+      }
+      for _, s := range sinks {
+        m.QueueDepth.WithLabelValues("sink_" + s.Name()).Set(float64(s.QueueDepth()))
+      }
+      m.ConntrackFlowTable.Set(float64(ctCollector.FlowTableSize()))
     }
   }
 }
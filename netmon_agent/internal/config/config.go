@@ -2,40 +2,182 @@ package config
 
 import (
   "errors"
+  "fmt"
+  "net/netip"
   "os"
+  "strings"
   "time"
 
   "gopkg.in/yaml.v3"
 )
 
 type Config struct {
-  RouterID        string   `yaml:"router_id"`
-  RailsBaseURL    string   `yaml:"rails_base_url"`
-  AuthToken       string   `yaml:"auth_token"`
-  NFLogGroups     []int    `yaml:"nflog_groups"`
-  DNSMasqLogPath  string   `yaml:"dnsmasq_log_path"`
-  LANInterfaces   []string `yaml:"lan_interfaces"`
-  WANInterfaces   []string `yaml:"wan_interfaces"`
-  LANSubnets      []string `yaml:"lan_subnets"`
-  MetricsBind     string   `yaml:"metrics_bind"`
-
-  BatchMaxEvents  int           `yaml:"batch_max_events"`
-  BatchMaxWait    time.Duration `yaml:"batch_max_wait"`
-  QueueDepth      int           `yaml:"queue_depth"`
-  SpoolDir        string        `yaml:"spool_dir"`
-  SpoolMaxBytes   int64         `yaml:"spool_max_bytes"`
-  QnameHashSalt   string        `yaml:"qname_hash_salt"`
-  QnameHashCap    int           `yaml:"qname_hash_cap"`
-  EmitConntrackNew bool         `yaml:"emit_conntrack_new"`
-  HttpTimeout     time.Duration `yaml:"http_timeout"`
-  HttpRetryMax    int           `yaml:"http_retry_max"`
-  HttpRetryBase   time.Duration `yaml:"http_retry_base"`
-  HTTPFlushWorkers int          `yaml:"http_flush_workers"`
-  SpoolReplayInterval time.Duration `yaml:"spool_replay_interval"`
-  HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
-  ConntrackReadBuffer int `yaml:"conntrack_read_buffer"`
-  ConntrackWorkers int `yaml:"conntrack_workers"`
-  ConntrackEventBuffer int `yaml:"conntrack_event_buffer"`
+  RouterID              string        `yaml:"router_id"`
+  RailsBaseURL          string        `yaml:"rails_base_url"`
+  AuthToken             string        `yaml:"auth_token"`
+  NFLogGroups           []NFLogGroup  `yaml:"nflog_groups"`
+  Sinks                 []Sink        `yaml:"sinks"`
+  DNSMasqLogPath        string        `yaml:"dnsmasq_log_path"`
+  DNSSource             string        `yaml:"dns_source"`
+  DNSLogPath            string        `yaml:"dns_log_path"`
+  DNSLogDrainRotated    bool          `yaml:"dns_log_drain_rotated"`
+  DNSLogTimezone        string        `yaml:"dns_log_timezone"`
+  DNSInput              string        `yaml:"dns_input"`
+  DNSJournalIdentifier  string        `yaml:"dns_journal_identifier"`
+  JournalctlPath        string        `yaml:"journalctl_path"`
+  StateDir              string        `yaml:"state_dir"`
+  DNSResponseWindow     time.Duration `yaml:"dns_response_window"`
+  DNSResponseMaxPending int           `yaml:"dns_response_max_pending"`
+  DNSAnswerMapSize      int           `yaml:"dns_answer_map_size"`
+  DNSAnswerTTL          time.Duration `yaml:"dns_answer_ttl"`
+  DNSClientCacheSize    int           `yaml:"dns_client_cache_size"`
+  DNSClientCacheTTL     time.Duration `yaml:"dns_client_cache_ttl"`
+  DNSQueryTrackerSize   int           `yaml:"dns_query_tracker_size"`
+  DNSAnomalyEnabled     bool          `yaml:"dns_anomaly_enabled"`
+  DNSAnomalyWindow      time.Duration `yaml:"dns_anomaly_window"`
+  DNSAnomalyThreshold   float64       `yaml:"dns_anomaly_threshold"`
+  DNSAnomalyMinQueries  int           `yaml:"dns_anomaly_min_queries"`
+  DNSAnomalyCooldown    time.Duration `yaml:"dns_anomaly_cooldown"`
+  DNSAnomalyMaxClients  int           `yaml:"dns_anomaly_max_clients"`
+  LANInterfaces         []string      `yaml:"lan_interfaces"`
+  // WANInterfaces is accepted for older configs but unused: every address on
+  // the router already counts as the router in flow direction.
+  WANInterfaces         []string      `yaml:"wan_interfaces"`
+  LANSubnets            []string      `yaml:"lan_subnets"`
+  MetricsBind           string        `yaml:"metrics_bind"`
+
+  BatchMaxEvents            int                 `yaml:"batch_max_events"`
+  BatchMaxWait              time.Duration       `yaml:"batch_max_wait"`
+  QueueDepth                int                 `yaml:"queue_depth"`
+  SpoolDir                  string              `yaml:"spool_dir"`
+  SpoolMaxBytes             int64               `yaml:"spool_max_bytes"`
+  DeadLetterDir             string              `yaml:"dead_letter_dir"`
+  DeadLetterMaxBytes        int64               `yaml:"dead_letter_max_bytes"`
+  QnameHashSalt             string              `yaml:"qname_hash_salt"`
+  QnameHashCap              int                 `yaml:"qname_hash_cap"`
+  QnameMode                 string              `yaml:"qname_mode"`
+  QnameModeOverrides        []QnameModeOverride `yaml:"qname_mode_overrides"`
+  EmitConntrackNew          bool                `yaml:"emit_conntrack_new"`
+  HttpTimeout               time.Duration       `yaml:"http_timeout"`
+  HttpRetryMax              int                 `yaml:"http_retry_max"`
+  HttpRetryBase             time.Duration       `yaml:"http_retry_base"`
+  HTTPFlushWorkers          int                 `yaml:"http_flush_workers"`
+  HTTPBreakerThreshold      int                 `yaml:"http_breaker_threshold"`
+  HTTPBreakerCooldown       time.Duration       `yaml:"http_breaker_cooldown"`
+  HTTPCompression           string              `yaml:"http_compression"`
+  SpoolCompression          string              `yaml:"spool_compression"`
+  SpoolReplayInterval       time.Duration       `yaml:"spool_replay_interval"`
+  HeartbeatInterval         time.Duration       `yaml:"heartbeat_interval"`
+  ConntrackReadBuffer       int                 `yaml:"conntrack_read_buffer"`
+  ConntrackWorkers          int                 `yaml:"conntrack_workers"`
+  ConntrackEventBuffer      int                 `yaml:"conntrack_event_buffer"`
+  ConntrackFlowTableSize    int                 `yaml:"conntrack_flow_table_size"`
+  ConntrackSnapshotInterval time.Duration       `yaml:"conntrack_snapshot_interval"`
+  ConntrackSnapshotMode     string              `yaml:"conntrack_snapshot_mode"`
+  ConntrackSnapshotMaxFlows int                 `yaml:"conntrack_snapshot_max_flows"`
+  ConntrackInterimInterval  time.Duration       `yaml:"conntrack_interim_interval"`
+}
+
+// NFLogGroup configures one NFLOG group. nflog_groups accepts either a plain
+// group number (legacy: 11 is FORWARD, anything else INPUT) or a mapping.
+type NFLogGroup struct {
+  Group         int           `yaml:"group"`
+  Hook          string        `yaml:"hook"`
+  Kind          string        `yaml:"kind"`
+  RuleTag       string        `yaml:"rule_tag"`
+  CopyRange     int           `yaml:"copy_range"`
+  BufferSize    int           `yaml:"buffer_size"`
+  QThreshold    int           `yaml:"qthreshold"`
+  Timeout       time.Duration `yaml:"timeout"`
+  IdleReconnect time.Duration `yaml:"idle_reconnect"`
+}
+
+// Sink configures one event output. Types limits it to those event types;
+// empty takes all. Path, MaxBytes and MaxFiles apply to file sinks; Network,
+// Address and Facility to syslog sinks.
+type Sink struct {
+  Name       string   `yaml:"name"`
+  Type       string   `yaml:"type"`
+  Types      []string `yaml:"types"`
+  QueueDepth int      `yaml:"queue_depth"`
+  Path       string   `yaml:"path"`
+  MaxBytes   int64    `yaml:"max_bytes"`
+  MaxFiles   int      `yaml:"max_files"`
+  Network    string   `yaml:"network"`
+  Address    string   `yaml:"address"`
+  Facility   string   `yaml:"facility"`
+}
+
+// QnameModeOverride applies a different qname_mode to clients in Subnet.
+type QnameModeOverride struct {
+  Subnet string `yaml:"subnet"`
+  Mode   string `yaml:"mode"`
+}
+
+const (
+  DNSSourceDnsmasq = "dnsmasq"
+  DNSSourceUnbound = "unbound"
+  DNSSourceBIND    = "bind"
+  DNSSourcePihole  = "pihole"
+)
+
+const (
+  DNSInputFile     = "file"
+  DNSInputJournald = "journald"
+)
+
+// defaultDNSJournalIdentifiers is the SYSLOG_IDENTIFIER each dns_source logs
+// under in the journal.
+var defaultDNSJournalIdentifiers = map[string]string{
+  DNSSourceDnsmasq: "dnsmasq",
+  DNSSourceUnbound: "unbound",
+  DNSSourceBIND:    "named",
+  DNSSourcePihole:  "pihole-FTL",
+}
+
+// defaultDNSLogPaths is where each dns_source logs queries by default.
+var defaultDNSLogPaths = map[string]string{
+  DNSSourceUnbound: "/var/log/unbound/unbound.log",
+  DNSSourceBIND:    "/var/log/named/query.log",
+  DNSSourcePihole:  "/var/log/pihole/pihole.log",
+}
+
+const (
+  QnameModeHash  = "hash"
+  QnameModePlain = "plain"
+  QnameModeETLD1 = "etld1"
+)
+
+const (
+  SinkHTTP   = "http"
+  SinkFile   = "file"
+  SinkStdout = "stdout"
+  SinkSyslog = "syslog"
+)
+
+// syslogFacilities maps facility names to their RFC 5424 codes.
+var syslogFacilities = map[string]int{
+  "user": 1, "daemon": 3, "local0": 16, "local1": 17, "local2": 18, "local3": 19,
+  "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+const (
+  NFLogKindDrop      = "drop"
+  NFLogKindAcceptLog = "accept_log"
+  NFLogKindDNS       = "dns"
+)
+
+func (g *NFLogGroup) UnmarshalYAML(value *yaml.Node) error {
+  if value.Kind == yaml.ScalarNode {
+    var group int
+    if err := value.Decode(&group); err != nil {
+      return err
+    }
+    *g = NFLogGroup{Group: group}
+    return nil
+  }
+  type plain NFLogGroup
+  return value.Decode((*plain)(g))
 }
 
 func Load(path string) (*Config, error) {
@@ -70,15 +212,81 @@ func (c *Config) applyDefaults() {
   if c.DNSMasqLogPath == "" {
     c.DNSMasqLogPath = "/var/log/dnsmasq.log"
   }
+  if c.DNSSource == "" {
+    c.DNSSource = DNSSourceDnsmasq
+  }
+  if c.DNSLogPath == "" {
+    c.DNSLogPath = c.DNSMasqLogPath
+    if p, ok := defaultDNSLogPaths[c.DNSSource]; ok {
+      c.DNSLogPath = p
+    }
+  }
+  if c.DNSInput == "" {
+    c.DNSInput = DNSInputFile
+  }
+  if c.DNSJournalIdentifier == "" {
+    c.DNSJournalIdentifier = defaultDNSJournalIdentifiers[c.DNSSource]
+  }
+  if c.JournalctlPath == "" {
+    c.JournalctlPath = "journalctl"
+  }
+  if c.StateDir == "" {
+    c.StateDir = "/var/lib/netmon-agent/state"
+  }
+  if c.DNSResponseWindow == 0 {
+    c.DNSResponseWindow = 10 * time.Second
+  }
+  if c.DNSResponseMaxPending == 0 {
+    c.DNSResponseMaxPending = 4096
+  }
+  if c.DNSAnswerMapSize == 0 {
+    c.DNSAnswerMapSize = 65536
+  }
+  if c.DNSAnswerTTL == 0 {
+    c.DNSAnswerTTL = 5 * time.Minute
+  }
+  if c.DNSClientCacheSize == 0 {
+    c.DNSClientCacheSize = 4096
+  }
+  if c.DNSClientCacheTTL == 0 {
+    c.DNSClientCacheTTL = time.Hour
+  }
+  if c.DNSQueryTrackerSize == 0 {
+    c.DNSQueryTrackerSize = 16384
+  }
+  if c.DNSAnomalyWindow == 0 {
+    c.DNSAnomalyWindow = 5 * time.Minute
+  }
+  if c.DNSAnomalyThreshold == 0 {
+    c.DNSAnomalyThreshold = 0.6
+  }
+  if c.DNSAnomalyMinQueries == 0 {
+    c.DNSAnomalyMinQueries = 20
+  }
+  if c.DNSAnomalyCooldown == 0 {
+    c.DNSAnomalyCooldown = 15 * time.Minute
+  }
+  if c.DNSAnomalyMaxClients == 0 {
+    c.DNSAnomalyMaxClients = 4096
+  }
   if c.SpoolDir == "" {
     c.SpoolDir = "/var/lib/netmon-agent/spool"
   }
   if c.SpoolMaxBytes == 0 {
     c.SpoolMaxBytes = 50 * 1024 * 1024
   }
+  if c.DeadLetterDir == "" {
+    c.DeadLetterDir = "/var/lib/netmon-agent/deadletter"
+  }
+  if c.DeadLetterMaxBytes == 0 {
+    c.DeadLetterMaxBytes = 10 * 1024 * 1024
+  }
   if c.QnameHashCap == 0 {
     c.QnameHashCap = 200
   }
+  if c.QnameMode == "" {
+    c.QnameMode = QnameModeHash
+  }
   if c.HttpTimeout == 0 {
     c.HttpTimeout = 5 * time.Second
   }
@@ -88,9 +296,21 @@ func (c *Config) applyDefaults() {
   if c.HttpRetryBase == 0 {
     c.HttpRetryBase = 1 * time.Second
   }
+  if c.HTTPCompression == "" {
+    c.HTTPCompression = "identity"
+  }
+  if c.SpoolCompression == "" {
+    c.SpoolCompression = "gzip"
+  }
   if c.HTTPFlushWorkers == 0 {
     c.HTTPFlushWorkers = 2
   }
+  if c.HTTPBreakerThreshold == 0 {
+    c.HTTPBreakerThreshold = 5
+  }
+  if c.HTTPBreakerCooldown == 0 {
+    c.HTTPBreakerCooldown = 30 * time.Second
+  }
   if c.SpoolReplayInterval == 0 {
     c.SpoolReplayInterval = 5 * time.Second
   }
@@ -106,20 +326,204 @@ func (c *Config) applyDefaults() {
   if c.ConntrackEventBuffer == 0 {
     c.ConntrackEventBuffer = 4096
   }
+  if c.ConntrackFlowTableSize == 0 {
+    c.ConntrackFlowTableSize = 65536
+  }
+  // Trimmed here so validation accepts what the classifier accepts.
+  subnets := c.LANSubnets[:0]
+  for _, s := range c.LANSubnets {
+    if s = strings.TrimSpace(s); s != "" {
+      subnets = append(subnets, s)
+    }
+  }
+  c.LANSubnets = subnets
+  if len(c.Sinks) == 0 {
+    c.Sinks = []Sink{{Type: SinkHTTP}}
+  }
+  for i := range c.Sinks {
+    s := &c.Sinks[i]
+    if s.Name == "" {
+      s.Name = s.Type
+    }
+    if s.QueueDepth == 0 {
+      s.QueueDepth = c.QueueDepth
+    }
+    switch s.Type {
+    case SinkFile:
+      if s.MaxBytes == 0 {
+        s.MaxBytes = 100 * 1024 * 1024
+      }
+      if s.MaxFiles == 0 {
+        s.MaxFiles = 5
+      }
+    case SinkSyslog:
+      if s.Network == "" {
+        s.Network = "udp"
+      }
+      if s.Facility == "" {
+        s.Facility = "local0"
+      }
+    }
+  }
+  for i := range c.NFLogGroups {
+    g := &c.NFLogGroups[i]
+    if g.Hook == "" {
+      g.Hook = "INPUT"
+      if g.Group == 11 {
+        g.Hook = "FORWARD"
+      }
+    }
+    if g.Kind == "" {
+      g.Kind = NFLogKindDrop
+    }
+    if g.CopyRange == 0 {
+      g.CopyRange = 128
+      // DNS responses need the whole packet.
+      if g.Kind == NFLogKindDNS {
+        g.CopyRange = 65535
+      }
+    }
+  }
+  if c.ConntrackSnapshotMode == "" {
+    c.ConntrackSnapshotMode = "table"
+  }
+  if c.ConntrackSnapshotMaxFlows == 0 {
+    c.ConntrackSnapshotMaxFlows = 20000
+  }
 }
 
 func (c *Config) validate() error {
   if c.RouterID == "" {
     return errors.New("router_id is required")
   }
-  if c.RailsBaseURL == "" {
-    return errors.New("rails_base_url is required")
-  }
-  if c.AuthToken == "" {
-    return errors.New("auth_token is required")
+  if err := c.validateSinks(); err != nil {
+    return err
   }
   if len(c.NFLogGroups) == 0 {
     return errors.New("nflog_groups required")
   }
+  seen := make(map[int]bool, len(c.NFLogGroups))
+  for _, g := range c.NFLogGroups {
+    if g.Group < 0 || g.Group > 65535 {
+      return fmt.Errorf("nflog_groups: group %d out of range", g.Group)
+    }
+    if seen[g.Group] {
+      return fmt.Errorf("nflog_groups: group %d listed twice", g.Group)
+    }
+    seen[g.Group] = true
+    if g.Kind != NFLogKindDrop && g.Kind != NFLogKindAcceptLog && g.Kind != NFLogKindDNS {
+      return fmt.Errorf("nflog_groups: group %d: kind must be %s, %s or %s, got %q", g.Group, NFLogKindDrop, NFLogKindAcceptLog, NFLogKindDNS, g.Kind)
+    }
+    if g.CopyRange < 0 || g.BufferSize < 0 || g.QThreshold < 0 || g.Timeout < 0 || g.IdleReconnect < 0 {
+      return fmt.Errorf("nflog_groups: group %d: negative option", g.Group)
+    }
+  }
+  if c.ConntrackSnapshotMode != "table" && c.ConntrackSnapshotMode != "flow" {
+    return fmt.Errorf("conntrack_snapshot_mode must be table or flow, got %q", c.ConntrackSnapshotMode)
+  }
+  for _, s := range c.LANSubnets {
+    if _, err := netip.ParsePrefix(s); err != nil {
+      return fmt.Errorf("lan_subnets: invalid CIDR %q", s)
+    }
+  }
+  switch c.DNSSource {
+  case DNSSourceDnsmasq, DNSSourceUnbound, DNSSourceBIND, DNSSourcePihole:
+  default:
+    return fmt.Errorf("dns_source must be dnsmasq, unbound, bind or pihole, got %q", c.DNSSource)
+  }
+  if c.DNSInput != DNSInputFile && c.DNSInput != DNSInputJournald {
+    return fmt.Errorf("dns_input must be file or journald, got %q", c.DNSInput)
+  }
+  for key, v := range map[string]string{"http_compression": c.HTTPCompression, "spool_compression": c.SpoolCompression} {
+    if v != "identity" && v != "gzip" && v != "zstd" {
+      return fmt.Errorf("%s must be identity, gzip or zstd, got %q", key, v)
+    }
+  }
+  if c.DNSAnomalyThreshold < 0 || c.DNSAnomalyThreshold > 1 {
+    return fmt.Errorf("dns_anomaly_threshold must be between 0 and 1, got %v", c.DNSAnomalyThreshold)
+  }
+  if _, err := c.DNSLogLocation(); err != nil {
+    return fmt.Errorf("dns_log_timezone: %w", err)
+  }
+  if !validQnameMode(c.QnameMode) {
+    return fmt.Errorf("qname_mode must be hash, plain or etld1, got %q", c.QnameMode)
+  }
+  for _, o := range c.QnameModeOverrides {
+    if _, err := netip.ParsePrefix(o.Subnet); err != nil {
+      return fmt.Errorf("qname_mode_overrides: invalid CIDR %q", o.Subnet)
+    }
+    if !validQnameMode(o.Mode) {
+      return fmt.Errorf("qname_mode_overrides: %s: mode must be hash, plain or etld1, got %q", o.Subnet, o.Mode)
+    }
+  }
+  return nil
+}
+
+func (c *Config) validateSinks() error {
+  names := make(map[string]bool, len(c.Sinks))
+  httpSinks := 0
+  for _, s := range c.Sinks {
+    if names[s.Name] {
+      return fmt.Errorf("sinks: name %q used twice", s.Name)
+    }
+    names[s.Name] = true
+    if s.QueueDepth < 0 || s.MaxBytes < 0 || s.MaxFiles < 0 {
+      return fmt.Errorf("sinks: %s: negative option", s.Name)
+    }
+    switch s.Type {
+    case SinkHTTP:
+      httpSinks++
+      if c.RailsBaseURL == "" {
+        return errors.New("rails_base_url is required")
+      }
+      if c.AuthToken == "" {
+        return errors.New("auth_token is required")
+      }
+    case SinkFile:
+      if s.Path == "" {
+        return fmt.Errorf("sinks: %s: path is required", s.Name)
+      }
+    case SinkStdout:
+    case SinkSyslog:
+      if s.Address == "" {
+        return fmt.Errorf("sinks: %s: address is required", s.Name)
+      }
+      if s.Network != "udp" && s.Network != "tcp" {
+        return fmt.Errorf("sinks: %s: network must be udp or tcp, got %q", s.Name, s.Network)
+      }
+      if _, ok := syslogFacilities[s.Facility]; !ok {
+        return fmt.Errorf("sinks: %s: unknown syslog facility %q", s.Name, s.Facility)
+      }
+    case "":
+      return errors.New("sinks: type is required")
+    default:
+      return fmt.Errorf("sinks: %s: type must be %s, %s, %s or %s, got %q", s.Name, SinkHTTP, SinkFile, SinkStdout, SinkSyslog, s.Type)
+    }
+  }
+  if httpSinks > 1 {
+    return errors.New("sinks: only one http sink is supported")
+  }
   return nil
 }
+
+// SyslogFacility is the RFC 5424 code of a syslog sink's facility.
+func (s Sink) SyslogFacility() int {
+  return syslogFacilities[s.Facility]
+}
+
+// DNSLogLocation is the zone of DNS log timestamps that carry none:
+// dns_log_timezone, or the system zone when unset.
+func (c *Config) DNSLogLocation() (*time.Location, error) {
+  if c.DNSLogTimezone == "" {
+    return time.Local, nil
+  }
+  return time.LoadLocation(c.DNSLogTimezone)
+}
+
+func validQnameMode(mode string) bool {
+  switch mode {
+  case QnameModeHash, QnameModePlain, QnameModeETLD1:
+    return true
+  }
+  return false
+}
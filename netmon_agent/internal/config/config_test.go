@@ -0,0 +1,206 @@
+package config
+
+import (
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+)
+
+const baseYAML = `
+router_id: "router-01"
+rails_base_url: "http://10.0.0.10:3000"
+auth_token: "secret"
+`
+
+func loadYAML(t *testing.T, body string) (*Config, error) {
+  t.Helper()
+  path := filepath.Join(t.TempDir(), "config.yaml")
+  if err := os.WriteFile(path, []byte(baseYAML+body), 0o600); err != nil {
+    t.Fatal(err)
+  }
+  return Load(path)
+}
+
+func TestNFLogGroupsLegacyList(t *testing.T) {
+  cfg, err := loadYAML(t, "nflog_groups: [10, 11]\n")
+  if err != nil {
+    t.Fatalf("Load: %v", err)
+  }
+  want := []NFLogGroup{
+    {Group: 10, Hook: "INPUT", Kind: NFLogKindDrop, CopyRange: 128},
+    {Group: 11, Hook: "FORWARD", Kind: NFLogKindDrop, CopyRange: 128},
+  }
+  if !reflect.DeepEqual(cfg.NFLogGroups, want) {
+    t.Fatalf("got %+v\nwant %+v", cfg.NFLogGroups, want)
+  }
+}
+
+func TestNFLogGroupsStructured(t *testing.T) {
+  cfg, err := loadYAML(t, `
+nflog_groups:
+  - 10
+  - group: 12
+    hook: OUTPUT
+    kind: accept_log
+    rule_tag: ACCEPT_SAMPLE
+    copy_range: 96
+    buffer_size: 1048576
+    qthreshold: 32
+    timeout: 500ms
+`)
+  if err != nil {
+    t.Fatalf("Load: %v", err)
+  }
+  want := []NFLogGroup{
+    {Group: 10, Hook: "INPUT", Kind: NFLogKindDrop, CopyRange: 128},
+    {Group: 12, Hook: "OUTPUT", Kind: NFLogKindAcceptLog, RuleTag: "ACCEPT_SAMPLE", CopyRange: 96, BufferSize: 1048576, QThreshold: 32, Timeout: 500 * time.Millisecond},
+  }
+  if !reflect.DeepEqual(cfg.NFLogGroups, want) {
+    t.Fatalf("got %+v\nwant %+v", cfg.NFLogGroups, want)
+  }
+}
+
+func TestNFLogGroupsInvalid(t *testing.T) {
+  tests := map[string]string{
+    "duplicate": "nflog_groups: [10, 10]\n",
+    "range":     "nflog_groups: [70000]\n",
+    "kind":      "nflog_groups:\n  - group: 10\n    kind: reject\n",
+  }
+  for name, body := range tests {
+    t.Run(name, func(t *testing.T) {
+      if _, err := loadYAML(t, body); err == nil || !strings.Contains(err.Error(), "nflog_groups") {
+        t.Fatalf("expected nflog_groups error, got %v", err)
+      }
+    })
+  }
+}
+
+func TestQnameModeOverrides(t *testing.T) {
+  cfg, err := loadYAML(t, `
+nflog_groups: [10]
+qname_mode: plain
+qname_mode_overrides:
+  - subnet: 10.0.50.0/24
+    mode: hash
+`)
+  if err != nil {
+    t.Fatalf("Load: %v", err)
+  }
+  want := []QnameModeOverride{{Subnet: "10.0.50.0/24", Mode: QnameModeHash}}
+  if cfg.QnameMode != QnameModePlain || !reflect.DeepEqual(cfg.QnameModeOverrides, want) {
+    t.Fatalf("got %q %+v", cfg.QnameMode, cfg.QnameModeOverrides)
+  }
+
+  for _, body := range []string{
+    "nflog_groups: [10]\nqname_mode: clear\n",
+    "nflog_groups: [10]\nqname_mode_overrides:\n  - subnet: 10.0.50.0/33\n    mode: hash\n",
+    "nflog_groups: [10]\nqname_mode_overrides:\n  - subnet: 10.0.50.0/24\n    mode: md5\n",
+  } {
+    if _, err := loadYAML(t, body); err == nil || !strings.Contains(err.Error(), "qname_mode") {
+      t.Errorf("expected qname_mode error for %q, got %v", body, err)
+    }
+  }
+}
+
+func TestDNSSource(t *testing.T) {
+  cfg, err := loadYAML(t, "nflog_groups: [10]\n")
+  if err != nil {
+    t.Fatalf("Load: %v", err)
+  }
+  if cfg.DNSSource != DNSSourceDnsmasq || cfg.DNSLogPath != "/var/log/dnsmasq.log" {
+    t.Fatalf("defaults: %q %q", cfg.DNSSource, cfg.DNSLogPath)
+  }
+  cfg, err = loadYAML(t, "nflog_groups: [10]\ndns_source: unbound\n")
+  if err != nil {
+    t.Fatalf("Load: %v", err)
+  }
+  if cfg.DNSLogPath != "/var/log/unbound/unbound.log" || cfg.DNSJournalIdentifier != "unbound" {
+    t.Fatalf("unbound defaults = %q %q", cfg.DNSLogPath, cfg.DNSJournalIdentifier)
+  }
+  if _, err := loadYAML(t, "nflog_groups: [10]\ndns_input: syslog\n"); err == nil || !strings.Contains(err.Error(), "dns_input") {
+    t.Fatalf("expected dns_input error, got %v", err)
+  }
+  if _, err := loadYAML(t, "nflog_groups: [10]\ndns_log_timezone: Mars/Olympus_Mons\n"); err == nil || !strings.Contains(err.Error(), "dns_log_timezone") {
+    t.Fatalf("expected dns_log_timezone error, got %v", err)
+  }
+  if _, err := loadYAML(t, "nflog_groups: [10]\ndns_source: powerdns\n"); err == nil || !strings.Contains(err.Error(), "dns_source") {
+    t.Fatalf("expected dns_source error, got %v", err)
+  }
+}
+
+func TestSinks(t *testing.T) {
+  cfg, err := loadYAML(t, "nflog_groups: [10]\n")
+  if err != nil {
+    t.Fatalf("Load: %v", err)
+  }
+  if want := []Sink{{Name: "http", Type: SinkHTTP, QueueDepth: 2000}}; !reflect.DeepEqual(cfg.Sinks, want) {
+    t.Fatalf("default sinks = %+v", cfg.Sinks)
+  }
+
+  cfg, err = loadYAML(t, `nflog_groups: [10]
+sinks:
+  - type: http
+  - type: file
+    path: /var/log/netmon-agent/events.ndjson
+    types: [flow, firewall_drop]
+  - name: siem
+    type: syslog
+    address: 10.0.0.5:514
+    queue_depth: 500
+`)
+  if err != nil {
+    t.Fatalf("Load: %v", err)
+  }
+  want := []Sink{
+    {Name: "http", Type: SinkHTTP, QueueDepth: 2000},
+    {Name: "file", Type: SinkFile, Types: []string{"flow", "firewall_drop"}, QueueDepth: 2000, Path: "/var/log/netmon-agent/events.ndjson", MaxBytes: 100 * 1024 * 1024, MaxFiles: 5},
+    {Name: "siem", Type: SinkSyslog, QueueDepth: 500, Network: "udp", Address: "10.0.0.5:514", Facility: "local0"},
+  }
+  if !reflect.DeepEqual(cfg.Sinks, want) {
+    t.Fatalf("got %+v\nwant %+v", cfg.Sinks, want)
+  }
+  if cfg.Sinks[2].SyslogFacility() != 16 {
+    t.Fatalf("local0 = %d", cfg.Sinks[2].SyslogFacility())
+  }
+
+  // Without an http sink the Rails settings are optional.
+  path := filepath.Join(t.TempDir(), "config.yaml")
+  body := "router_id: router-01\nnflog_groups: [10]\nsinks:\n  - type: stdout\n"
+  if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := Load(path); err != nil {
+    t.Fatalf("stdout only: %v", err)
+  }
+
+  for body, msg := range map[string]string{
+    "sinks:\n  - type: kafka\n":                         "type must be",
+    "sinks:\n  - path: /tmp/x\n":                        "type is required",
+    "sinks:\n  - type: file\n":                          "path is required",
+    "sinks:\n  - type: stdout\n  - type: stdout\n":      "used twice",
+    "sinks:\n  - type: http\n  - {type: http, name: b}\n": "only one http sink",
+    "sinks:\n  - type: syslog\n":                        "address is required",
+    "sinks:\n  - {type: syslog, address: x:514, network: tls}\n":    "network must be",
+    "sinks:\n  - {type: syslog, address: x:514, facility: local9}\n": "unknown syslog facility",
+  } {
+    if _, err := loadYAML(t, "nflog_groups: [10]\n"+body); err == nil || !strings.Contains(err.Error(), msg) {
+      t.Errorf("%q: expected %q error, got %v", body, msg, err)
+    }
+  }
+}
+
+func TestLANSubnetsTrimmed(t *testing.T) {
+  cfg, err := loadYAML(t, "nflog_groups: [10]\nlan_subnets: [\" 10.0.0.0/24\", \"\", \"fd00::/64 \"]\n")
+  if err != nil {
+    t.Fatalf("Load: %v", err)
+  }
+  if want := []string{"10.0.0.0/24", "fd00::/64"}; !reflect.DeepEqual(cfg.LANSubnets, want) {
+    t.Fatalf("lan_subnets = %q", cfg.LANSubnets)
+  }
+  if _, err := loadYAML(t, "nflog_groups: [10]\nlan_subnets: [\"10.0.0.0/33\"]\n"); err == nil {
+    t.Fatal("expected lan_subnets error")
+  }
+}
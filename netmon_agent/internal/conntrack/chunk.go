@@ -0,0 +1,42 @@
+package conntrack
+
+import (
+  "time"
+
+  "netmon_agent/internal/event"
+)
+
+const flowTableChunk = 500
+
+// snapshotLimit returns how many of n dumped flows a snapshot keeps under
+// conntrack_snapshot_max_flows (0 keeps all), and whether any were cut.
+func snapshotLimit(n, max int) (int, bool) {
+  if max > 0 && n > max {
+    return max, true
+  }
+  return n, false
+}
+
+// flowTableChunks splits the entries of one snapshot into flow_table events
+// of at most size entries, numbered from 1. total is the number of flows in
+// the dump before truncation. An empty table still yields one event so the
+// server can clear stale flows.
+func flowTableChunks(entries []event.FlowTableEntry, total int, truncated bool, size int, now time.Time) []event.FlowTable {
+  chunks := (len(entries) + size - 1) / size
+  if chunks == 0 {
+    chunks = 1
+  }
+  tables := make([]event.FlowTable, 0, chunks)
+  for i := 0; i < chunks; i++ {
+    start, end := i*size, (i+1)*size
+    if end > len(entries) {
+      end = len(entries)
+    }
+    flows := entries[start:end:end]
+    if flows == nil {
+      flows = []event.FlowTableEntry{}
+    }
+    tables = append(tables, event.FlowTable{SnapshotAt: now, Chunk: i + 1, Chunks: chunks, Total: total, Truncated: truncated, Flows: flows})
+  }
+  return tables
+}
@@ -0,0 +1,72 @@
+package conntrack
+
+import (
+  "testing"
+  "time"
+
+  "netmon_agent/internal/event"
+)
+
+func TestSnapshotLimit(t *testing.T) {
+  for _, tt := range []struct {
+    n, max, keep int
+    truncated    bool
+  }{
+    {0, 0, 0, false},
+    {1200, 0, 1200, false},
+    {1200, 20000, 1200, false},
+    {20000, 20000, 20000, false},
+    {20001, 20000, 20000, true},
+  } {
+    keep, truncated := snapshotLimit(tt.n, tt.max)
+    if keep != tt.keep || truncated != tt.truncated {
+      t.Errorf("snapshotLimit(%d, %d) = %d, %v; want %d, %v", tt.n, tt.max, keep, truncated, tt.keep, tt.truncated)
+    }
+  }
+}
+
+func TestFlowTableChunks(t *testing.T) {
+  now := time.Date(2026, 2, 20, 14, 22, 0, 0, time.UTC)
+  entries := func(n int) []event.FlowTableEntry {
+    out := make([]event.FlowTableEntry, n)
+    for i := range out {
+      out[i].ID = uint32(i + 1)
+    }
+    return out
+  }
+  for _, tt := range []struct {
+    name      string
+    entries   int
+    total     int
+    truncated bool
+    sizes     []int
+  }{
+    {"empty table", 0, 0, false, []int{0}},
+    {"one partial chunk", 3, 3, false, []int{3}},
+    {"exact chunk", 500, 500, false, []int{500}},
+    {"spills over", 1201, 1201, false, []int{500, 500, 201}},
+    {"truncated", 1000, 25000, true, []int{500, 500}},
+  } {
+    tables := flowTableChunks(entries(tt.entries), tt.total, tt.truncated, flowTableChunk, now)
+    if len(tables) != len(tt.sizes) {
+      t.Errorf("%s: %d chunks, want %d", tt.name, len(tables), len(tt.sizes))
+      continue
+    }
+    next := uint32(1)
+    for i, table := range tables {
+      if table.Chunk != i+1 || table.Chunks != len(tt.sizes) || table.Total != tt.total || table.Truncated != tt.truncated || !table.SnapshotAt.Equal(now) {
+        t.Errorf("%s: chunk %d header = %d/%d total %d truncated %v", tt.name, i, table.Chunk, table.Chunks, table.Total, table.Truncated)
+      }
+      if table.Flows == nil || len(table.Flows) != tt.sizes[i] {
+        t.Errorf("%s: chunk %d has %d flows (nil %v), want %d", tt.name, i, len(table.Flows), table.Flows == nil, tt.sizes[i])
+        continue
+      }
+      for _, f := range table.Flows {
+        if f.ID != next {
+          t.Fatalf("%s: chunk %d: flow %d out of order, want %d", tt.name, i, f.ID, next)
+        }
+        next++
+      }
+    }
+  }
+}
@@ -6,6 +6,8 @@ import (
   "context"
   "fmt"
   "log"
+  "os"
+  "strings"
   "time"
 
   ct "github.com/ti-mo/conntrack"
@@ -22,59 +24,246 @@ type Collector struct {
   cfg     *config.Config
   metrics *metrics.Metrics
   dns     *dns.Correlator
+  dir     *Classifier
+  flows   *flowTable
 }
 
 func New(cfg *config.Config, metrics *metrics.Metrics, dns *dns.Correlator) *Collector {
-  return &Collector{cfg: cfg, metrics: metrics, dns: dns}
+  return &Collector{cfg: cfg, metrics: metrics, dns: dns, flows: newFlowTable(cfg.ConntrackFlowTableSize)}
 }
 
 func (c *Collector) Start(ctx context.Context, out chan<- event.Event) error {
+  dir, err := c.newClassifier()
+  if err != nil {
+    return err
+  }
+  c.dir = dir
+  if !kernelTimestamps() {
+    log.Printf("conntrack: nf_conntrack_timestamp disabled; using agent-observed first_seen")
+  }
+  go c.refreshRouterAddrs(ctx)
   go c.run(ctx, out)
+  if c.cfg.ConntrackSnapshotInterval > 0 {
+    go c.snapshotLoop(ctx, out)
+  }
+  if c.cfg.ConntrackInterimInterval > 0 {
+    go c.interimLoop(ctx, out)
+  }
   return nil
 }
 
+// newClassifier builds the direction classifier from lan_subnets plus the
+// subnets configured on lan_interfaces. Every local address counts as the
+// router itself; they are refreshed periodically to follow WAN DHCP changes.
+func (c *Collector) newClassifier() (*Classifier, error) {
+  subnets := append([]string{}, c.cfg.LANSubnets...)
+  if len(c.cfg.LANInterfaces) > 0 {
+    _, prefixes, err := interfacePrefixes(systemInterfaceAddrs, c.cfg.LANInterfaces)
+    if err != nil {
+      log.Printf("conntrack: list lan_interfaces subnets: %v", err)
+    }
+    for _, p := range prefixes {
+      subnets = append(subnets, p.String())
+    }
+  }
+  dir, err := NewClassifier(subnets, nil)
+  if err != nil {
+    return nil, err
+  }
+  if err := dir.RefreshRouterAddrs(systemInterfaceAddrs); err != nil {
+    log.Printf("conntrack: list router addresses: %v", err)
+  }
+  return dir, nil
+}
+
+func (c *Collector) refreshRouterAddrs(ctx context.Context) {
+  ticker := time.NewTicker(1 * time.Minute)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+      if err := c.dir.RefreshRouterAddrs(systemInterfaceAddrs); err != nil {
+        log.Printf("conntrack: list router addresses, keeping the previous ones: %v", err)
+      }
+    }
+  }
+}
+
 func (c *Collector) handleEvent(ev ct.Event, out chan<- event.Event) {
   if ev.Flow == nil {
     c.metrics.ConntrackParseErrors.Inc()
     return
   }
+  now := time.Now().UTC()
+  var final counters
+  var since time.Duration
+  closing := false
   if ev.Type == ct.EventDestroy {
     c.metrics.ConntrackDestroy.Inc()
+    if c.cfg.ConntrackInterimInterval > 0 && ev.Flow.ID != 0 {
+      // Taken before buildFlow drops the flow from the table.
+      final, since, closing = c.flows.final(ev.Flow.ID, flowCounters(ev.Flow), now)
+    }
+  }
+
+  flow := c.buildFlow(ev, ev.Type.String(), conntrackState(ev), now)
+
+  if closing {
+    // The last flow_update covers the rest of the flow, so its deltas add up
+    // to the totals on the DESTROY flow.
+    c.sendUpdate(flow, final, since, now, out)
+  }
+  util.TrySend(out, c.metrics, "flow", event.Event{Type: "flow", TS: now, Data: flow})
+}
+
+func (c *Collector) handleUpdate(ev ct.Event, out chan<- event.Event) {
+  c.emitInterim(ev, time.Now().UTC(), c.cfg.ConntrackInterimInterval, out)
+}
+
+// emitInterim sends a flow_update with the counter deltas since the flow was
+// last reported, at most once per every. The flow is only built when a report
+// is due.
+func (c *Collector) emitInterim(ev ct.Event, now time.Time, every time.Duration, out chan<- event.Event) {
+  f := ev.Flow
+  if f.ID == 0 {
+    return
+  }
+  c.track(f.ID, now, false)
+  d, since, ok := c.flows.interim(f.ID, flowCounters(f), now, every)
+  if !ok {
+    return
   }
+  flow := c.buildFlow(ev, "UPDATE", conntrackState(ev), now)
+  c.sendUpdate(flow, d, since, now, out)
+}
+
+func (c *Collector) sendUpdate(flow event.Flow, d counters, since time.Duration, now time.Time, out chan<- event.Event) {
+  update := event.FlowUpdate{
+    Flow:              flow,
+    BytesOrigDelta:    d.bytesOrig,
+    BytesReplyDelta:   d.bytesReply,
+    PacketsOrigDelta:  d.packetsOrig,
+    PacketsReplyDelta: d.packetsReply,
+    IntervalMS:        since.Milliseconds(),
+  }
+  if util.TrySend(out, c.metrics, "flow_update", event.Event{Type: "flow_update", TS: now, Data: update}) {
+    c.metrics.ConntrackFlowUpdates.Inc()
+  }
+}
 
+func flowCounters(f *ct.Flow) counters {
+  return counters{
+    bytesOrig:    f.CountersOrig.Bytes,
+    bytesReply:   f.CountersReply.Bytes,
+    packetsOrig:  f.CountersOrig.Packets,
+    packetsReply: f.CountersReply.Packets,
+  }
+}
+
+// buildFlow converts a conntrack flow into the wire format. name is the event
+// label (NEW, DESTROY, SNAPSHOT, ...).
+func (c *Collector) buildFlow(ev ct.Event, name, state string, now time.Time) event.Flow {
   srcIP := ev.Flow.TupleOrig.IP.SourceAddress.String()
-  dstIP := ev.Flow.TupleOrig.IP.DestinationAddress.String()
-  srcPort := int(ev.Flow.TupleOrig.Proto.SourcePort)
-  dstPort := int(ev.Flow.TupleOrig.Proto.DestinationPort)
-  l4proto := int(ev.Flow.TupleOrig.Proto.Protocol)
 
-  firstSeen := time.Now().UTC()
-  lastSeen := time.Now().UTC()
-  // conntrack v0.6.0 doesn't expose per-flow first/last seen timestamps; keep now.
+  firstSeen, lastSeen := c.flowTimes(ev, now)
 
   flow := event.Flow{
-    Event:       ev.Type.String(),
-    State:       conntrackState(ev),
+    Event:       name,
+    State:       state,
     Flags:       conntrackFlags(ev),
     SrcIP:       srcIP,
-    DstIP:       dstIP,
-    SrcPort:     srcPort,
-    DstPort:     dstPort,
-    L4Proto:     l4proto,
-    Dir:         "OUT",
+    DstIP:       ev.Flow.TupleOrig.IP.DestinationAddress.String(),
+    SrcPort:     int(ev.Flow.TupleOrig.Proto.SourcePort),
+    DstPort:     int(ev.Flow.TupleOrig.Proto.DestinationPort),
+    L4Proto:     int(ev.Flow.TupleOrig.Proto.Protocol),
+    Dir:         c.direction(ev.Flow),
     BytesOrig:   ev.Flow.CountersOrig.Bytes,
     BytesReply:  ev.Flow.CountersReply.Bytes,
     PacketsOrig: ev.Flow.CountersOrig.Packets,
     PacketsReply: ev.Flow.CountersReply.Packets,
     FirstSeen:   firstSeen,
     LastSeen:    lastSeen,
+    DurationMS:  lastSeen.Sub(firstSeen).Milliseconds(),
   }
 
+  applyReplyTuple(&flow, ev.Flow)
+  flow.ICMP = flowICMP(ev.Flow.TupleOrig.Proto)
+
   if c.dns != nil {
     flow.DNSContext = c.dns.DNSContextForIP(srcIP)
+    // The client resolved the original destination, before any DNAT.
+    if d, ok := c.dns.DstDomainForIP(srcIP, flow.DstIP, firstSeen); ok {
+      resolvedAt := d.ResolvedAt.UTC()
+      flow.DstDomain = d.QName
+      flow.DstDomainMode = d.QNameMode
+      flow.DstDomainResolvedAt = &resolvedAt
+    }
   }
+  return flow
+}
 
-  util.TrySend(out, c.metrics, "flow", event.Event{Type: "flow", TS: time.Now().UTC(), Data: flow})
+// track adds a flow the agent has not seen yet to the flow table.
+func (c *Collector) track(id uint32, now time.Time, started bool) *flowState {
+  st, evicted := c.flows.observe(id, now, started)
+  if evicted {
+    c.metrics.ConntrackFlowTableEvictions.Inc()
+  }
+  return st
+}
+
+// flowTimes prefers the kernel's CTA_TIMESTAMP start/stop. Without it the
+// start falls back to when the agent first saw the conntrack ID.
+func (c *Collector) flowTimes(ev ct.Event, now time.Time) (time.Time, time.Time) {
+  ts := ev.Flow.Timestamp
+  var st *flowState
+  if ev.Flow.ID != 0 {
+    if ev.Type == ct.EventDestroy {
+      st, _ = c.flows.remove(ev.Flow.ID)
+    } else if ts.Start.IsZero() || c.cfg.ConntrackInterimInterval > 0 {
+      st = c.track(ev.Flow.ID, now, ev.Type == ct.EventNew)
+    }
+  }
+
+  first, last := now, now
+  if !ts.Start.IsZero() {
+    first = ts.Start.UTC()
+  } else if st != nil {
+    first = st.firstSeen
+  }
+  if !ts.Stop.IsZero() {
+    last = ts.Stop.UTC()
+  }
+  if last.Before(first) {
+    last = first
+  }
+  return first, last
+}
+
+// FlowTableSize reports how many flows are tracked for first-seen fallback.
+func (c *Collector) FlowTableSize() int {
+  return c.flows.len()
+}
+
+func kernelTimestamps() bool {
+  data, err := os.ReadFile("/proc/sys/net/netfilter/nf_conntrack_timestamp")
+  if err != nil {
+    return false
+  }
+  return strings.TrimSpace(string(data)) == "1"
+}
+
+func (c *Collector) direction(f *ct.Flow) string {
+  if c.dir == nil {
+    return DirUnknown
+  }
+  dst := f.TupleOrig.IP.DestinationAddress
+  if f.TupleReply.IP.SourceAddress.IsValid() {
+    // After DNAT the reply comes from the real destination.
+    dst = f.TupleReply.IP.SourceAddress
+  }
+  return c.dir.Classify(f.TupleOrig.IP.SourceAddress, dst)
 }
 
 func (c *Collector) run(ctx context.Context, out chan<- event.Event) {
@@ -125,6 +314,14 @@ func (c *Collector) run(ctx context.Context, out chan<- event.Event) {
       for ev := range evCh {
         if ev.Type == ct.EventDestroy || (ev.Type == ct.EventNew && c.cfg.EmitConntrackNew) {
           c.handleEvent(ev, out)
+        } else if ev.Type == ct.EventNew && ev.Flow != nil {
+          // Not emitted, but remember when the flow started.
+          c.flowTimes(ev, time.Now().UTC())
+        } else if ev.Type == ct.EventUpdate && ev.Flow != nil && c.cfg.ConntrackInterimInterval > 0 {
+          c.handleUpdate(ev, out)
+        } else if ev.Type == ct.EventUpdate && ev.Flow != nil {
+          // Keeps an active flow from being evicted as stale.
+          c.flows.touch(ev.Flow.ID)
         }
       }
     }()
@@ -160,17 +357,22 @@ func nextBackoff(cur, max time.Duration) time.Duration {
 }
 
 func conntrackState(ev ct.Event) string {
-  if ev.Flow != nil && ev.Flow.ProtoInfo.TCP != nil {
-    return tcpStateName(ev.Flow.ProtoInfo.TCP.State)
-  }
   switch ev.Type {
   case ct.EventNew:
-    return "NEW"
+    return flowStateName(ev.Flow, "NEW")
   case ct.EventDestroy:
-    return "DESTROY"
+    return flowStateName(ev.Flow, "DESTROY")
   default:
-    return ev.Type.String()
+    return flowStateName(ev.Flow, ev.Type.String())
+  }
+}
+
+// flowStateName returns the TCP state, or fallback for stateless protocols.
+func flowStateName(f *ct.Flow, fallback string) string {
+  if f != nil && f.ProtoInfo.TCP != nil {
+    return tcpStateName(f.ProtoInfo.TCP.State)
   }
+  return fallback
 }
 
 func conntrackFlags(ev ct.Event) string {
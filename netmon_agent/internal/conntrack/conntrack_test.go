@@ -0,0 +1,70 @@
+//go:build linux
+
+package conntrack
+
+import (
+  "sync"
+  "testing"
+  "time"
+
+  ct "github.com/ti-mo/conntrack"
+
+  "netmon_agent/internal/config"
+  "netmon_agent/internal/event"
+  "netmon_agent/internal/metrics"
+)
+
+var (
+  testMetricsOnce sync.Once
+  testMetrics     *metrics.Metrics
+)
+
+func ctFlow(id uint32, bytesOrig, bytesReply uint64) *ct.Flow {
+  return &ct.Flow{
+    ID:            id,
+    TupleOrig:     tuple("192.168.1.10", 40000, "93.184.216.34", 443),
+    CountersOrig:  ct.Counter{Bytes: bytesOrig, Packets: bytesOrig / 100},
+    CountersReply: ct.Counter{Bytes: bytesReply, Packets: bytesReply / 100},
+  }
+}
+
+func TestFlowUpdatesAddUpToDestroy(t *testing.T) {
+  cfg := &config.Config{ConntrackInterimInterval: time.Minute}
+  testMetricsOnce.Do(func() { testMetrics = metrics.New() })
+  c := &Collector{cfg: cfg, metrics: testMetrics, flows: newFlowTable(10)}
+  out := make(chan event.Event, 10)
+  t0 := time.Now().UTC()
+
+  c.flowTimes(ct.Event{Type: ct.EventNew, Flow: ctFlow(5, 0, 0)}, t0)
+  // Two dumps of an established flow, one interval apart.
+  c.emitInterim(ct.Event{Type: ct.EventUpdate, Flow: ctFlow(5, 1000, 20000)}, t0.Add(time.Minute), time.Minute, out)
+  c.emitInterim(ct.Event{Type: ct.EventUpdate, Flow: ctFlow(5, 1500, 30000)}, t0.Add(2*time.Minute), time.Minute, out)
+  c.handleEvent(ct.Event{Type: ct.EventDestroy, Flow: ctFlow(5, 1700, 30400)}, out)
+  close(out)
+
+  var sum event.FlowUpdate
+  var updates int
+  var destroy *event.Flow
+  for ev := range out {
+    switch data := ev.Data.(type) {
+    case event.FlowUpdate:
+      updates++
+      sum.BytesOrigDelta += data.BytesOrigDelta
+      sum.BytesReplyDelta += data.BytesReplyDelta
+      sum.PacketsOrigDelta += data.PacketsOrigDelta
+      sum.PacketsReplyDelta += data.PacketsReplyDelta
+    case event.Flow:
+      destroy = &data
+    }
+  }
+  if updates != 3 || destroy == nil || destroy.State != "DESTROY" {
+    t.Fatalf("got %d updates, destroy %+v; want 3 updates then the destroy", updates, destroy)
+  }
+  if sum.BytesOrigDelta != destroy.BytesOrig || sum.BytesReplyDelta != destroy.BytesReply ||
+    sum.PacketsOrigDelta != destroy.PacketsOrig || sum.PacketsReplyDelta != destroy.PacketsReply {
+    t.Fatalf("deltas add up to %+v, destroy totals %+v", sum, *destroy)
+  }
+  if c.flows.len() != 0 {
+    t.Fatal("destroyed flow still tracked")
+  }
+}
@@ -0,0 +1,167 @@
+package conntrack
+
+import (
+  "fmt"
+  "net"
+  "net/netip"
+  "strings"
+  "sync"
+)
+
+const (
+  DirOut     = "OUT"
+  DirIn      = "IN"
+  DirLocal   = "LOCAL"
+  DirRouter  = "ROUTER"
+  DirUnknown = "UNKNOWN"
+)
+
+// Classifier labels flows relative to the LAN subnets and the router's own
+// addresses.
+type Classifier struct {
+  lan    []netip.Prefix
+  mu     sync.RWMutex
+  router map[netip.Addr]struct{}
+}
+
+func NewClassifier(lanSubnets []string, routerAddrs []netip.Addr) (*Classifier, error) {
+  c := &Classifier{}
+  for _, s := range lanSubnets {
+    s = strings.TrimSpace(s)
+    if s == "" {
+      continue
+    }
+    p, err := netip.ParsePrefix(s)
+    if err != nil {
+      return nil, fmt.Errorf("lan_subnets %q: %w", s, err)
+    }
+    c.lan = append(c.lan, p.Masked())
+  }
+  c.SetRouterAddrs(routerAddrs)
+  return c, nil
+}
+
+// SetRouterAddrs replaces the set of addresses owned by the router, e.g. after
+// a DHCP renewal on the WAN side.
+func (c *Classifier) SetRouterAddrs(addrs []netip.Addr) {
+  router := make(map[netip.Addr]struct{}, len(addrs))
+  for _, a := range addrs {
+    router[a.Unmap()] = struct{}{}
+  }
+  c.mu.Lock()
+  c.router = router
+  c.mu.Unlock()
+}
+
+// Classify returns the direction of a flow. dst should be the real peer, i.e.
+// the reply tuple source when the flow was DNATed.
+func (c *Classifier) Classify(src, dst netip.Addr) string {
+  src = src.Unmap()
+  dst = dst.Unmap()
+  if c.isRouter(src) || c.isRouter(dst) {
+    return DirRouter
+  }
+  srcLAN := c.isLAN(src)
+  dstLAN := c.isLAN(dst)
+  switch {
+  case srcLAN && dstLAN:
+    return DirLocal
+  case srcLAN:
+    return DirOut
+  case dstLAN:
+    return DirIn
+  default:
+    return DirUnknown
+  }
+}
+
+func (c *Classifier) isRouter(a netip.Addr) bool {
+  if a.IsLoopback() {
+    return true
+  }
+  c.mu.RLock()
+  defer c.mu.RUnlock()
+  _, ok := c.router[a]
+  return ok
+}
+
+func (c *Classifier) isLAN(a netip.Addr) bool {
+  for _, p := range c.lan {
+    if p.Contains(a) {
+      return true
+    }
+  }
+  return false
+}
+
+// RefreshRouterAddrs replaces the router's addresses with those on every
+// interface. If they cannot be listed the previous set is kept: an empty one
+// would turn every router flow into a transit flow until the next refresh.
+func (c *Classifier) RefreshRouterAddrs(list interfaceLister) error {
+  addrs, _, err := interfacePrefixes(list, nil)
+  if err != nil {
+    return err
+  }
+  c.SetRouterAddrs(addrs)
+  return nil
+}
+
+// interfaceLister returns the addresses configured on the named interfaces,
+// or on every interface when names is empty.
+type interfaceLister func(names []string) ([]net.Addr, error)
+
+// systemInterfaceAddrs lists interface addresses from the kernel. A named
+// interface that does not exist is skipped.
+func systemInterfaceAddrs(names []string) ([]net.Addr, error) {
+  var ifaces []net.Interface
+  if len(names) == 0 {
+    all, err := net.Interfaces()
+    if err != nil {
+      return nil, err
+    }
+    ifaces = all
+  } else {
+    for _, name := range names {
+      iface, err := net.InterfaceByName(name)
+      if err != nil {
+        continue
+      }
+      ifaces = append(ifaces, *iface)
+    }
+  }
+  var addrs []net.Addr
+  for _, iface := range ifaces {
+    ifAddrs, err := iface.Addrs()
+    if err != nil {
+      return nil, fmt.Errorf("%s: %w", iface.Name, err)
+    }
+    addrs = append(addrs, ifAddrs...)
+  }
+  return addrs, nil
+}
+
+// interfacePrefixes returns the addresses and subnets configured on the named
+// interfaces. An empty names list means every interface.
+func interfacePrefixes(list interfaceLister, names []string) ([]netip.Addr, []netip.Prefix, error) {
+  ifAddrs, err := list(names)
+  if err != nil {
+    return nil, nil, err
+  }
+  var addrs []netip.Addr
+  var prefixes []netip.Prefix
+  for _, a := range ifAddrs {
+    ipnet, ok := a.(*net.IPNet)
+    if !ok {
+      continue
+    }
+    addr, ok := netip.AddrFromSlice(ipnet.IP)
+    if !ok {
+      continue
+    }
+    addr = addr.Unmap()
+    ones, _ := ipnet.Mask.Size()
+    addrs = append(addrs, addr)
+    prefixes = append(prefixes, netip.PrefixFrom(addr, ones).Masked())
+  }
+  return addrs, prefixes, nil
+}
@@ -0,0 +1,109 @@
+package conntrack
+
+import (
+  "errors"
+  "net"
+  "net/netip"
+  "testing"
+)
+
+func TestClassify(t *testing.T) {
+  c, err := NewClassifier(
+    []string{"10.0.0.0/24", "192.168.50.0/24", "fd00:1234::/64"},
+    []netip.Addr{
+      netip.MustParseAddr("10.0.0.1"),
+      netip.MustParseAddr("198.51.100.2"),
+      netip.MustParseAddr("fd00:1234::1"),
+      netip.MustParseAddr("2001:db8:ffff::2"),
+    },
+  )
+  if err != nil {
+    t.Fatalf("NewClassifier: %v", err)
+  }
+
+  tests := []struct {
+    name string
+    src  string
+    dst  string
+    want string
+  }{
+    {"v4 lan to internet", "10.0.0.20", "142.250.72.46", DirOut},
+    {"v4 internet to forwarded lan host", "203.0.113.9", "10.0.0.20", DirIn},
+    {"v4 lan to lan", "10.0.0.20", "10.0.0.30", DirLocal},
+    {"v4 lan to second lan subnet", "10.0.0.20", "192.168.50.7", DirLocal},
+    {"v4 lan to router lan address", "10.0.0.20", "10.0.0.1", DirRouter},
+    {"v4 internet to router wan address", "203.0.113.9", "198.51.100.2", DirRouter},
+    {"v4 router to internet", "198.51.100.2", "1.1.1.1", DirRouter},
+    {"v4 loopback", "127.0.0.1", "127.0.0.1", DirRouter},
+    {"v4 mapped lan to internet", "::ffff:10.0.0.20", "::ffff:8.8.8.8", DirOut},
+    {"v4 transit", "203.0.113.9", "8.8.8.8", DirUnknown},
+    {"v6 lan to internet", "fd00:1234::20", "2606:4700::1111", DirOut},
+    {"v6 internet to lan", "2606:4700::1111", "fd00:1234::20", DirIn},
+    {"v6 lan to lan", "fd00:1234::20", "fd00:1234::30", DirLocal},
+    {"v6 lan to router", "fd00:1234::20", "fd00:1234::1", DirRouter},
+    {"v6 internet to router wan", "2606:4700::1111", "2001:db8:ffff::2", DirRouter},
+    {"v6 outside lan prefix", "fd00:1234:0:1::20", "2606:4700::1111", DirUnknown},
+    {"v6 loopback", "::1", "::1", DirRouter},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      got := c.Classify(netip.MustParseAddr(tt.src), netip.MustParseAddr(tt.dst))
+      if got != tt.want {
+        t.Fatalf("Classify(%s, %s) = %s, want %s", tt.src, tt.dst, got, tt.want)
+      }
+    })
+  }
+}
+
+func TestClassifyRouterAddrsRefresh(t *testing.T) {
+  c, err := NewClassifier([]string{"10.0.0.0/24"}, []netip.Addr{netip.MustParseAddr("198.51.100.2")})
+  if err != nil {
+    t.Fatalf("NewClassifier: %v", err)
+  }
+  src := netip.MustParseAddr("203.0.113.9")
+  oldWAN := netip.MustParseAddr("198.51.100.2")
+  newWAN := netip.MustParseAddr("198.51.100.77")
+
+  c.SetRouterAddrs([]netip.Addr{newWAN})
+  if got := c.Classify(src, newWAN); got != DirRouter {
+    t.Fatalf("new wan address: got %s, want %s", got, DirRouter)
+  }
+  if got := c.Classify(src, oldWAN); got != DirUnknown {
+    t.Fatalf("old wan address: got %s, want %s", got, DirUnknown)
+  }
+}
+
+func TestNewClassifierInvalidSubnet(t *testing.T) {
+  if _, err := NewClassifier([]string{"10.0.0.0/33"}, nil); err == nil {
+    t.Fatal("expected error for invalid CIDR")
+  }
+}
+
+func TestRefreshRouterAddrsKeepsSetOnError(t *testing.T) {
+  c, err := NewClassifier([]string{"10.0.0.0/24"}, nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  src := netip.MustParseAddr("203.0.113.9")
+  wan := netip.MustParseAddr("198.51.100.2")
+  lister := func([]string) ([]net.Addr, error) {
+    return []net.Addr{&net.IPNet{IP: net.ParseIP("198.51.100.2"), Mask: net.CIDRMask(24, 32)}}, nil
+  }
+  if err := c.RefreshRouterAddrs(lister); err != nil {
+    t.Fatal(err)
+  }
+  if got := c.Classify(src, wan); got != DirRouter {
+    t.Fatalf("after refresh: got %s, want %s", got, DirRouter)
+  }
+
+  failing := func([]string) ([]net.Addr, error) {
+    return nil, errors.New("netlink receive: interrupted system call")
+  }
+  if err := c.RefreshRouterAddrs(failing); err == nil {
+    t.Fatal("failed listing not reported")
+  }
+  if got := c.Classify(src, wan); got != DirRouter {
+    t.Fatalf("after failed refresh: got %s, want %s", got, DirRouter)
+  }
+}
@@ -0,0 +1,154 @@
+package conntrack
+
+import (
+  "container/list"
+  "sync"
+  "time"
+)
+
+type flowState struct {
+  id        uint32
+  firstSeen time.Time
+
+  // interim accounting
+  reported   bool
+  lastReport time.Time
+  last       counters
+}
+
+type counters struct {
+  bytesOrig    uint64
+  bytesReply   uint64
+  packetsOrig  uint64
+  packetsReply uint64
+}
+
+func (c counters) sub(prev counters) counters {
+  return counters{
+    bytesOrig:    delta(c.bytesOrig, prev.bytesOrig),
+    bytesReply:   delta(c.bytesReply, prev.bytesReply),
+    packetsOrig:  delta(c.packetsOrig, prev.packetsOrig),
+    packetsReply: delta(c.packetsReply, prev.packetsReply),
+  }
+}
+
+// delta treats a counter that went backwards (zeroed by the kernel) as
+// restarting from zero.
+func delta(cur, prev uint64) uint64 {
+  if cur < prev {
+    return cur
+  }
+  return cur - prev
+}
+
+// flowTable remembers per-flow state by conntrack ID for kernels without
+// nf_conntrack_timestamp. It is capped; when full the flow seen least recently
+// is evicted, so a burst of short flows cannot push out long-lived ones that
+// keep being updated.
+type flowTable struct {
+  mu    sync.Mutex
+  max   int
+  order *list.List // least recently seen first
+  byID  map[uint32]*list.Element
+}
+
+func newFlowTable(max int) *flowTable {
+  return &flowTable{max: max, order: list.New(), byID: make(map[uint32]*list.Element)}
+}
+
+// observe returns the state for id, creating it with firstSeen=now if absent,
+// and marks it as the most recently seen. started means the flow was seen at
+// NEW, so its counters start from zero and the first interim report covers it
+// from the start. evicted reports whether another flow had to be dropped to
+// make room.
+func (t *flowTable) observe(id uint32, now time.Time, started bool) (st *flowState, evicted bool) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if el, ok := t.byID[id]; ok {
+    t.order.MoveToBack(el)
+    return el.Value.(*flowState), false
+  }
+  if t.max <= 0 {
+    return &flowState{id: id, firstSeen: now}, false
+  }
+  if t.order.Len() >= t.max {
+    stale := t.order.Front()
+    t.order.Remove(stale)
+    delete(t.byID, stale.Value.(*flowState).id)
+    evicted = true
+  }
+  st = &flowState{id: id, firstSeen: now, reported: started, lastReport: now}
+  t.byID[id] = t.order.PushBack(st)
+  return st, evicted
+}
+
+// touch marks id, if tracked, as the most recently seen.
+func (t *flowTable) touch(id uint32) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if el, ok := t.byID[id]; ok {
+    t.order.MoveToBack(el)
+  }
+}
+
+// remove drops id and returns its state, if it was tracked.
+func (t *flowTable) remove(id uint32) (*flowState, bool) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  el, ok := t.byID[id]
+  if !ok {
+    return nil, false
+  }
+  t.order.Remove(el)
+  delete(t.byID, id)
+  return el.Value.(*flowState), true
+}
+
+// interim returns the counter deltas for id since its last report, at most
+// once per every. For a flow first seen mid-life the first call only records
+// a baseline.
+func (t *flowTable) interim(id uint32, cur counters, now time.Time, every time.Duration) (counters, time.Duration, bool) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  el, ok := t.byID[id]
+  if !ok {
+    return counters{}, 0, false
+  }
+  st := el.Value.(*flowState)
+  if !st.reported {
+    st.reported = true
+    st.lastReport = now
+    st.last = cur
+    return counters{}, 0, false
+  }
+  since := now.Sub(st.lastReport)
+  if since < every {
+    return counters{}, 0, false
+  }
+  d := cur.sub(st.last)
+  st.lastReport = now
+  st.last = cur
+  return d, since, true
+}
+
+// final returns the counter deltas for id since its last report, due or not,
+// for the report closing a destroyed flow. A flow without a baseline has none.
+func (t *flowTable) final(id uint32, cur counters, now time.Time) (counters, time.Duration, bool) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  el, ok := t.byID[id]
+  if !ok {
+    return counters{}, 0, false
+  }
+  st := el.Value.(*flowState)
+  if !st.reported {
+    return counters{}, 0, false
+  }
+  return cur.sub(st.last), now.Sub(st.lastReport), true
+}
+
+func (t *flowTable) len() int {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  return t.order.Len()
+}
@@ -0,0 +1,162 @@
+package conntrack
+
+import (
+  "testing"
+  "time"
+)
+
+func TestFlowTableFirstSeen(t *testing.T) {
+  ft := newFlowTable(10)
+  t0 := time.Date(2026, 2, 20, 14, 0, 0, 0, time.UTC)
+
+  st, _ := ft.observe(42, t0, true)
+  if !st.firstSeen.Equal(t0) {
+    t.Fatalf("firstSeen = %v, want %v", st.firstSeen, t0)
+  }
+  st, _ = ft.observe(42, t0.Add(time.Minute), false)
+  if !st.firstSeen.Equal(t0) {
+    t.Fatalf("second observe changed firstSeen to %v", st.firstSeen)
+  }
+  st, ok := ft.remove(42)
+  if !ok || !st.firstSeen.Equal(t0) {
+    t.Fatalf("remove = %v, %v", st, ok)
+  }
+  if _, ok := ft.remove(42); ok {
+    t.Fatal("flow still tracked after remove")
+  }
+}
+
+func TestFlowTableEvictsLeastRecentlySeen(t *testing.T) {
+  ft := newFlowTable(3)
+  now := time.Now()
+  for id := uint32(1); id <= 3; id++ {
+    if _, evicted := ft.observe(id, now, false); evicted {
+      t.Fatalf("unexpected eviction at id %d", id)
+    }
+  }
+  // Seen again, flow 1 is no longer the first to go.
+  ft.observe(1, now, false)
+  if _, evicted := ft.observe(4, now, false); !evicted {
+    t.Fatal("expected eviction when full")
+  }
+  if ft.len() != 3 {
+    t.Fatalf("len = %d, want 3", ft.len())
+  }
+  if _, ok := ft.remove(2); ok {
+    t.Fatal("least recently seen flow should have been evicted")
+  }
+  for _, id := range []uint32{1, 3, 4} {
+    if _, ok := ft.remove(id); !ok {
+      t.Fatalf("flow %d missing", id)
+    }
+  }
+}
+
+func TestFlowTableKeepsLongLivedFlow(t *testing.T) {
+  ft := newFlowTable(100)
+  t0 := time.Date(2026, 2, 20, 14, 0, 0, 0, time.UTC)
+  ft.observe(1, t0, true)
+  ft.interim(1, counters{}, t0, time.Minute)
+
+  // A scan opens far more short flows than the table holds, while the long
+  // flow keeps getting updates.
+  for id := uint32(2); id < 2000; id++ {
+    now := t0.Add(time.Duration(id) * time.Millisecond)
+    ft.observe(id, now, true)
+    if id%50 == 0 {
+      ft.observe(1, now, false)
+    }
+  }
+  st, ok := ft.remove(1)
+  if !ok || !st.firstSeen.Equal(t0) {
+    t.Fatalf("long-lived flow evicted: %v, %v", st, ok)
+  }
+  if ft.len() != 99 {
+    t.Fatalf("len = %d, want 99", ft.len())
+  }
+}
+
+func TestFlowTableInterim(t *testing.T) {
+  ft := newFlowTable(10)
+  t0 := time.Date(2026, 2, 20, 14, 0, 0, 0, time.UTC)
+  every := time.Minute
+  ft.observe(7, t0, true)
+
+  if _, _, ok := ft.interim(7, counters{bytesOrig: 500, packetsOrig: 5}, t0.Add(30*time.Second), every); ok {
+    t.Fatal("report before interval elapsed")
+  }
+  d, since, ok := ft.interim(7, counters{bytesOrig: 1100, bytesReply: 9000, packetsOrig: 11, packetsReply: 8}, t0.Add(61*time.Second), every)
+  if !ok {
+    t.Fatal("expected report after interval")
+  }
+  // Seen at NEW: the first report covers the flow from its start.
+  want := counters{bytesOrig: 1100, bytesReply: 9000, packetsOrig: 11, packetsReply: 8}
+  if d != want || since != 61*time.Second {
+    t.Fatalf("delta = %+v over %v, want %+v over 61s", d, since, want)
+  }
+
+  d, since, ok = ft.interim(7, counters{bytesOrig: 1600, bytesReply: 9000, packetsOrig: 16, packetsReply: 8}, t0.Add(2*time.Minute + time.Second), every)
+  want = counters{bytesOrig: 500, packetsOrig: 5}
+  if !ok || d != want || since != time.Minute {
+    t.Fatalf("second report: delta = %+v over %v, ok = %v", d, since, ok)
+  }
+
+  d, _, ok = ft.interim(7, counters{bytesOrig: 40}, t0.Add(4*time.Minute), every)
+  if !ok || d.bytesOrig != 40 {
+    t.Fatalf("counter reset: delta = %+v, ok = %v", d, ok)
+  }
+
+  if _, _, ok := ft.interim(8, counters{}, t0.Add(time.Hour), every); ok {
+    t.Fatal("untracked flow reported")
+  }
+}
+
+func TestFlowTableInterimMidLife(t *testing.T) {
+  ft := newFlowTable(10)
+  t0 := time.Date(2026, 2, 20, 14, 0, 0, 0, time.UTC)
+  every := time.Minute
+  ft.observe(9, t0, false)
+
+  // Counters accumulated before the agent saw the flow are not a delta.
+  if _, _, ok := ft.interim(9, counters{bytesOrig: 100000, packetsOrig: 100}, t0, every); ok {
+    t.Fatal("first call should only record a baseline")
+  }
+  d, _, ok := ft.interim(9, counters{bytesOrig: 100250, packetsOrig: 103}, t0.Add(time.Minute), every)
+  if want := (counters{bytesOrig: 250, packetsOrig: 3}); !ok || d != want {
+    t.Fatalf("delta = %+v, ok = %v; want %+v", d, ok, want)
+  }
+}
+
+func TestFlowTableFinal(t *testing.T) {
+  ft := newFlowTable(10)
+  t0 := time.Date(2026, 2, 20, 14, 0, 0, 0, time.UTC)
+  ft.observe(7, t0, true)
+  ft.interim(7, counters{bytesOrig: 1000, packetsOrig: 10}, t0.Add(time.Minute), time.Minute)
+
+  // Due or not, the final report covers what the last interim one did not.
+  d, since, ok := ft.final(7, counters{bytesOrig: 1200, bytesReply: 50, packetsOrig: 12, packetsReply: 1}, t0.Add(70*time.Second))
+  if want := (counters{bytesOrig: 200, bytesReply: 50, packetsOrig: 2, packetsReply: 1}); !ok || d != want || since != 10*time.Second {
+    t.Fatalf("final = %+v over %v, ok = %v; want %+v over 10s", d, since, ok, want)
+  }
+
+  ft.observe(9, t0, false)
+  if _, _, ok := ft.final(9, counters{bytesOrig: 500}, t0.Add(time.Minute)); ok {
+    t.Fatal("flow without a baseline got a final delta")
+  }
+}
+
+func TestFlowTableTouch(t *testing.T) {
+  ft := newFlowTable(2)
+  now := time.Now()
+  ft.observe(1, now, false)
+  ft.observe(2, now, false)
+  ft.touch(1)
+  ft.touch(3) // untracked: no-op
+  ft.observe(3, now, false)
+  if _, ok := ft.remove(1); !ok {
+    t.Fatal("touched flow evicted")
+  }
+  if ft.len() != 1 {
+    t.Fatalf("len = %d, want 1", ft.len())
+  }
+}
@@ -0,0 +1,29 @@
+package conntrack
+
+import (
+  ct "github.com/ti-mo/conntrack"
+
+  "netmon_agent/internal/event"
+)
+
+// flowICMP returns the ICMP type/code/id of an ICMP or ICMPv6 conntrack tuple,
+// or nil for other protocols. Conntrack only tracks query types (echo,
+// timestamp, ...); errors are RELATED to the flow they quote.
+func flowICMP(t ct.ProtoTuple) *event.ICMP {
+  if !t.ICMPv4 && !t.ICMPv6 && t.Protocol != 1 && t.Protocol != 58 {
+    return nil
+  }
+  icmp := &event.ICMP{Type: int(t.ICMPType), Code: int(t.ICMPCode)}
+  if isEcho(t) {
+    id := int(t.ICMPID)
+    icmp.EchoID = &id
+  }
+  return icmp
+}
+
+func isEcho(t ct.ProtoTuple) bool {
+  if t.ICMPv6 || t.Protocol == 58 {
+    return t.ICMPType == 128 || t.ICMPType == 129
+  }
+  return t.ICMPType == 8 || t.ICMPType == 0
+}
@@ -0,0 +1,28 @@
+package conntrack
+
+import (
+  "testing"
+
+  ct "github.com/ti-mo/conntrack"
+)
+
+func TestFlowICMP(t *testing.T) {
+  if got := flowICMP(ct.ProtoTuple{Protocol: 6, SourcePort: 1, DestinationPort: 2}); got != nil {
+    t.Fatalf("tcp tuple: got %+v, want nil", got)
+  }
+
+  echo := flowICMP(ct.ProtoTuple{Protocol: 1, ICMPv4: true, ICMPType: 8, ICMPID: 0x1234})
+  if echo == nil || echo.Type != 8 || echo.Code != 0 || echo.EchoID == nil || *echo.EchoID != 0x1234 {
+    t.Fatalf("icmp echo: got %+v", echo)
+  }
+
+  echo6 := flowICMP(ct.ProtoTuple{Protocol: 58, ICMPv6: true, ICMPType: 128, ICMPID: 7})
+  if echo6 == nil || echo6.Type != 128 || echo6.EchoID == nil || *echo6.EchoID != 7 {
+    t.Fatalf("icmpv6 echo: got %+v", echo6)
+  }
+
+  ts := flowICMP(ct.ProtoTuple{Protocol: 1, ICMPv4: true, ICMPType: 13, ICMPID: 9})
+  if ts == nil || ts.Type != 13 || ts.EchoID != nil {
+    t.Fatalf("icmp timestamp: got %+v", ts)
+  }
+}
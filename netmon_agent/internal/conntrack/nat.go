@@ -0,0 +1,34 @@
+package conntrack
+
+import (
+  ct "github.com/ti-mo/conntrack"
+
+  "netmon_agent/internal/event"
+)
+
+// applyReplyTuple copies the reply direction onto the flow and derives the NAT
+// translation from it. Without NAT the reply tuple is the original one
+// mirrored; with SNAT the reply is addressed to the translated source, with
+// DNAT it comes from the translated destination.
+func applyReplyTuple(flow *event.Flow, f *ct.Flow) {
+  orig := f.TupleOrig
+  reply := f.TupleReply
+  if !reply.IP.SourceAddress.IsValid() || !reply.IP.DestinationAddress.IsValid() {
+    return
+  }
+  flow.ReplySrcIP = reply.IP.SourceAddress.String()
+  flow.ReplyDstIP = reply.IP.DestinationAddress.String()
+  flow.ReplySrcPort = int(reply.Proto.SourcePort)
+  flow.ReplyDstPort = int(reply.Proto.DestinationPort)
+
+  if reply.IP.DestinationAddress != orig.IP.SourceAddress || reply.Proto.DestinationPort != orig.Proto.SourcePort || f.Status.SrcNAT() {
+    flow.SNAT = true
+    flow.NATSrcIP = flow.ReplyDstIP
+    flow.NATSrcPort = flow.ReplyDstPort
+  }
+  if reply.IP.SourceAddress != orig.IP.DestinationAddress || reply.Proto.SourcePort != orig.Proto.DestinationPort || f.Status.DstNAT() {
+    flow.DNAT = true
+    flow.NATDstIP = flow.ReplySrcIP
+    flow.NATDstPort = flow.ReplySrcPort
+  }
+}
@@ -0,0 +1,80 @@
+package conntrack
+
+import (
+  "net/netip"
+  "testing"
+
+  ct "github.com/ti-mo/conntrack"
+
+  "netmon_agent/internal/event"
+)
+
+func tuple(src string, sport uint16, dst string, dport uint16) ct.Tuple {
+  return ct.Tuple{
+    IP:    ct.IPTuple{SourceAddress: netip.MustParseAddr(src), DestinationAddress: netip.MustParseAddr(dst)},
+    Proto: ct.ProtoTuple{Protocol: 6, SourcePort: sport, DestinationPort: dport},
+  }
+}
+
+func TestApplyReplyTuple(t *testing.T) {
+  tests := []struct {
+    name     string
+    orig     ct.Tuple
+    reply    ct.Tuple
+    snat     bool
+    dnat     bool
+    natSrc   string
+    natSPort int
+    natDst   string
+    natDPort int
+  }{
+    {
+      name:  "no nat",
+      orig:  tuple("10.0.0.20", 51422, "10.0.0.30", 22),
+      reply: tuple("10.0.0.30", 22, "10.0.0.20", 51422),
+    },
+    {
+      name:     "masquerade",
+      orig:     tuple("10.0.0.20", 51422, "142.250.72.46", 443),
+      reply:    tuple("142.250.72.46", 443, "198.51.100.2", 61001),
+      snat:     true,
+      natSrc:   "198.51.100.2",
+      natSPort: 61001,
+    },
+    {
+      name:     "port forward",
+      orig:     tuple("203.0.113.9", 40000, "198.51.100.2", 8022),
+      reply:    tuple("10.0.0.20", 22, "203.0.113.9", 40000),
+      dnat:     true,
+      natDst:   "10.0.0.20",
+      natDPort: 22,
+    },
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      var flow event.Flow
+      applyReplyTuple(&flow, &ct.Flow{TupleOrig: tt.orig, TupleReply: tt.reply})
+      if flow.ReplySrcIP != tt.reply.IP.SourceAddress.String() || flow.ReplyDstPort != int(tt.reply.Proto.DestinationPort) {
+        t.Fatalf("reply tuple not copied: %+v", flow)
+      }
+      if flow.SNAT != tt.snat || flow.DNAT != tt.dnat {
+        t.Fatalf("snat/dnat = %v/%v, want %v/%v", flow.SNAT, flow.DNAT, tt.snat, tt.dnat)
+      }
+      if flow.NATSrcIP != tt.natSrc || flow.NATSrcPort != tt.natSPort {
+        t.Fatalf("nat src = %s:%d, want %s:%d", flow.NATSrcIP, flow.NATSrcPort, tt.natSrc, tt.natSPort)
+      }
+      if flow.NATDstIP != tt.natDst || flow.NATDstPort != tt.natDPort {
+        t.Fatalf("nat dst = %s:%d, want %s:%d", flow.NATDstIP, flow.NATDstPort, tt.natDst, tt.natDPort)
+      }
+    })
+  }
+}
+
+func TestApplyReplyTupleMissing(t *testing.T) {
+  var flow event.Flow
+  applyReplyTuple(&flow, &ct.Flow{TupleOrig: tuple("10.0.0.20", 1, "10.0.0.30", 2)})
+  if flow.ReplySrcIP != "" || flow.SNAT || flow.DNAT {
+    t.Fatalf("expected no reply data, got %+v", flow)
+  }
+}
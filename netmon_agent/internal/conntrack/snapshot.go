@@ -0,0 +1,124 @@
+//go:build linux
+
+package conntrack
+
+import (
+  "context"
+  "log"
+  "time"
+
+  ct "github.com/ti-mo/conntrack"
+
+  "netmon_agent/internal/event"
+  "netmon_agent/internal/util"
+)
+
+// snapshotLoop periodically dumps the conntrack table so long-lived flows are
+// visible before they are destroyed.
+func (c *Collector) snapshotLoop(ctx context.Context, out chan<- event.Event) {
+  c.dumpLoop(ctx, "snapshot", c.cfg.ConntrackSnapshotInterval, func(flows []ct.Flow, now time.Time) {
+    c.metrics.ConntrackSnapshotFlows.Set(float64(len(flows)))
+    c.emitSnapshot(flows, now, out)
+  })
+}
+
+// interimLoop dumps the conntrack table once per conntrack_interim_interval
+// so every open flow reports its deltas. Kernel UPDATE events only fire on
+// state changes, so an established flow moving data sends none.
+func (c *Collector) interimLoop(ctx context.Context, out chan<- event.Event) {
+  every := c.cfg.ConntrackInterimInterval
+  // A flow reported at the previous dump is due at this one even if the
+  // ticker fires a little early.
+  due := every - every/4
+  c.dumpLoop(ctx, "interim", every, func(flows []ct.Flow, now time.Time) {
+    for i := range flows {
+      c.emitInterim(ct.Event{Type: ct.EventUpdate, Flow: &flows[i]}, now, due, out)
+    }
+  })
+}
+
+// dumpLoop dumps the conntrack table every interval and hands the flows to
+// handle, redialing after a failure.
+func (c *Collector) dumpLoop(ctx context.Context, name string, every time.Duration, handle func([]ct.Flow, time.Time)) {
+  ticker := time.NewTicker(every)
+  defer ticker.Stop()
+
+  var conn *ct.Conn
+  defer func() {
+    if conn != nil {
+      _ = conn.Close()
+    }
+  }()
+
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+      if conn == nil {
+        var err error
+        conn, err = ct.Dial(nil)
+        if err != nil {
+          c.metrics.ConntrackSnapshotErrors.Inc()
+          log.Printf("conntrack %s dial failed: %v", name, err)
+          conn = nil
+          continue
+        }
+      }
+      flows, err := conn.Dump(nil)
+      if err != nil {
+        c.metrics.ConntrackSnapshotErrors.Inc()
+        log.Printf("conntrack %s dump failed: %v", name, err)
+        _ = conn.Close()
+        conn = nil
+        continue
+      }
+      handle(flows, time.Now().UTC())
+    }
+  }
+}
+
+func (c *Collector) emitSnapshot(flows []ct.Flow, now time.Time, out chan<- event.Event) {
+  total := len(flows)
+  keep, truncated := snapshotLimit(len(flows), c.cfg.ConntrackSnapshotMaxFlows)
+  flows = flows[:keep]
+
+  if c.cfg.ConntrackSnapshotMode == "flow" {
+    for i := range flows {
+      ev := ct.Event{Type: ct.EventUpdate, Flow: &flows[i]}
+      flow := c.buildFlow(ev, "SNAPSHOT", flowStateName(ev.Flow, "ACTIVE"), now)
+      if !util.TrySend(out, c.metrics, "flow_snapshot", event.Event{Type: "flow_snapshot", TS: now, Data: flow}) {
+        return
+      }
+    }
+    return
+  }
+
+  entries := make([]event.FlowTableEntry, 0, len(flows))
+  for i := range flows {
+    ev := ct.Event{Type: ct.EventUpdate, Flow: &flows[i]}
+    flow := c.buildFlow(ev, "SNAPSHOT", flowStateName(ev.Flow, "ACTIVE"), now)
+    entries = append(entries, event.FlowTableEntry{
+      ID:           flows[i].ID,
+      State:        flow.State,
+      SrcIP:        flow.SrcIP,
+      DstIP:        flow.DstIP,
+      SrcPort:      flow.SrcPort,
+      DstPort:      flow.DstPort,
+      L4Proto:      flow.L4Proto,
+      Dir:          flow.Dir,
+      NATSrcIP:     flow.NATSrcIP,
+      NATSrcPort:   flow.NATSrcPort,
+      BytesOrig:    flow.BytesOrig,
+      BytesReply:   flow.BytesReply,
+      PacketsOrig:  flow.PacketsOrig,
+      PacketsReply: flow.PacketsReply,
+      FirstSeen:    flow.FirstSeen,
+    })
+  }
+  for _, table := range flowTableChunks(entries, total, truncated, flowTableChunk, now) {
+    if !util.TrySend(out, c.metrics, "flow_table", event.Event{Type: "flow_table", TS: now, Data: table}) {
+      return
+    }
+  }
+}
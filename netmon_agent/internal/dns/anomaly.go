@@ -0,0 +1,303 @@
+package dns
+
+import (
+  "math"
+  "sort"
+  "strings"
+  "time"
+
+  "golang.org/x/net/publicsuffix"
+
+  "netmon_agent/internal/event"
+  "netmon_agent/internal/util"
+)
+
+// The anomaly detector keeps each client's queries over a sliding window and
+// scores them with two heuristics:
+//
+//   - dga: random-looking registrable names that mostly do not exist
+//     (label entropy, NXDOMAIN ratio)
+//   - tunneling: data smuggled in query names or TXT/NULL records (long
+//     labels, many unique subdomains of one parent, TXT/NULL rate, entropy)
+//
+// Each feature is mapped linearly from its "normal" value to a value that is
+// suspicious on its own, giving a score in [0, 1]. A client is reported when
+// the higher of the two weighted sums reaches the threshold.
+const (
+  anomalyKindDGA       = "dga"
+  anomalyKindTunneling = "tunneling"
+
+  // anomalyMaxQueries bounds the queries kept per client in the window.
+  anomalyMaxQueries = 1024
+  anomalyMaxSamples = 5
+  longLabelLen      = 40
+)
+
+// featureRange maps a feature value onto [0, 1].
+type featureRange struct{ normal, suspicious float64 }
+
+var (
+  entropyRange   = featureRange{3.0, 3.8} // mean bits per character
+  longLabelRange = featureRange{0, 0.25}  // share of queries
+  txtNullRange   = featureRange{0.05, 0.3}
+  subdomainRange = featureRange{10, 50} // unique subdomains of one parent
+  nxdomainRange  = featureRange{0.1, 0.5}
+)
+
+func (r featureRange) score(v float64) float64 {
+  s := (v - r.normal) / (r.suspicious - r.normal)
+  return math.Max(0, math.Min(1, s))
+}
+
+type anomalyDetector struct {
+  window     time.Duration
+  threshold  float64
+  minQueries int
+  cooldown   time.Duration
+  // clients is bounded by dns_anomaly_max_clients; evaluate drops those with
+  // nothing left in the window.
+  clients *util.LRU[string, *anomalyClient]
+}
+
+// anomalyClient holds observations in ascending time order, which evaluate
+// relies on to cut the window.
+type anomalyClient struct {
+  queries   []anomalyQuery
+  nxdomain  []time.Time
+  lastAlert time.Time
+}
+
+type anomalyQuery struct {
+  at      time.Time
+  qname   string
+  parent  string
+  sub     string
+  entropy float64
+  long    bool
+  txtNull bool
+}
+
+func newAnomalyDetector(window time.Duration, threshold float64, minQueries int, cooldown time.Duration, maxClients int) *anomalyDetector {
+  return &anomalyDetector{
+    window: window,
+    threshold: threshold,
+    minQueries: minQueries,
+    cooldown: cooldown,
+    clients: util.NewLRU[string, *anomalyClient](maxClients, 0),
+  }
+}
+
+// observeQuery records a client query. Reverse lookups are ignored.
+func (d *anomalyDetector) observeQuery(client, qname, qtype string, at time.Time) {
+  name := strings.ToLower(strings.TrimSuffix(qname, "."))
+  if client == "" || name == "" || qtype == "PTR" || strings.HasSuffix(name, ".arpa") {
+    return
+  }
+  q := anomalyQuery{at: at, qname: name, txtNull: isTXTOrNull(qtype)}
+  q.parent, q.sub = splitParent(name)
+  for _, label := range strings.Split(strings.TrimSuffix(name, suffixOf(name)), ".") {
+    if len(label) >= longLabelLen {
+      q.long = true
+    }
+    q.entropy = math.Max(q.entropy, labelEntropy(label))
+  }
+  c := d.client(client, at)
+  c.queries = append(c.queries, q)
+  i := len(c.queries) - 1
+  for ; i > 0 && c.queries[i-1].at.After(at); i-- {
+    c.queries[i] = c.queries[i-1]
+  }
+  c.queries[i] = q
+  if len(c.queries) > anomalyMaxQueries {
+    c.queries = c.queries[1:]
+  }
+}
+
+// observeNXDomain records an NXDOMAIN answer to a client.
+func (d *anomalyDetector) observeNXDomain(client string, at time.Time) {
+  if client == "" {
+    return
+  }
+  c := d.client(client, at)
+  c.nxdomain = append(c.nxdomain, at)
+  i := len(c.nxdomain) - 1
+  for ; i > 0 && c.nxdomain[i-1].After(at); i-- {
+    c.nxdomain[i] = c.nxdomain[i-1]
+  }
+  c.nxdomain[i] = at
+  if len(c.nxdomain) > anomalyMaxQueries {
+    c.nxdomain = c.nxdomain[1:]
+  }
+}
+
+func (d *anomalyDetector) client(ip string, now time.Time) *anomalyClient {
+  c, ok := d.clients.Get(ip, now)
+  if !ok {
+    c = &anomalyClient{}
+    d.clients.Put(ip, c, now)
+  }
+  return c
+}
+
+// evaluate drops observations older than the window and returns an anomaly
+// for each client over the threshold that has not been reported within the
+// cooldown. SampleQNames are the raw names; the caller renders them.
+func (d *anomalyDetector) evaluate(now time.Time) []event.DNSAnomaly {
+  start := now.Add(-d.window)
+  var out []event.DNSAnomaly
+  var idle []string
+  d.clients.Range(func(ip string, c *anomalyClient) bool {
+    c.queries = c.queries[sort.Search(len(c.queries), func(i int) bool { return !c.queries[i].at.Before(start) }):]
+    c.nxdomain = c.nxdomain[sort.Search(len(c.nxdomain), func(i int) bool { return !c.nxdomain[i].Before(start) }):]
+    if len(c.queries) == 0 && len(c.nxdomain) == 0 && now.Sub(c.lastAlert) > d.cooldown {
+      idle = append(idle, ip)
+      return true
+    }
+    if len(c.queries) < d.minQueries || now.Sub(c.lastAlert) < d.cooldown {
+      return true
+    }
+    a, ok := d.score(c)
+    if !ok {
+      return true
+    }
+    a.ClientIP, a.WindowStart = ip, start
+    c.lastAlert = now
+    out = append(out, a)
+    return true
+  })
+  for _, ip := range idle {
+    d.clients.Remove(ip)
+  }
+  sort.Slice(out, func(i, j int) bool { return out[i].ClientIP < out[j].ClientIP })
+  return out
+}
+
+func (d *anomalyDetector) score(c *anomalyClient) (event.DNSAnomaly, bool) {
+  n := float64(len(c.queries))
+  var entropy, long, txtNull float64
+  subs := make(map[string]map[string]struct{})
+  for _, q := range c.queries {
+    entropy += q.entropy
+    if q.long {
+      long++
+    }
+    if q.txtNull {
+      txtNull++
+    }
+    if q.sub != "" {
+      if subs[q.parent] == nil {
+        subs[q.parent] = make(map[string]struct{})
+      }
+      subs[q.parent][q.sub] = struct{}{}
+    }
+  }
+  maxSubs := 0
+  for _, s := range subs {
+    if len(s) > maxSubs {
+      maxSubs = len(s)
+    }
+  }
+  features := map[string]event.DNSAnomalyFeature{}
+  add := func(name string, v float64, r featureRange) float64 {
+    s := r.score(v)
+    features[name] = event.DNSAnomalyFeature{Name: name, Value: round3(v), Score: round3(s)}
+    return s
+  }
+  fEntropy := add("label_entropy", entropy/n, entropyRange)
+  fLong := add("long_labels", long/n, longLabelRange)
+  fTXT := add("txt_null_rate", txtNull/n, txtNullRange)
+  fSubs := add("unique_subdomains", float64(maxSubs), subdomainRange)
+  fNX := add("nxdomain_ratio", math.Min(1, float64(len(c.nxdomain))/n), nxdomainRange)
+
+  dga := 0.5*fEntropy + 0.5*fNX
+  tunneling := 0.35*fLong + 0.35*fSubs + 0.15*fTXT + 0.15*fEntropy
+  a := event.DNSAnomaly{Kind: anomalyKindDGA, Score: dga, Queries: len(c.queries), NXDomain: len(c.nxdomain)}
+  contributing := []string{"label_entropy", "nxdomain_ratio"}
+  if tunneling > dga {
+    a.Kind, a.Score = anomalyKindTunneling, tunneling
+    contributing = []string{"long_labels", "unique_subdomains", "txt_null_rate", "label_entropy"}
+  }
+  if a.Score < d.threshold {
+    return a, false
+  }
+  a.Score = round3(a.Score)
+  for _, name := range contributing {
+    if f := features[name]; f.Score > 0 {
+      a.Features = append(a.Features, f)
+    }
+  }
+  sort.SliceStable(a.Features, func(i, j int) bool { return a.Features[i].Score > a.Features[j].Score })
+  a.SampleQNames = sampleQNames(c.queries)
+  return a, true
+}
+
+// sampleQNames returns the distinct highest-entropy names, as examples.
+func sampleQNames(queries []anomalyQuery) []string {
+  sorted := make([]anomalyQuery, len(queries))
+  copy(sorted, queries)
+  sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].entropy > sorted[j].entropy })
+  seen := make(map[string]bool)
+  var out []string
+  for _, q := range sorted {
+    if len(out) == anomalyMaxSamples {
+      break
+    }
+    if !seen[q.qname] {
+      seen[q.qname] = true
+      out = append(out, q.qname)
+    }
+  }
+  return out
+}
+
+// splitParent splits a name into its registrable domain and the labels in
+// front of it.
+func splitParent(name string) (parent, sub string) {
+  parent, err := publicsuffix.EffectiveTLDPlusOne(name)
+  if err != nil {
+    return name, ""
+  }
+  return parent, strings.TrimSuffix(strings.TrimSuffix(name, parent), ".")
+}
+
+// suffixOf returns the public suffix of name with its leading dot, or "" if
+// name is itself a suffix.
+func suffixOf(name string) string {
+  suffix, _ := publicsuffix.PublicSuffix(name)
+  if suffix == name {
+    return ""
+  }
+  return "." + suffix
+}
+
+// labelEntropy is the Shannon entropy of a label in bits per character.
+func labelEntropy(label string) float64 {
+  if label == "" {
+    return 0
+  }
+  var counts [256]int
+  for i := 0; i < len(label); i++ {
+    counts[label[i]]++
+  }
+  n := float64(len(label))
+  var h float64
+  for _, c := range counts {
+    if c > 0 {
+      p := float64(c) / n
+      h -= p * math.Log2(p)
+    }
+  }
+  return h
+}
+
+func isTXTOrNull(qtype string) bool {
+  switch strings.ToUpper(qtype) {
+  case "TXT", "NULL", "TYPE10", "TYPE=10":
+    return true
+  }
+  return false
+}
+
+func round3(v float64) float64 {
+  return math.Round(v*1000) / 1000
+}
@@ -0,0 +1,157 @@
+package dns
+
+import (
+  "fmt"
+  "math/rand"
+  "testing"
+  "time"
+)
+
+var anomalyNow = time.Date(2026, 3, 8, 14, 20, 0, 0, time.UTC)
+
+func newTestDetector() *anomalyDetector {
+  return newAnomalyDetector(5*time.Minute, 0.6, 20, 15*time.Minute, 100)
+}
+
+func randomLabel(r *rand.Rand, n int, alphabet string) string {
+  b := make([]byte, n)
+  for i := range b {
+    b[i] = alphabet[r.Intn(len(alphabet))]
+  }
+  return string(b)
+}
+
+func TestAnomalyNormalClient(t *testing.T) {
+  d := newTestDetector()
+  names := []string{"github.com", "api.github.com", "www.google.com", "fonts.gstatic.com", "www.netflix.com",
+    "connectivity-check.ubuntu.com", "time.cloudflare.com", "_dmarc.example.com", "s3.us-west-2.amazonaws.com", "router.lan"}
+  for i := 0; i < 60; i++ {
+    d.observeQuery("10.0.0.20", names[i%len(names)], "A", anomalyNow.Add(-time.Duration(i)*time.Second))
+  }
+  d.observeNXDomain("10.0.0.20", anomalyNow)
+  if got := d.evaluate(anomalyNow); len(got) != 0 {
+    t.Fatalf("normal client flagged: %+v", got)
+  }
+}
+
+func TestAnomalyDGA(t *testing.T) {
+  d := newTestDetector()
+  r := rand.New(rand.NewSource(1))
+  tlds := []string{"com", "net", "info", "biz"}
+  for i := 0; i < 40; i++ {
+    name := randomLabel(r, 12+r.Intn(8), "abcdefghijklmnopqrstuvwxyz0123456789") + "." + tlds[i%len(tlds)]
+    d.observeQuery("10.0.0.99", name, "A", anomalyNow.Add(-time.Minute))
+    if i%10 != 0 {
+      d.observeNXDomain("10.0.0.99", anomalyNow.Add(-time.Minute))
+    }
+  }
+  got := d.evaluate(anomalyNow)
+  if len(got) != 1 {
+    t.Fatalf("got %+v, want one anomaly", got)
+  }
+  a := got[0]
+  if a.ClientIP != "10.0.0.99" || a.Kind != anomalyKindDGA || a.Score < 0.6 || a.Queries != 40 || a.NXDomain != 36 {
+    t.Fatalf("got %+v", a)
+  }
+  if len(a.Features) != 2 || a.Features[0].Name != "nxdomain_ratio" || a.Features[1].Name != "label_entropy" {
+    t.Fatalf("features = %+v", a.Features)
+  }
+  if len(a.SampleQNames) != anomalyMaxSamples || !a.WindowStart.Equal(anomalyNow.Add(-5*time.Minute)) {
+    t.Fatalf("got %+v", a)
+  }
+}
+
+func TestAnomalyTunneling(t *testing.T) {
+  d := newTestDetector()
+  r := rand.New(rand.NewSource(2))
+  for i := 0; i < 60; i++ {
+    name := fmt.Sprintf("%s.%s.t.example.com", randomLabel(r, 52, "0123456789abcdef"), randomLabel(r, 10, "0123456789abcdef"))
+    qtype := "A"
+    if i%2 == 0 {
+      qtype = "TXT"
+    }
+    d.observeQuery("10.0.0.42", name, qtype, anomalyNow.Add(-time.Duration(i)*time.Second))
+  }
+  got := d.evaluate(anomalyNow)
+  if len(got) != 1 || got[0].Kind != anomalyKindTunneling {
+    t.Fatalf("got %+v, want one tunneling anomaly", got)
+  }
+  names := map[string]float64{}
+  for _, f := range got[0].Features {
+    names[f.Name] = f.Score
+  }
+  for _, want := range []string{"long_labels", "unique_subdomains", "txt_null_rate"} {
+    if names[want] != 1 {
+      t.Errorf("feature %s score = %v, want 1 (%+v)", want, names[want], got[0].Features)
+    }
+  }
+}
+
+func TestAnomalyMinQueriesCooldownAndWindow(t *testing.T) {
+  d := newTestDetector()
+  r := rand.New(rand.NewSource(3))
+  dga := func(n int, at time.Time) {
+    for i := 0; i < n; i++ {
+      d.observeQuery("10.0.0.99", randomLabel(r, 16, "abcdefghijklmnopqrstuvwxyz0123456789")+".com", "A", at)
+      d.observeNXDomain("10.0.0.99", at)
+    }
+  }
+  dga(10, anomalyNow)
+  if got := d.evaluate(anomalyNow); len(got) != 0 {
+    t.Fatalf("flagged below dns_anomaly_min_queries: %+v", got)
+  }
+  dga(20, anomalyNow)
+  if got := d.evaluate(anomalyNow); len(got) != 1 || got[0].Queries != 30 {
+    t.Fatalf("got %+v", got)
+  }
+  dga(30, anomalyNow.Add(time.Minute))
+  if got := d.evaluate(anomalyNow.Add(time.Minute)); len(got) != 0 {
+    t.Fatalf("reported again within cooldown: %+v", got)
+  }
+  later := anomalyNow.Add(16 * time.Minute)
+  if got := d.evaluate(later); len(got) != 0 || d.clients.Len() != 0 {
+    t.Fatalf("stale queries kept: %+v, %d clients", got, d.clients.Len())
+  }
+  dga(30, later)
+  if got := d.evaluate(later); len(got) != 1 || got[0].Queries != 30 {
+    t.Fatalf("got %+v after cooldown", got)
+  }
+}
+
+func TestAnomalyOutOfOrderObservations(t *testing.T) {
+  d := newTestDetector()
+  r := rand.New(rand.NewSource(4))
+  // Log times arrive slightly out of order; the stale half must still be cut
+  // from the window.
+  for i := 0; i < 40; i++ {
+    at := anomalyNow.Add(-time.Duration(i%2*10) * time.Minute).Add(time.Duration(i) * time.Second)
+    d.observeQuery("10.0.0.99", randomLabel(r, 16, "abcdefghijklmnopqrstuvwxyz0123456789")+".com", "A", at)
+    d.observeNXDomain("10.0.0.99", at)
+  }
+  c, _ := d.clients.Peek("10.0.0.99", anomalyNow)
+  for i := 1; i < len(c.queries); i++ {
+    if c.queries[i].at.Before(c.queries[i-1].at) || c.nxdomain[i].Before(c.nxdomain[i-1]) {
+      t.Fatalf("observation %d out of order", i)
+    }
+  }
+  got := d.evaluate(anomalyNow.Add(time.Minute))
+  if len(got) != 1 || got[0].Queries != 20 || got[0].NXDomain != 20 {
+    t.Fatalf("got %+v, want one anomaly over the 20 recent queries", got)
+  }
+}
+
+func TestLabelEntropy(t *testing.T) {
+  for _, tt := range []struct {
+    label string
+    want  float64
+  }{
+    {"", 0},
+    {"aaaa", 0},
+    {"abab", 1},
+    {"abcdefgh", 3},
+  } {
+    if got := labelEntropy(tt.label); got != tt.want {
+      t.Errorf("labelEntropy(%q) = %v, want %v", tt.label, got, tt.want)
+    }
+  }
+}
@@ -0,0 +1,146 @@
+package dns
+
+import (
+  "container/list"
+  "net/netip"
+  "sync"
+  "time"
+
+  "netmon_agent/internal/event"
+)
+
+// answerRetain keeps expired answers around so flows that started while an
+// answer was valid still resolve when they are reported at DESTROY.
+const answerRetain = time.Hour
+
+// answerMap is a bounded reverse map from an answer address to the name that
+// resolved it. Each answer is stored twice, under the resolving client and
+// under the address alone, so a lookup prefers the client's own resolution.
+type answerMap struct {
+  mu         sync.Mutex
+  max        int
+  defaultTTL time.Duration
+  order      *list.List // *answerEntry, most recently used first
+  entries    map[answerKey]*list.Element
+}
+
+type answerKey struct {
+  client string
+  ip     netip.Addr
+}
+
+type answerEntry struct {
+  key        answerKey
+  qname      string
+  client     string
+  resolvedAt time.Time
+  expires    time.Time
+}
+
+// DstDomain is the name a destination address was resolved from.
+type DstDomain struct {
+  QName      string
+  QNameMode  string
+  ClientIP   string
+  ResolvedAt time.Time
+}
+
+func newAnswerMap(max int, defaultTTL time.Duration) *answerMap {
+  return &answerMap{max: max, defaultTTL: defaultTTL, order: list.New(), entries: make(map[answerKey]*list.Element)}
+}
+
+// record stores the A/AAAA answers of a response. The queried name is kept
+// rather than the CNAME target, so a CDN address maps back to what the client
+// asked for.
+func (a *answerMap) record(resp event.DNSResponse, at time.Time) {
+  client, _ := netip.ParseAddr(resp.ClientIP)
+  for _, ans := range resp.Answers {
+    if ans.Type != "A" && ans.Type != "AAAA" {
+      continue
+    }
+    ip, err := netip.ParseAddr(ans.Data)
+    if err != nil {
+      continue
+    }
+    ttl := a.defaultTTL
+    if ans.TTL != nil {
+      ttl = time.Duration(*ans.TTL) * time.Second
+    }
+    e := &answerEntry{qname: resp.QName, client: resp.ClientIP, resolvedAt: at, expires: at.Add(ttl)}
+    if client.IsValid() {
+      a.put(answerKey{client: client.Unmap().String(), ip: ip.Unmap()}, e)
+    }
+    a.put(answerKey{ip: ip.Unmap()}, e)
+  }
+}
+
+func (a *answerMap) put(key answerKey, e *answerEntry) {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  entry := *e
+  entry.key = key
+  if el, ok := a.entries[key]; ok {
+    el.Value = &entry
+    a.order.MoveToFront(el)
+    return
+  }
+  a.entries[key] = a.order.PushFront(&entry)
+  for a.max > 0 && a.order.Len() > a.max {
+    a.removeLocked(a.order.Back())
+  }
+}
+
+// lookup returns the name dst was resolved from, preferring client's own
+// query. at is when the connection started; answers that had already expired
+// by then are ignored. A later re-resolution of the same address still
+// matches, since long-lived flows are only reported when they end.
+func (a *answerMap) lookup(client, dst string, at time.Time) (DstDomain, bool) {
+  ip, err := netip.ParseAddr(dst)
+  if err != nil {
+    return DstDomain{}, false
+  }
+  clientKey := ""
+  if c, err := netip.ParseAddr(client); err == nil {
+    clientKey = c.Unmap().String()
+  }
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  for _, key := range []answerKey{{client: clientKey, ip: ip.Unmap()}, {ip: ip.Unmap()}} {
+    el, ok := a.entries[key]
+    if !ok {
+      continue
+    }
+    e := el.Value.(*answerEntry)
+    if at.After(e.expires) {
+      continue
+    }
+    a.order.MoveToFront(el)
+    return DstDomain{QName: e.qname, ClientIP: e.client, ResolvedAt: e.resolvedAt}, true
+  }
+  return DstDomain{}, false
+}
+
+// prune drops answers that expired more than answerRetain ago.
+func (a *answerMap) prune(now time.Time) {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  cutoff := now.Add(-answerRetain)
+  for el := a.order.Back(); el != nil; {
+    prev := el.Prev()
+    if el.Value.(*answerEntry).expires.Before(cutoff) {
+      a.removeLocked(el)
+    }
+    el = prev
+  }
+}
+
+func (a *answerMap) removeLocked(el *list.Element) {
+  delete(a.entries, el.Value.(*answerEntry).key)
+  a.order.Remove(el)
+}
+
+func (a *answerMap) len() int {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  return a.order.Len()
+}
@@ -0,0 +1,78 @@
+package dns
+
+import (
+  "testing"
+  "time"
+
+  "netmon_agent/internal/event"
+)
+
+func TestAnswerMapLookup(t *testing.T) {
+  a := newAnswerMap(100, 5*time.Minute)
+  t0 := time.Date(2026, 3, 8, 14, 20, 0, 0, time.UTC)
+  ttl := 60
+  a.record(event.DNSResponse{
+    ClientIP: "10.0.0.31",
+    QName: "www.netflix.com",
+    QType: "A",
+    Answers: []event.DNSAnswer{
+      {Name: "www.netflix.com", Type: "CNAME", Data: "www.dradis.netflix.com"},
+      {Name: "www.dradis.netflix.com", Type: "A", Data: "54.186.4.192"},
+      {Name: "www.dradis.netflix.com", Type: "A", Data: "44.242.13.161", TTL: &ttl},
+    },
+  }, t0)
+  a.record(event.DNSResponse{
+    ClientIP: "10.0.0.20",
+    QName: "netflix.com",
+    QType: "A",
+    Answers: []event.DNSAnswer{{Name: "netflix.com", Type: "A", Data: "54.186.4.192"}},
+  }, t0.Add(time.Second))
+
+  tests := []struct {
+    name   string
+    client string
+    dst    string
+    at     time.Time
+    want   string
+    ok     bool
+  }{
+    {"own resolution wins", "10.0.0.31", "54.186.4.192", t0.Add(time.Minute), "www.netflix.com", true},
+    {"other client falls back to latest", "10.0.0.99", "54.186.4.192", t0.Add(time.Minute), "netflix.com", true},
+    {"answer ttl honoured", "10.0.0.31", "44.242.13.161", t0.Add(59 * time.Second), "www.netflix.com", true},
+    {"expired answer ignored", "10.0.0.31", "44.242.13.161", t0.Add(2 * time.Minute), "", false},
+    {"started before a re-resolution", "10.0.0.31", "54.186.4.192", t0.Add(-time.Hour), "www.netflix.com", true},
+    {"cname target not mapped", "10.0.0.31", "www.dradis.netflix.com", t0, "", false},
+    {"unknown address", "10.0.0.31", "192.0.2.1", t0, "", false},
+  }
+  for _, tt := range tests {
+    d, ok := a.lookup(tt.client, tt.dst, tt.at)
+    if ok != tt.ok || d.QName != tt.want {
+      t.Errorf("%s: got %q, %v; want %q, %v", tt.name, d.QName, ok, tt.want, tt.ok)
+    }
+  }
+  if d, _ := a.lookup("10.0.0.31", "54.186.4.192", t0); !d.ResolvedAt.Equal(t0) || d.ClientIP != "10.0.0.31" {
+    t.Errorf("got %+v", d)
+  }
+}
+
+func TestAnswerMapBounded(t *testing.T) {
+  a := newAnswerMap(4, time.Minute)
+  t0 := time.Date(2026, 3, 8, 14, 20, 0, 0, time.UTC)
+  for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+    a.record(event.DNSResponse{ClientIP: "10.0.0.20", QName: ip + ".example", Answers: []event.DNSAnswer{{Type: "A", Data: ip}}}, t0)
+  }
+  if a.len() != 4 {
+    t.Fatalf("len = %d, want 4", a.len())
+  }
+  if _, ok := a.lookup("10.0.0.20", "192.0.2.1", t0); ok {
+    t.Fatal("oldest answer should have been evicted")
+  }
+  if _, ok := a.lookup("10.0.0.20", "192.0.2.3", t0); !ok {
+    t.Fatal("newest answer missing")
+  }
+
+  a.prune(t0.Add(answerRetain + 2*time.Minute))
+  if a.len() != 0 {
+    t.Fatalf("len after prune = %d, want 0", a.len())
+  }
+}
@@ -0,0 +1,53 @@
+package dns
+
+import (
+  "errors"
+  "regexp"
+  "strings"
+  "time"
+
+  "netmon_agent/internal/config"
+)
+
+// Example BIND query log lines (querylog file with print-time/print-category,
+// then through syslog):
+// 08-Mar-2026 14:19:59.123 queries: info: client @0x7f8b3c0a2168 10.0.0.20#51234 (github.com): query: github.com IN A +E(0)K (10.0.0.1)
+// Mar  8 14:19:59 ns1 named[812]: client @0x7f8b3c0a2168 10.0.0.20#51234 (github.com): query: github.com IN A + (10.0.0.1)
+//
+// BIND logs queries only, so this source feeds dns_bucket/host_identity but
+// never completes a dns_response.
+
+var (
+  bindLineRe  = regexp.MustCompile(`^(?:(?P<date>\d{2}-\w{3}-\d{4}\s+\d{2}:\d{2}:\d{2}(?:\.\d+)?)|(?P<ts>` + syslogTS + `)(?:\s+\S+)?\s+named\[\d+\]:)\s+(?:\S+:\s+\w+:\s+)?(?P<msg>.*)$`)
+  bindQueryRe = regexp.MustCompile(`^client\s+(?:@0x[0-9a-fA-F]+\s+)?(?P<client>\S+)#\d+(?:\s+\([^)]*\))?:\s+(?:view\s+\S+:\s+)?query:\s+(?P<qname>\S+)\s+(?P<class>\S+)\s+(?P<qtype>\S+)`)
+)
+
+type bindSource struct{}
+
+func (bindSource) Name() string { return config.DNSSourceBIND }
+
+func (bindSource) Parse(line string, now time.Time) (*ParsedLine, error) {
+  line = strings.TrimSpace(line)
+  if line == "" {
+    return nil, errors.New("empty")
+  }
+  m := bindLineRe.FindStringSubmatch(line)
+  if m == nil {
+    return nil, errors.New("unmatched")
+  }
+  q := bindQueryRe.FindStringSubmatch(m[3])
+  if q == nil {
+    return nil, errors.New("unmatched")
+  }
+  var ts time.Time
+  var err error
+  if m[1] != "" {
+    ts, err = time.ParseInLocation("02-Jan-2006 15:04:05", m[1], now.Location())
+  } else {
+    ts, err = parseTS(m[2], now)
+  }
+  if err != nil {
+    return nil, err
+  }
+  return &ParsedLine{TS: ts, Action: "query", ClientIP: q[1], QName: strings.TrimSuffix(q[2], "."), QType: q[4]}, nil
+}
@@ -2,9 +2,6 @@ package dns
 
 import (
   "context"
-  "crypto/sha256"
-  "encoding/base64"
-  "strings"
   "sync"
   "time"
 
@@ -26,62 +23,100 @@ type cacheEntry struct {
   qnames   *util.Ring[string]
 }
 
+// trackedQuery remembers which bucket a qname's last query went to, so an
+// NXDOMAIN answer can be counted against it.
+type trackedQuery struct {
+  key  bucketKey
+  seen time.Time
+}
+
+// trackedQueryTTL is how long a query waits for its NXDOMAIN answer.
+const trackedQueryTTL = 5 * time.Minute
+
 type Correlator struct {
   cfg     *config.Config
   metrics *metrics.Metrics
   mu      sync.RWMutex
-  cache   map[string]*cacheEntry
+  // cache holds recent qnames per client IP, guarded by mu.
+  cache   *util.LRU[string, *cacheEntry]
+  // queries is only used by the Start goroutine.
+  queries *util.LRU[string, trackedQuery]
+  answers *answerMap
+  qnames  *qnamePolicy
+  source  DNSSource
+  loc     *time.Location
+  // anomalies is nil unless dns_anomaly_enabled is set.
+  anomalies *anomalyDetector
 }
 
 func NewCorrelator(cfg *config.Config, metrics *metrics.Metrics) *Correlator {
-  return &Correlator{cfg: cfg, metrics: metrics, cache: make(map[string]*cacheEntry)}
+  source, err := NewSource(cfg.DNSSource)
+  if err != nil {
+    // config.Load rejects unknown sources.
+    source = dnsmasqSource{}
+  }
+  loc, err := cfg.DNSLogLocation()
+  if err != nil {
+    // config.Load rejects unknown zones.
+    loc = time.Local
+  }
+  c := &Correlator{
+    cfg: cfg,
+    metrics: metrics,
+    cache: util.NewLRU[string, *cacheEntry](cfg.DNSClientCacheSize, cfg.DNSClientCacheTTL),
+    queries: util.NewLRU[string, trackedQuery](cfg.DNSQueryTrackerSize, trackedQueryTTL),
+    answers: newAnswerMap(cfg.DNSAnswerMapSize, cfg.DNSAnswerTTL),
+    qnames: newQNamePolicy(cfg),
+    source: source,
+    loc: loc,
+  }
+  c.cache.OnEvict = func(_ string, _ *cacheEntry, reason string) {
+    metrics.DNSCacheEvictions.WithLabelValues("clients", reason).Inc()
+  }
+  c.queries.OnEvict = func(_ string, _ trackedQuery, reason string) {
+    metrics.DNSCacheEvictions.WithLabelValues("queries", reason).Inc()
+  }
+  if cfg.DNSAnomalyEnabled {
+    c.anomalies = newAnomalyDetector(cfg.DNSAnomalyWindow, cfg.DNSAnomalyThreshold, cfg.DNSAnomalyMinQueries, cfg.DNSAnomalyCooldown, cfg.DNSAnomalyMaxClients)
+    c.anomalies.clients.OnEvict = func(_ string, _ *anomalyClient, reason string) {
+      metrics.DNSCacheEvictions.WithLabelValues("anomaly", reason).Inc()
+    }
+  }
+  return c
 }
 
-func (c *Correlator) Start(ctx context.Context, lines <-chan string, out chan<- event.Event) {
+// Start consumes log lines from the configured DNS source and, when a dns
+// NFLOG group is configured, decoded packets (see DecodePacket). Either
+// channel may be nil.
+func (c *Correlator) Start(ctx context.Context, lines <-chan string, packets <-chan *ParsedLine, out chan<- event.Event) {
   buckets := make(map[bucketKey]*event.DNSBucket)
-  lastQueries := make(map[string]struct {
-    key   bucketKey
-    seen  time.Time
-  })
   ticker := time.NewTicker(1 * time.Minute)
   defer ticker.Stop()
+  responses := newResponseMatcher(c.cfg.DNSResponseWindow, c.cfg.DNSResponseMaxPending)
+  responses.onDrop = func(reason string) {
+    c.metrics.DNSResponsesDropped.WithLabelValues(reason).Inc()
+  }
+  settle := time.NewTicker(1 * time.Second)
+  defer settle.Stop()
 
   for {
+    var parsed *ParsedLine
     select {
     case <-ctx.Done():
       return
     case line := <-lines:
       c.metrics.DNSLinesTotal.Inc()
-      parsed, err := Parse(line, time.Now())
+      p, err := c.source.Parse(line, time.Now().In(c.loc))
       if err != nil {
         c.metrics.DNSParseErrors.Inc()
         continue
       }
-      if parsed.Action == "query" {
-        c.trackClient(parsed.ClientIP, parsed.QName)
-        bucketStart := parsed.TS.Truncate(time.Minute)
-        qhash := c.hashQName(parsed.QName)
-        key := bucketKey{ClientIP: parsed.ClientIP, QType: parsed.QType, QNameHash: qhash, Bucket: bucketStart}
-        bucket := buckets[key]
-        if bucket == nil {
-          bucket = &event.DNSBucket{BucketStart: bucketStart, ClientIP: parsed.ClientIP, QType: parsed.QType, QNameHash: qhash}
-          buckets[key] = bucket
-        }
-        bucket.Count++
-        lastQueries[parsed.QName] = struct {
-          key  bucketKey
-          seen time.Time
-        }{key: key, seen: parsed.TS}
-      }
-      if parsed.Action == "reply" && parsed.NXDomain {
-        if entry, ok := lastQueries[parsed.QName]; ok {
-          if parsed.TS.Sub(entry.seen) <= 2*time.Minute {
-            if bucket, ok := buckets[entry.key]; ok {
-              bucket.NXDomain++
-            }
-          }
-        }
-      }
+      parsed = p
+    case parsed = <-packets:
+    case <-settle.C:
+      c.emitResponses(responses.flush(time.Now()), out)
+      c.metrics.DNSResponsesPending.Set(float64(responses.len()))
+      continue
     case <-ticker.C:
       now := time.Now().UTC()
       for _, bucket := range buckets {
@@ -89,56 +124,134 @@ func (c *Correlator) Start(ctx context.Context, lines <-chan string, out chan<-
         c.metrics.DNSBucketsEmitted.Inc()
       }
       buckets = make(map[bucketKey]*event.DNSBucket)
+      c.pruneCaches(now)
       c.emitHostIdentity(now, out)
-      // prune lastQueries older than 5 minutes
-      cutoff := now.Add(-5 * time.Minute)
-      for q, entry := range lastQueries {
-        if entry.seen.Before(cutoff) {
-          delete(lastQueries, q)
+      c.emitAnomalies(now, out)
+      c.answers.prune(now)
+      c.metrics.DNSAnswerMapEntries.Set(float64(c.answers.len()))
+      continue
+    }
+
+    c.emitResponses(responses.observe(parsed, time.Now()), out)
+    if parsed.Action == "query" {
+      c.trackClient(parsed.ClientIP, parsed.QName)
+      if c.anomalies != nil {
+        c.anomalies.observeQuery(parsed.ClientIP, parsed.QName, parsed.QType, parsed.TS)
+      }
+      bucketStart := parsed.TS.Truncate(time.Minute)
+      mode := c.qnames.modeFor(parsed.ClientIP)
+      qhash := c.qnames.renderMode(mode, parsed.QName)
+      key := bucketKey{ClientIP: parsed.ClientIP, QType: parsed.QType, QNameHash: qhash, Bucket: bucketStart}
+      bucket := buckets[key]
+      if bucket == nil {
+        bucket = &event.DNSBucket{BucketStart: bucketStart, ClientIP: parsed.ClientIP, QType: parsed.QType, QNameHash: qhash, QNameMode: mode}
+        buckets[key] = bucket
+      }
+      bucket.Count++
+      c.queries.Put(parsed.QName, trackedQuery{key: key, seen: parsed.TS}, time.Now())
+    }
+    if (parsed.Action == "reply" || parsed.Action == "response") && parsed.NXDomain {
+      if entry, ok := c.queries.Get(parsed.QName, time.Now()); ok {
+        if parsed.TS.Sub(entry.seen) <= 2*time.Minute {
+          if bucket, ok := buckets[entry.key]; ok {
+            bucket.NXDomain++
+          }
         }
       }
     }
   }
 }
 
+func (c *Correlator) emitResponses(evs []event.Event, out chan<- event.Event) {
+  for _, ev := range evs {
+    if resp, ok := ev.Data.(event.DNSResponse); ok {
+      c.answers.record(resp, ev.TS)
+      if c.anomalies != nil && resp.RCode == "NXDOMAIN" {
+        c.anomalies.observeNXDomain(resp.ClientIP, ev.TS)
+      }
+      ev.Data = c.qnames.renderResponse(resp)
+    }
+    if util.TrySend(out, c.metrics, "dns_response", ev) {
+      c.metrics.DNSResponsesEmitted.Inc()
+    }
+  }
+}
+
+// emitAnomalies reports clients whose recent queries look like DGA or
+// tunneling traffic. Sample names follow the client's qname_mode.
+func (c *Correlator) emitAnomalies(now time.Time, out chan<- event.Event) {
+  if c.anomalies == nil {
+    return
+  }
+  for _, a := range c.anomalies.evaluate(now) {
+    for i, name := range a.SampleQNames {
+      a.SampleQNames[i] = c.qnames.render(a.ClientIP, name)
+    }
+    a.QNameMode = c.qnames.modeFor(a.ClientIP)
+    util.TrySend(out, c.metrics, "dns_anomaly", event.Event{Type: "dns_anomaly", TS: now, Data: a})
+    c.metrics.DNSAnomaliesEmitted.WithLabelValues(a.Kind).Inc()
+  }
+}
+
 func (c *Correlator) trackClient(clientIP, qname string) {
   if clientIP == "" {
     return
   }
   c.mu.Lock()
   defer c.mu.Unlock()
-  entry := c.cache[clientIP]
-  if entry == nil {
+  now := time.Now().UTC()
+  entry, ok := c.cache.Get(clientIP, now)
+  if !ok {
     entry = &cacheEntry{qnames: util.NewRing[string](c.cfg.QnameHashCap)}
-    c.cache[clientIP] = entry
   }
-  entry.lastSeen = time.Now().UTC()
-  entry.qnames.Add(c.hashQName(qname))
+  entry.lastSeen = now
+  entry.qnames.Add(c.qnames.render(clientIP, qname))
+  c.cache.Put(clientIP, entry, now)
+}
+
+// pruneCaches drops expired entries and updates the cache size gauges.
+func (c *Correlator) pruneCaches(now time.Time) {
+  c.mu.Lock()
+  c.cache.Prune(now)
+  c.metrics.DNSCacheEntries.WithLabelValues("clients").Set(float64(c.cache.Len()))
+  c.mu.Unlock()
+  c.queries.Prune(now)
+  c.metrics.DNSCacheEntries.WithLabelValues("queries").Set(float64(c.queries.Len()))
+  if c.anomalies != nil {
+    c.metrics.DNSCacheEntries.WithLabelValues("anomaly").Set(float64(c.anomalies.clients.Len()))
+  }
 }
 
 func (c *Correlator) emitHostIdentity(now time.Time, out chan<- event.Event) {
   c.mu.RLock()
   defer c.mu.RUnlock()
-  for ip, entry := range c.cache {
-    if entry.lastSeen.IsZero() {
-      continue
+  c.cache.Range(func(ip string, entry *cacheEntry) bool {
+    if !entry.lastSeen.IsZero() {
+      util.TrySend(out, c.metrics, "host_identity", event.Event{Type: "host_identity", TS: now, Data: event.HostIdentity{IP: ip, LastSeen: entry.lastSeen, RecentQNameHashes: entry.qnames.Values(), QNameMode: c.qnames.modeFor(ip)}})
     }
-    util.TrySend(out, c.metrics, "host_identity", event.Event{Type: "host_identity", TS: now, Data: event.HostIdentity{IP: ip, LastSeen: entry.lastSeen, RecentQNameHashes: entry.qnames.Values()}})
-  }
-}
-
-func (c *Correlator) hashQName(qname string) string {
-  q := strings.ToLower(strings.TrimSpace(qname))
-  sum := sha256.Sum256([]byte(c.cfg.QnameHashSalt + q))
-  return "b64:" + base64.StdEncoding.EncodeToString(sum[:])
+    return true
+  })
 }
 
 func (c *Correlator) DNSContextForIP(ip string) *event.DNSContext {
   c.mu.RLock()
   defer c.mu.RUnlock()
-  entry := c.cache[ip]
-  if entry == nil {
+  entry, ok := c.cache.Peek(ip, time.Now().UTC())
+  if !ok {
     return nil
   }
-  return &event.DNSContext{RecentQNameHashes: entry.qnames.Values(), LastSeen: entry.lastSeen.Format(time.RFC3339)}
+  return &event.DNSContext{RecentQNameHashes: entry.qnames.Values(), LastSeen: entry.lastSeen.Format(time.RFC3339), QNameMode: c.qnames.modeFor(ip)}
+}
+
+// DstDomainForIP returns the name dstIP was resolved from, preferring a
+// resolution by clientIP. at is when the connection started. The name
+// follows clientIP's qname_mode.
+func (c *Correlator) DstDomainForIP(clientIP, dstIP string, at time.Time) (DstDomain, bool) {
+  d, ok := c.answers.lookup(clientIP, dstIP, at)
+  if !ok {
+    return d, false
+  }
+  d.QNameMode = c.qnames.modeFor(clientIP)
+  d.QName = c.qnames.renderMode(d.QNameMode, d.QName)
+  return d, true
 }
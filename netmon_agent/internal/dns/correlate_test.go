@@ -0,0 +1,155 @@
+package dns
+
+import (
+  "encoding/binary"
+  "fmt"
+  "net/netip"
+  "reflect"
+  "runtime"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/prometheus/client_golang/prometheus/testutil"
+
+  "netmon_agent/internal/config"
+  "netmon_agent/internal/event"
+  "netmon_agent/internal/metrics"
+)
+
+var (
+  testMetricsOnce sync.Once
+  testMetrics     *metrics.Metrics
+)
+
+func getMetrics() *metrics.Metrics {
+  testMetricsOnce.Do(func() { testMetrics = metrics.New() })
+  return testMetrics
+}
+
+// TestCorrelatorCachesBounded floods the client cache and the query tracker
+// with distinct client IPs and qnames, as a spoofed-source flood would, and
+// checks that entry counts and heap stay capped.
+func TestCorrelatorCachesBounded(t *testing.T) {
+  n := 2_000_000
+  if testing.Short() {
+    n = 200_000
+  }
+  cfg := &config.Config{
+    DNSSource: config.DNSSourceDnsmasq,
+    QnameMode: config.QnameModeHash,
+    QnameHashCap: 8,
+    DNSClientCacheSize: 1000,
+    DNSClientCacheTTL: time.Hour,
+    DNSQueryTrackerSize: 2000,
+    DNSAnswerMapSize: 1000,
+    DNSAnswerTTL: time.Minute,
+    DNSAnomalyEnabled: true,
+    DNSAnomalyWindow: 5 * time.Minute,
+    DNSAnomalyMaxClients: 1000,
+  }
+  m := getMetrics()
+  evictions := testutil.ToFloat64(m.DNSCacheEvictions.WithLabelValues("clients", "capacity"))
+  anomalyEvictions := testutil.ToFloat64(m.DNSCacheEvictions.WithLabelValues("anomaly", "capacity"))
+  c := NewCorrelator(cfg, m)
+
+  var before, after runtime.MemStats
+  runtime.GC()
+  runtime.ReadMemStats(&before)
+  now := time.Now()
+  var ip [4]byte
+  var client string
+  for i := 0; i < n; i++ {
+    binary.BigEndian.PutUint32(ip[:], 0x0a000000+uint32(i))
+    client = netip.AddrFrom4(ip).String()
+    qname := fmt.Sprintf("h%d.flood.example", i)
+    c.trackClient(client, qname)
+    c.queries.Put(qname, trackedQuery{seen: now}, now)
+    c.anomalies.observeQuery(client, qname, "A", now)
+    c.anomalies.observeNXDomain(client, now)
+  }
+  runtime.GC()
+  runtime.ReadMemStats(&after)
+
+  if c.cache.Len() != cfg.DNSClientCacheSize || c.queries.Len() != cfg.DNSQueryTrackerSize || c.anomalies.clients.Len() != cfg.DNSAnomalyMaxClients {
+    t.Fatalf("cache %d, queries %d, anomaly %d entries", c.cache.Len(), c.queries.Len(), c.anomalies.clients.Len())
+  }
+  if grown := int64(after.HeapAlloc) - int64(before.HeapAlloc); grown > 16<<20 {
+    t.Fatalf("heap grew %d MiB for %d distinct clients", grown>>20, n)
+  }
+  if c.DNSContextForIP(client) == nil {
+    t.Fatal("most recent client evicted")
+  }
+  if got := testutil.ToFloat64(m.DNSCacheEvictions.WithLabelValues("clients", "capacity")) - evictions; got != float64(n-cfg.DNSClientCacheSize) {
+    t.Fatalf("client evictions = %v", got)
+  }
+  if got := testutil.ToFloat64(m.DNSCacheEvictions.WithLabelValues("anomaly", "capacity")) - anomalyEvictions; got != float64(n-cfg.DNSAnomalyMaxClients) {
+    t.Fatalf("anomaly evictions = %v", got)
+  }
+  c.pruneCaches(now)
+  if got := testutil.ToFloat64(m.DNSCacheEntries.WithLabelValues("queries")); got != float64(cfg.DNSQueryTrackerSize) {
+    t.Fatalf("queries gauge = %v", got)
+  }
+}
+
+func TestEmitResponsesCountsSent(t *testing.T) {
+  cfg := &config.Config{DNSSource: config.DNSSourceDnsmasq, DNSAnswerMapSize: 10, DNSAnswerTTL: time.Minute}
+  m := getMetrics()
+  c := NewCorrelator(cfg, m)
+  before := testutil.ToFloat64(m.DNSResponsesEmitted)
+
+  out := make(chan event.Event, 1)
+  ev := event.Event{Type: "dns_response", TS: time.Now(), Data: event.DNSResponse{ClientIP: "10.0.0.5", QName: "example.com", RCode: "NOERROR"}}
+  c.emitResponses([]event.Event{ev, ev, ev}, out)
+
+  if got := testutil.ToFloat64(m.DNSResponsesEmitted) - before; got != 1 {
+    t.Fatalf("responses emitted = %v, want 1 (the others were dropped)", got)
+  }
+}
+
+func TestResponseNamesFollowQNameMode(t *testing.T) {
+  cfg := &config.Config{
+    DNSSource: config.DNSSourceDnsmasq,
+    QnameMode: config.QnameModeHash,
+    QnameHashSalt: "s",
+    QnameModeOverrides: []config.QnameModeOverride{{Subnet: "10.0.9.0/24", Mode: config.QnameModePlain}},
+    DNSAnswerMapSize: 10,
+    DNSAnswerTTL: time.Minute,
+  }
+  c := NewCorrelator(cfg, getMetrics())
+  hash := func(name string) string { return c.qnames.renderMode(config.QnameModeHash, name) }
+  ttl := 60
+  now := time.Now()
+  resp := func(client string) event.Event {
+    return event.Event{Type: "dns_response", TS: now, Data: event.DNSResponse{ClientIP: client, QName: "www.netflix.com", QType: "A", RCode: "NOERROR", Answers: []event.DNSAnswer{
+      {Name: "www.netflix.com", Type: "CNAME", Data: "www.dradis.netflix.com"},
+      {Name: "www.dradis.netflix.com", Type: "A", Data: "54.186.4.192", TTL: &ttl},
+      {Name: "www.netflix.com", Type: "MX", Data: "10 mx.netflix.com"},
+    }}}
+  }
+  out := make(chan event.Event, 2)
+  c.emitResponses([]event.Event{resp("10.0.0.31"), resp("10.0.9.5")}, out)
+
+  got := (<-out).Data.(event.DNSResponse)
+  want := []event.DNSAnswer{
+    {Name: hash("www.netflix.com"), Type: "CNAME", Data: hash("www.dradis.netflix.com")},
+    {Name: hash("www.dradis.netflix.com"), Type: "A", Data: "54.186.4.192", TTL: &ttl},
+    {Name: hash("www.netflix.com"), Type: "MX"},
+  }
+  if got.QName != hash("www.netflix.com") || got.QNameMode != config.QnameModeHash || !reflect.DeepEqual(got.Answers, want) {
+    t.Fatalf("hash client: %+v", got)
+  }
+  if plain := (<-out).Data.(event.DNSResponse); plain.QName != "www.netflix.com" || plain.QNameMode != config.QnameModePlain || plain.Answers[2].Data != "10 mx.netflix.com" {
+    t.Fatalf("plain client: %+v", plain)
+  }
+
+  // The answer map keeps the real name; the flow gets it in the source's mode.
+  d, ok := c.DstDomainForIP("10.0.0.31", "54.186.4.192", now)
+  if !ok || d.QName != hash("www.netflix.com") || d.QNameMode != config.QnameModeHash {
+    t.Fatalf("hash client dst domain = %+v, %v", d, ok)
+  }
+  d, ok = c.DstDomainForIP("10.0.9.5", "54.186.4.192", now)
+  if !ok || d.QName != "www.netflix.com" || d.QNameMode != config.QnameModePlain {
+    t.Fatalf("plain client dst domain = %+v, %v", d, ok)
+  }
+}
@@ -3,78 +3,273 @@ package dns
 import (
   "bufio"
   "context"
+  "errors"
+  "fmt"
   "io"
+  "log"
   "os"
   "syscall"
   "time"
 
   "netmon_agent/internal/metrics"
+  "netmon_agent/internal/util"
 )
 
-func Tail(ctx context.Context, path string, out chan<- string, m *metrics.Metrics) {
+// TailOptions configures Tail.
+type TailOptions struct {
+  Path string
+  // OffsetPath persists the inode and offset of the last line read, so a
+  // restart resumes after it instead of at the end of the file. Empty
+  // disables persistence.
+  OffsetPath string
+  // DrainRotated reads the rest of Path+".1" before switching files when the
+  // reader finds the log truncated (logrotate copytruncate) or, on startup,
+  // rotated away while the agent was down.
+  DrainRotated bool
+}
+
+// Tail follows a DNS log file, polling once a second. Rotation by rename is
+// detected by inode: the old file is read to its end before the new one is
+// opened. Rotation by copytruncate is detected when the file shrinks below
+// the read offset. Lines are dropped if out is full.
+func Tail(ctx context.Context, opts TailOptions, out chan<- string, m *metrics.Metrics) {
   ticker := time.NewTicker(1 * time.Second)
   defer ticker.Stop()
 
-  var file *os.File
-  var reader *bufio.Reader
+  t := newTailer(opts, out, m)
+  defer t.close()
+  t.resume()
+  for {
+    select {
+    case <-ctx.Done():
+      t.save()
+      return
+    case <-ticker.C:
+      t.poll()
+    }
+  }
+}
+
+type tailer struct {
+  opts    TailOptions
+  out     chan<- string
+  metrics *metrics.Metrics
+
+  file    *os.File
+  reader  *bufio.Reader
+  inode   uint64
+  // offset is the end of the last complete line read from file; partial
+  // holds a line still being written.
+  offset  int64
+  partial string
+  saved   string
+}
+
+func newTailer(opts TailOptions, out chan<- string, m *metrics.Metrics) *tailer {
+  return &tailer{opts: opts, out: out, metrics: m}
+}
+
+// resume opens the log at the saved position. Without saved state it starts
+// at the end, as there is no telling how much of the file was already seen.
+func (t *tailer) resume() {
   var inode uint64
+  var offset int64
+  state := util.ReadStateFile(t.opts.OffsetPath)
+  if _, err := fmt.Sscanf(state, "%d %d", &inode, &offset); err != nil {
+    if t.open(t.opts.Path) {
+      t.seek(-1)
+    }
+    return
+  }
+  if !t.open(t.opts.Path) {
+    return
+  }
+  switch {
+  case t.inode == inode && offset <= t.size():
+    t.seek(offset)
+  case t.inode == inode:
+    // Truncated while the agent was down.
+    if t.opts.DrainRotated {
+      t.drainRotated(inode, offset, true)
+    }
+    t.seek(0)
+  default:
+    // Rotated while the agent was down: everything in the new file is unread.
+    if t.opts.DrainRotated {
+      t.drainRotated(inode, offset, false)
+    }
+    t.seek(0)
+  }
+  t.save()
+}
 
-  reopen := func() {
-    if file != nil {
-      _ = file.Close()
+// poll reads everything appended since the last poll, following rotation.
+func (t *tailer) poll() {
+  if t.file == nil {
+    if t.open(t.opts.Path) {
+      t.seek(0)
     }
-    f, err := os.Open(path)
-    if err != nil {
-      file = nil
-      reader = nil
+    if t.file == nil {
       return
     }
-    file = f
-    reader = bufio.NewReader(f)
-    stat, _ := f.Stat()
-    if stat != nil {
-      if s, ok := stat.Sys().(*syscall.Stat_t); ok {
-        inode = s.Ino
-      }
+  }
+  if t.size() < t.offset {
+    // copytruncate: the unread tail, if any, was copied to Path.1.
+    if t.opts.DrainRotated {
+      t.drainRotated(t.inode, t.offset, true)
     }
-    _, _ = f.Seek(0, io.SeekEnd)
+    t.seek(0)
   }
+  t.readLines()
+  if ino, ok := statInode(t.opts.Path); ok && ino != t.inode {
+    // Renamed away: the old file was read to its end above, so a trailing
+    // line without newline is complete.
+    if t.partial != "" {
+      t.send(t.partial)
+    }
+    if t.open(t.opts.Path) {
+      t.seek(0)
+      t.readLines()
+    }
+  }
+  t.save()
+}
 
-  reopen()
-
+// readLines sends every complete line from the current position.
+func (t *tailer) readLines() {
   for {
-    select {
-    case <-ctx.Done():
-      if file != nil {
-        _ = file.Close()
+    chunk, err := t.reader.ReadString('\n')
+    if err != nil {
+      t.partial += chunk
+      if !errors.Is(err, io.EOF) {
+        log.Printf("dns tail: %s: %v", t.opts.Path, err)
       }
       return
-    case <-ticker.C:
-      if file == nil {
-        reopen()
-        continue
-      }
-      stat, err := file.Stat()
-      if err == nil {
-        if s, ok := stat.Sys().(*syscall.Stat_t); ok {
-          if s.Ino != inode {
-            reopen()
-          }
-        }
-      }
-      for {
-        line, err := reader.ReadString('\n')
-        if err != nil {
-          break
-        }
-        select {
-        case out <- line:
-        default:
-          if m != nil {
-            m.DroppedLocalTotal.WithLabelValues("dns_lines").Inc()
-          }
-        }
+    }
+    line := t.partial + chunk
+    t.partial = ""
+    t.offset += int64(len(line))
+    t.send(line)
+  }
+}
+
+// drainRotated sends Path.1 from offset to its end if it is the file that
+// was being read (same inode) or, when copied is set, a copy of it made by
+// copytruncate.
+func (t *tailer) drainRotated(inode uint64, offset int64, copied bool) {
+  f, err := os.Open(t.opts.Path + ".1")
+  if err != nil {
+    return
+  }
+  defer f.Close()
+  stat, err := f.Stat()
+  if err != nil || stat.Size() < offset {
+    return
+  }
+  ino, ok := fileInode(stat)
+  if !ok || (copied && ino == inode) || (!copied && ino != inode) {
+    return
+  }
+  if _, err := f.Seek(offset, io.SeekStart); err != nil {
+    return
+  }
+  r := bufio.NewReader(f)
+  for {
+    line, err := r.ReadString('\n')
+    if err != nil {
+      // A last line without newline is complete: the file is done.
+      if line != "" {
+        t.send(line)
       }
+      return
     }
+    t.send(line)
+  }
+}
+
+func (t *tailer) send(line string) {
+  select {
+  case t.out <- line:
+  default:
+    if t.metrics != nil {
+      t.metrics.DroppedLocalTotal.WithLabelValues("dns_lines").Inc()
+    }
+  }
+}
+
+func (t *tailer) open(path string) bool {
+  f, err := os.Open(path)
+  if err != nil {
+    return false
+  }
+  t.close()
+  t.file = f
+  t.reader = bufio.NewReader(f)
+  t.inode = 0
+  if stat, err := f.Stat(); err == nil {
+    t.inode, _ = fileInode(stat)
+  }
+  return true
+}
+
+// seek moves to offset, or to the end of the file if offset is negative.
+func (t *tailer) seek(offset int64) {
+  whence := io.SeekStart
+  if offset < 0 {
+    offset, whence = 0, io.SeekEnd
+  }
+  pos, err := t.file.Seek(offset, whence)
+  if err != nil {
+    pos = 0
+  }
+  t.offset = pos
+  t.partial = ""
+  t.reader.Reset(t.file)
+}
+
+func (t *tailer) size() int64 {
+  stat, err := t.file.Stat()
+  if err != nil {
+    return 0
+  }
+  return stat.Size()
+}
+
+// save persists the read position if it changed.
+func (t *tailer) save() {
+  if t.file == nil {
+    return
+  }
+  state := fmt.Sprintf("%d %d", t.inode, t.offset)
+  if state == t.saved {
+    return
+  }
+  if err := util.WriteStateFile(t.opts.OffsetPath, state); err != nil {
+    log.Printf("dns tail: save offset: %v", err)
+    return
+  }
+  t.saved = state
+}
+
+func (t *tailer) close() {
+  if t.file != nil {
+    _ = t.file.Close()
+    t.file = nil
+  }
+}
+
+func statInode(path string) (uint64, bool) {
+  stat, err := os.Stat(path)
+  if err != nil {
+    return 0, false
+  }
+  return fileInode(stat)
+}
+
+func fileInode(stat os.FileInfo) (uint64, bool) {
+  s, ok := stat.Sys().(*syscall.Stat_t)
+  if !ok {
+    return 0, false
   }
+  return s.Ino, true
 }
@@ -0,0 +1,188 @@
+package dns
+
+import (
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+)
+
+type tailFixture struct {
+  t    *testing.T
+  dir  string
+  log  string
+  opts TailOptions
+  out  chan string
+}
+
+func newTailFixture(t *testing.T, drain bool) *tailFixture {
+  dir := t.TempDir()
+  f := &tailFixture{t: t, dir: dir, log: filepath.Join(dir, "dnsmasq.log"), out: make(chan string, 100)}
+  f.opts = TailOptions{Path: f.log, OffsetPath: filepath.Join(dir, "state", "dns_tail.offset"), DrainRotated: drain}
+  return f
+}
+
+// start opens a tailer the way Tail does at startup.
+func (f *tailFixture) start() *tailer {
+  tl := newTailer(f.opts, f.out, nil)
+  f.t.Cleanup(tl.close)
+  tl.resume()
+  return tl
+}
+
+func (f *tailFixture) append(path string, lines ...string) {
+  f.t.Helper()
+  w, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+  if err != nil {
+    f.t.Fatal(err)
+  }
+  defer w.Close()
+  for _, line := range lines {
+    if _, err := w.WriteString(line); err != nil {
+      f.t.Fatal(err)
+    }
+  }
+}
+
+func (f *tailFixture) expect(want ...string) {
+  f.t.Helper()
+  var got []string
+  for len(f.out) > 0 {
+    got = append(got, <-f.out)
+  }
+  if !reflect.DeepEqual(got, want) {
+    f.t.Fatalf("got  %q\nwant %q", got, want)
+  }
+}
+
+// copytruncate does what logrotate's copytruncate does.
+func (f *tailFixture) copytruncate() {
+  f.t.Helper()
+  data, err := os.ReadFile(f.log)
+  if err != nil {
+    f.t.Fatal(err)
+  }
+  if err := os.WriteFile(f.log+".1", data, 0o644); err != nil {
+    f.t.Fatal(err)
+  }
+  if err := os.Truncate(f.log, 0); err != nil {
+    f.t.Fatal(err)
+  }
+}
+
+func (f *tailFixture) rename() {
+  f.t.Helper()
+  if err := os.Rename(f.log, f.log+".1"); err != nil {
+    f.t.Fatal(err)
+  }
+}
+
+func TestTailStartsAtEnd(t *testing.T) {
+  f := newTailFixture(t, false)
+  f.append(f.log, "old 1\n", "old 2\n")
+  tl := f.start()
+  f.append(f.log, "new 1\n")
+  tl.poll()
+  f.expect("new 1\n")
+}
+
+func TestTailResumesAfterRestart(t *testing.T) {
+  f := newTailFixture(t, false)
+  f.append(f.log, "old\n")
+  tl := f.start()
+  f.append(f.log, "a\n", "b")
+  tl.poll()
+  f.expect("a\n")
+  tl.close()
+
+  // Written while the agent was down, including the rest of the partial line.
+  f.append(f.log, "\n", "c\n")
+  tl = f.start()
+  tl.poll()
+  f.expect("b\n", "c\n")
+}
+
+func TestTailRename(t *testing.T) {
+  f := newTailFixture(t, false)
+  f.append(f.log, "old\n")
+  tl := f.start()
+  f.append(f.log, "a\n")
+  f.rename()
+  f.append(f.log+".1", "b\n")
+  f.append(f.log, "c\n")
+  tl.poll()
+  f.expect("a\n", "b\n", "c\n")
+  f.append(f.log, "d\n")
+  tl.poll()
+  f.expect("d\n")
+}
+
+func TestTailCopytruncate(t *testing.T) {
+  for _, drain := range []bool{false, true} {
+    f := newTailFixture(t, drain)
+    f.append(f.log, "old\n")
+    tl := f.start()
+    f.append(f.log, "a\n")
+    tl.poll()
+    f.expect("a\n")
+    // b is written after the last poll but before the copy.
+    f.append(f.log, "b\n")
+    f.copytruncate()
+    f.append(f.log, "c\n")
+    tl.poll()
+    if drain {
+      f.expect("b\n", "c\n")
+    } else {
+      f.expect("c\n")
+    }
+  }
+}
+
+func TestTailRotatedWhileDown(t *testing.T) {
+  for _, drain := range []bool{false, true} {
+    f := newTailFixture(t, drain)
+    f.append(f.log, "old\n")
+    tl := f.start()
+    f.append(f.log, "a\n")
+    tl.poll()
+    f.expect("a\n")
+    tl.close()
+
+    f.append(f.log, "b\n")
+    f.rename()
+    f.append(f.log, "c\n")
+    tl = f.start()
+    tl.poll()
+    if drain {
+      f.expect("b\n", "c\n")
+    } else {
+      f.expect("c\n")
+    }
+  }
+}
+
+func TestTailTruncatedWhileDown(t *testing.T) {
+  f := newTailFixture(t, true)
+  f.append(f.log, "old\n")
+  tl := f.start()
+  f.append(f.log, "a\n")
+  tl.poll()
+  f.expect("a\n")
+  tl.close()
+
+  f.append(f.log, "b\n")
+  f.copytruncate()
+  f.append(f.log, "c\n")
+  tl = f.start()
+  tl.poll()
+  f.expect("b\n", "c\n")
+}
+
+func TestTailMissingFile(t *testing.T) {
+  f := newTailFixture(t, false)
+  tl := f.start()
+  tl.poll()
+  f.append(f.log, "a\n")
+  tl.poll()
+  f.expect("a\n")
+}
@@ -0,0 +1,207 @@
+package dns
+
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "os/exec"
+  "strconv"
+  "strings"
+  "time"
+
+  "netmon_agent/internal/util"
+)
+
+var errJournalExited = errors.New("journalctl exited")
+
+// JournalOptions configures TailJournal.
+type JournalOptions struct {
+  // Command is the journalctl binary.
+  Command    string
+  // Identifier is the SYSLOG_IDENTIFIER to follow, e.g. dnsmasq.
+  Identifier string
+  // CursorPath persists the cursor of the last entry handed off, so a
+  // restart resumes right after it. Empty disables persistence.
+  CursorPath string
+}
+
+// journalEntry holds the export-format fields TailJournal uses.
+type journalEntry struct {
+  cursor   string
+  realtime time.Time
+  ident    string
+  pid      string
+  message  string
+}
+
+// TailJournal follows the systemd journal through `journalctl -f -o export`
+// and sends each entry to out as a syslog-style line with an RFC 3339
+// timestamp ("2026-03-08T14:19:59Z dnsmasq[812]: ..."), so the usual
+// DNSSource parsers apply.
+// Without a saved cursor it starts at the end of the journal, like Tail. Unlike
+// Tail it blocks on a full out: the journal keeps the backlog. journalctl is
+// restarted with backoff if it exits.
+func TailJournal(ctx context.Context, opts JournalOptions, out chan<- string) {
+  cursor := util.ReadStateFile(opts.CursorPath)
+  backoff := 1 * time.Second
+  maxBackoff := 30 * time.Second
+  for {
+    started := time.Now()
+    last, err := followJournal(ctx, opts, cursor, out)
+    if last != "" {
+      cursor = last
+    } else if err != nil && !errors.Is(err, errJournalExited) && cursor != "" {
+      // A cursor from a vacuumed or replaced journal makes journalctl fail
+      // before it prints anything; start over from the end.
+      log.Printf("dns journal: %v; dropping cursor", err)
+      cursor = ""
+      util.RemoveStateFile(opts.CursorPath)
+    }
+    if saveErr := util.WriteStateFile(opts.CursorPath, cursor); saveErr != nil {
+      log.Printf("dns journal: save cursor: %v", saveErr)
+    }
+    if ctx.Err() != nil {
+      return
+    }
+    if err != nil {
+      log.Printf("dns journal: %v", err)
+    }
+    if time.Since(started) > maxBackoff {
+      backoff = 1 * time.Second
+    }
+    select {
+    case <-ctx.Done():
+      return
+    case <-time.After(backoff):
+    }
+    backoff *= 2
+    if backoff > maxBackoff {
+      backoff = maxBackoff
+    }
+  }
+}
+
+// followJournal runs journalctl once and returns the cursor of the last entry
+// sent to out. The cursor is also saved at most once a second while entries
+// flow.
+func followJournal(ctx context.Context, opts JournalOptions, cursor string, out chan<- string) (string, error) {
+  args := []string{"-f", "-o", "export", "--no-pager", "SYSLOG_IDENTIFIER=" + opts.Identifier}
+  if cursor != "" {
+    args = append(args, "--after-cursor="+cursor)
+  } else {
+    args = append(args, "--lines=0")
+  }
+  cmd := exec.CommandContext(ctx, opts.Command, args...)
+  stdout, err := cmd.StdoutPipe()
+  if err != nil {
+    return "", err
+  }
+  var stderr bytes.Buffer
+  cmd.Stderr = &stderr
+  if err := cmd.Start(); err != nil {
+    return "", err
+  }
+
+  var last string
+  saved := time.Now()
+  r := bufio.NewReader(stdout)
+  for {
+    entry, err := readJournalEntry(r)
+    if err != nil {
+      if !errors.Is(err, io.EOF) {
+        _ = cmd.Process.Kill()
+      }
+      break
+    }
+    if entry.message == "" || entry.ident != opts.Identifier {
+      continue
+    }
+    select {
+    case out <- entry.line():
+    case <-ctx.Done():
+      _ = cmd.Wait()
+      return last, nil
+    }
+    last = entry.cursor
+    if time.Since(saved) >= time.Second {
+      if err := util.WriteStateFile(opts.CursorPath, last); err != nil {
+        log.Printf("dns journal: save cursor: %v", err)
+      }
+      saved = time.Now()
+    }
+  }
+  err = cmd.Wait()
+  if ctx.Err() != nil {
+    return last, nil
+  }
+  if err != nil {
+    return last, fmt.Errorf("journalctl: %v: %s", err, strings.TrimSpace(stderr.String()))
+  }
+  return last, errJournalExited
+}
+
+func (e journalEntry) line() string {
+  ts := e.realtime.Format(time.RFC3339Nano)
+  if e.pid == "" {
+    return ts + " " + e.ident + ": " + e.message
+  }
+  return ts + " " + e.ident + "[" + e.pid + "]: " + e.message
+}
+
+// readJournalEntry reads one entry of the journal export format: KEY=value
+// lines ended by an empty line, where fields that are not plain text are
+// written as KEY, a newline, a 64-bit little-endian length and the raw data.
+func readJournalEntry(r *bufio.Reader) (journalEntry, error) {
+  var e journalEntry
+  fields := 0
+  for {
+    line, err := r.ReadString('\n')
+    if err != nil {
+      if errors.Is(err, io.EOF) && line == "" && fields > 0 {
+        return e, nil
+      }
+      return e, err
+    }
+    line = strings.TrimSuffix(line, "\n")
+    if line == "" {
+      if fields == 0 {
+        continue
+      }
+      return e, nil
+    }
+    fields++
+    key, value, ok := strings.Cut(line, "=")
+    if !ok {
+      var size uint64
+      if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+        return e, err
+      }
+      if size > 1<<20 {
+        return e, fmt.Errorf("journal field %s too large (%d bytes)", key, size)
+      }
+      data := make([]byte, size+1)
+      if _, err := io.ReadFull(r, data); err != nil {
+        return e, err
+      }
+      value = string(data[:size])
+    }
+    switch key {
+    case "__CURSOR":
+      e.cursor = value
+    case "__REALTIME_TIMESTAMP":
+      usec, _ := strconv.ParseInt(value, 10, 64)
+      e.realtime = time.UnixMicro(usec)
+    case "SYSLOG_IDENTIFIER":
+      e.ident = value
+    case "_PID":
+      e.pid = value
+    case "MESSAGE":
+      e.message = strings.TrimRight(value, "\n")
+    }
+  }
+}
@@ -0,0 +1,109 @@
+package dns
+
+import (
+  "context"
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+
+  "netmon_agent/internal/util"
+)
+
+// runJournal runs TailJournal against testdata/fake_journalctl.sh until want
+// lines arrive and returns them with the arguments journalctl was given.
+func runJournal(t *testing.T, cursorPath string, want int) ([]string, string) {
+  t.Helper()
+  dir := t.TempDir()
+  argsPath := filepath.Join(dir, "args")
+  export, err := filepath.Abs("testdata/journal.export")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Setenv("FAKE_JOURNALCTL_ARGS", argsPath)
+  t.Setenv("FAKE_JOURNALCTL_EXPORT", export)
+
+  ctx, cancel := context.WithCancel(context.Background())
+  out := make(chan string)
+  done := make(chan struct{})
+  go func() {
+    TailJournal(ctx, JournalOptions{Command: "testdata/fake_journalctl.sh", Identifier: "dnsmasq", CursorPath: cursorPath}, out)
+    close(done)
+  }()
+  var lines []string
+  timeout := time.After(5 * time.Second)
+  for len(lines) < want {
+    select {
+    case line := <-out:
+      lines = append(lines, line)
+    case <-timeout:
+      t.Fatalf("got %d lines, want %d", len(lines), want)
+    }
+  }
+  cancel()
+  <-done
+  args, err := os.ReadFile(argsPath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return lines, strings.TrimSpace(string(args))
+}
+
+func TestTailJournal(t *testing.T) {
+  local := time.Local
+  time.Local = time.UTC
+  defer func() { time.Local = local }()
+
+  cursorPath := filepath.Join(t.TempDir(), "state", "dns_journal.cursor")
+  lines, args := runJournal(t, cursorPath, 3)
+  want := []string{
+    "2026-03-08T14:19:59Z dnsmasq[812]: query[A] github.com from 10.0.0.20",
+    "2026-03-08T14:19:59Z dnsmasq[812]: forwarded github.com to 8.8.8.8",
+    "2026-03-08T14:19:59.15Z dnsmasq[812]: reply github.com is 140.82.113.3",
+  }
+  if !reflect.DeepEqual(lines, want) {
+    t.Fatalf("lines\ngot  %q\nwant %q", lines, want)
+  }
+  if args != "-f -o export --no-pager SYSLOG_IDENTIFIER=dnsmasq --lines=0" {
+    t.Fatalf("first run args = %q", args)
+  }
+  for _, line := range lines {
+    if _, err := Parse(line, fixtureNow); err != nil {
+      t.Errorf("Parse(%q): %v", line, err)
+    }
+  }
+
+  // The cursor of the last dnsmasq entry (not the systemd one before it) is
+  // persisted and passed back on restart.
+  const last = "s=6b0b5c4a3e2d4f1a8c9b7e6d5f4a3b2c;i=104;b=2b1d0c6f5e4a4c1e9f3b7a8d6c5e4f3a;m=1004;t=64c83fb3141c4;x=abc4"
+  if got := util.ReadStateFile(cursorPath); got != last {
+    t.Fatalf("cursor = %q, want %q", got, last)
+  }
+  _, args = runJournal(t, cursorPath, 1)
+  if !strings.HasSuffix(args, " --after-cursor="+last) {
+    t.Fatalf("restart args = %q", args)
+  }
+}
+
+func TestJournalLinesParse(t *testing.T) {
+  // unbound logs "[pid:tid] ..." itself; journal lines add the syslog pid too.
+  for src, line := range map[string]string{
+    "unbound": "2026-03-08T14:19:59Z unbound[812]: [812:0] query: 10.0.0.20 github.com. A IN",
+    "bind":    "2026-03-08T14:19:59Z named[640]: client @0x7f8b3c0a2168 10.0.0.20#51234 (github.com): query: github.com IN A +E(0)K (10.0.0.1)",
+  } {
+    s, err := NewSource(src)
+    if err != nil {
+      t.Fatal(err)
+    }
+    p, err := s.Parse(line, fixtureNow)
+    if err != nil {
+      t.Errorf("%s: Parse(%q): %v", src, line, err)
+      continue
+    }
+    if p.Action != "query" || p.QName != "github.com" || p.ClientIP != "10.0.0.20" {
+      t.Errorf("%s: got %+v", src, p)
+    }
+  }
+}
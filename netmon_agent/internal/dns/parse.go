@@ -3,8 +3,11 @@ package dns
 import (
   "errors"
   "regexp"
+  "strconv"
   "strings"
   "time"
+
+  "netmon_agent/internal/event"
 )
 
 // Example dnsmasq log lines:
@@ -12,51 +15,137 @@ import (
 // Feb 20 14:21:33 dnsmasq[1234]: forwarded example.com to 1.1.1.1
 // Feb 20 14:21:33 dnsmasq[1234]: reply example.com is 93.184.216.34
 // Feb 20 14:21:33 dnsmasq[1234]: cached example.com is 93.184.216.34
+// Feb 20 14:21:33 dnsmasq[1234]: config router.lan is 192.168.1.1
+// Feb 20 14:21:33 dnsmasq[1234]: /etc/hosts nas.lan is 192.168.1.5
 // Feb 20 14:21:33 dnsmasq[1234]: query[AAAA] example.com from 192.168.1.50
 // Feb 20 14:21:33 dnsmasq[1234]: reply example.com is NXDOMAIN
+//
+// Lines written through syslog carry a hostname before "dnsmasq"; with
+// log-queries=extra each line is prefixed by the query serial and the
+// client address/port:
+// Feb 20 14:21:33 gw dnsmasq[1234]: 42 192.168.1.50/51234 query[A] example.com from 192.168.1.50
+//
+// rsyslog's file format and RFC 5424 forwarding use RFC 3339 timestamps:
+// 2026-02-20T14:21:33.120458+01:00 gw dnsmasq[1234]: query[A] example.com from 192.168.1.50
+// <30>1 2026-02-20T14:21:33.120Z gw dnsmasq 1234 - - query[A] example.com from 192.168.1.50
+
+const (
+  // syslogTS matches a classic syslog timestamp or an RFC 3339 one.
+  syslogTS = `\w{3}\s+\d+\s+\d{2}:\d{2}:\d{2}|\d{4}-\d{2}-\d{2}T\S+`
+  // rfc5424Header is the <PRI>VERSION before an RFC 5424 timestamp.
+  rfc5424Header = `(?:<\d+>1\s+)?`
+  // rfc5424Tag is what follows the app name in RFC 5424: PROCID, MSGID and
+  // structured data.
+  rfc5424Tag = `\s+\S+\s+\S+\s+(?:-|(?:\[[^\]]*\])+)`
+)
 
 var (
-  queryRe = regexp.MustCompile(`^(?P<ts>\w{3}\s+\d+\s+\d{2}:\d{2}:\d{2})\s+\S+\s+dnsmasq\[\d+\]:\s+query\[(?P<qtype>[^\]]+)\]\s+(?P<qname>\S+)\s+from\s+(?P<client>\S+)`)
-  replyRe = regexp.MustCompile(`^(?P<ts>\w{3}\s+\d+\s+\d{2}:\d{2}:\d{2})\s+\S+\s+dnsmasq\[\d+\]:\s+reply\s+(?P<qname>\S+)\s+is\s+(?P<answer>\S+)`)
+  lineRe      = regexp.MustCompile(`^` + rfc5424Header + `(?P<ts>` + syslogTS + `)\s+(?:\S+\s+)?dnsmasq(?:\[\d+\]:|` + rfc5424Tag + `)\s+(?:(?P<serial>\d+)\s+\S+/\d+\s+)?(?P<msg>.*)$`)
+  queryRe     = regexp.MustCompile(`^query\[(?P<qtype>[^\]]+)\]\s+(?P<qname>\S+)\s+from\s+(?P<client>\S+)`)
+  forwardedRe = regexp.MustCompile(`^forwarded\s+(?P<qname>\S+)\s+to\s+(?P<server>\S+)`)
+  answerRe    = regexp.MustCompile(`^(?P<source>reply|cached|cached-stale|config|/\S+)\s+(?P<qname>\S+)\s+is\s+(?P<answer>\S+)`)
 )
 
 type ParsedLine struct {
   TS       time.Time
   Action   string
+  Serial   int
   ClientIP string
   QName    string
   QType    string
+  Answer   string
+  RCode    string
+  Resolver string
   NXDomain bool
+  // Answers is set on response lines from sources that see the records.
+  Answers  []event.DNSAnswer
 }
 
+// Parse reads one dnsmasq log line. Action is query, forwarded, reply, cached
+// or config (address=/hosts-file answers). Resolver is the upstream server for
+// forwarded lines and "cache", "config" or the hosts file path for locally
+// answered ones. now supplies the year and time zone for timestamps that lack
+// them (see parseTS).
 func Parse(line string, now time.Time) (*ParsedLine, error) {
+  return parseDnsmasq(lineRe, line, now, nil)
+}
+
+// parseDnsmasq parses the dnsmasq log format behind prefix, whose groups are
+// the timestamp, the optional log-queries=extra serial and the message. extra
+// gets the first chance at each message, for forks that add their own lines.
+func parseDnsmasq(prefix *regexp.Regexp, line string, now time.Time, extra func(msg string, p *ParsedLine) bool) (*ParsedLine, error) {
   line = strings.TrimSpace(line)
   if line == "" {
     return nil, errors.New("empty")
   }
-  if m := queryRe.FindStringSubmatch(line); m != nil {
-    ts, err := parseTS(m[1], now)
-    if err != nil {
-      return nil, err
-    }
-    return &ParsedLine{TS: ts, Action: "query", QType: m[2], QName: m[3], ClientIP: m[4]}, nil
+  m := prefix.FindStringSubmatch(line)
+  if m == nil {
+    return nil, errors.New("unmatched")
+  }
+  ts, err := parseTS(m[1], now)
+  if err != nil {
+    return nil, err
+  }
+  p := &ParsedLine{TS: ts}
+  if m[2] != "" {
+    p.Serial, _ = strconv.Atoi(m[2])
   }
-  if m := replyRe.FindStringSubmatch(line); m != nil {
-    ts, err := parseTS(m[1], now)
-    if err != nil {
-      return nil, err
+  msg := m[3]
+
+  if extra != nil && extra(msg, p) {
+    return p, nil
+  }
+  if q := queryRe.FindStringSubmatch(msg); q != nil {
+    p.Action, p.QType, p.QName, p.ClientIP = "query", q[1], q[2], q[3]
+    return p, nil
+  }
+  if f := forwardedRe.FindStringSubmatch(msg); f != nil {
+    p.Action, p.QName, p.Resolver = "forwarded", f[1], f[2]
+    return p, nil
+  }
+  if a := answerRe.FindStringSubmatch(msg); a != nil {
+    p.QName, p.Answer = a[2], a[3]
+    switch source := a[1]; source {
+    case "reply":
+      p.Action = "reply"
+    case "cached", "cached-stale":
+      p.Action, p.Resolver = "cached", "cache"
+    default:
+      p.Action, p.Resolver = "config", source
     }
-    nxd := strings.Contains(strings.ToUpper(m[3]), "NXDOMAIN")
-    return &ParsedLine{TS: ts, Action: "reply", QName: m[2], NXDomain: nxd}, nil
+    p.NXDomain = strings.Contains(strings.ToUpper(p.Answer), "NXDOMAIN")
+    return p, nil
   }
   return nil, errors.New("unmatched")
 }
 
+// parseTSSkew is how far ahead of now a classic syslog timestamp may be, for
+// a log writer whose clock runs slightly ahead of the agent's.
+const parseTSSkew = 24 * time.Hour
+
+// parseTS parses a syslog timestamp. RFC 3339 timestamps are taken as they
+// are. Classic ones have no year or zone: they are read in now's location and
+// given the latest year that does not put them more than parseTSSkew ahead of
+// now, so a Dec 31 line read on Jan 1 stays in the old year and replayed logs
+// never land in the future. Feb 29 falls back to the latest leap year.
 func parseTS(prefix string, now time.Time) (time.Time, error) {
-  // dnsmasq logs don't include year
-  t, err := time.ParseInLocation("Jan 2 15:04:05", prefix, time.Local)
+  if len(prefix) > 0 && prefix[0] >= '0' && prefix[0] <= '9' {
+    return time.Parse(time.RFC3339Nano, prefix)
+  }
+  loc := now.Location()
+  t, err := time.ParseInLocation("Jan 2 15:04:05", prefix, loc)
   if err != nil {
     return time.Time{}, err
   }
-  return time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local), nil
+  limit := now.Add(parseTSSkew)
+  for year := now.Year() + 1; ; year-- {
+    c := time.Date(year, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc)
+    if c.Day() != t.Day() {
+      // Feb 29 outside a leap year.
+      continue
+    }
+    if !c.After(limit) {
+      return c, nil
+    }
+  }
 }
@@ -0,0 +1,170 @@
+package dns
+
+import (
+  "bufio"
+  "os"
+  "reflect"
+  "testing"
+  "time"
+)
+
+var fixtureNow = time.Date(2026, 3, 8, 15, 0, 0, 0, time.Local)
+
+func TestParse(t *testing.T) {
+  ts := time.Date(2026, 3, 8, 14, 19, 59, 0, time.Local)
+  tests := []struct {
+    line string
+    want ParsedLine
+  }{
+    {
+      "Mar  8 14:19:59 dnsmasq[812]: query[A] github.com from 10.0.0.20",
+      ParsedLine{TS: ts, Action: "query", QType: "A", QName: "github.com", ClientIP: "10.0.0.20"},
+    },
+    {
+      "Mar  8 14:19:59 dnsmasq[812]: forwarded github.com to 8.8.8.8",
+      ParsedLine{TS: ts, Action: "forwarded", QName: "github.com", Resolver: "8.8.8.8"},
+    },
+    {
+      "Mar  8 14:19:59 dnsmasq[812]: reply github.com is 140.82.113.3",
+      ParsedLine{TS: ts, Action: "reply", QName: "github.com", Answer: "140.82.113.3"},
+    },
+    {
+      "Mar  8 14:19:59 dnsmasq[812]: reply does-not-exist.example is NXDOMAIN",
+      ParsedLine{TS: ts, Action: "reply", QName: "does-not-exist.example", Answer: "NXDOMAIN", NXDomain: true},
+    },
+    {
+      "Mar  8 14:19:59 dnsmasq[812]: cached github.com is 140.82.113.3",
+      ParsedLine{TS: ts, Action: "cached", QName: "github.com", Answer: "140.82.113.3", Resolver: "cache"},
+    },
+    {
+      "Mar  8 14:19:59 dnsmasq[812]: cached-stale github.com is 140.82.113.3",
+      ParsedLine{TS: ts, Action: "cached", QName: "github.com", Answer: "140.82.113.3", Resolver: "cache"},
+    },
+    {
+      "Mar  8 14:19:59 dnsmasq[812]: config router.lan is 10.0.0.1",
+      ParsedLine{TS: ts, Action: "config", QName: "router.lan", Answer: "10.0.0.1", Resolver: "config"},
+    },
+    {
+      "Mar  8 14:19:59 dnsmasq[812]: /etc/hosts nas.lan is 10.0.0.5",
+      ParsedLine{TS: ts, Action: "config", QName: "nas.lan", Answer: "10.0.0.5", Resolver: "/etc/hosts"},
+    },
+    {
+      "Mar  8 14:19:59 gw dnsmasq[812]: 41 10.0.0.20/51234 query[AAAA] github.com from 10.0.0.20",
+      ParsedLine{TS: ts, Action: "query", Serial: 41, QType: "AAAA", QName: "github.com", ClientIP: "10.0.0.20"},
+    },
+    {
+      "Mar  8 14:19:59 gw dnsmasq[812]: reply www.netflix.com is <CNAME>",
+      ParsedLine{TS: ts, Action: "reply", QName: "www.netflix.com", Answer: "<CNAME>"},
+    },
+    {
+      "2026-03-08T14:19:59.250+01:00 gw dnsmasq[812]: query[A] github.com from 10.0.0.20",
+      ParsedLine{TS: time.Date(2026, 3, 8, 14, 19, 59, 250e6, time.FixedZone("", 3600)), Action: "query", QType: "A", QName: "github.com", ClientIP: "10.0.0.20"},
+    },
+    {
+      "<30>1 2026-03-08T14:19:59Z gw dnsmasq 812 - - 41 10.0.0.20/51234 reply github.com is 140.82.113.3",
+      ParsedLine{TS: time.Date(2026, 3, 8, 14, 19, 59, 0, time.UTC), Action: "reply", Serial: 41, QName: "github.com", Answer: "140.82.113.3"},
+    },
+  }
+  for _, tt := range tests {
+    got, err := Parse(tt.line, fixtureNow)
+    if err != nil {
+      t.Errorf("Parse(%q): %v", tt.line, err)
+      continue
+    }
+    // Compare instants: RFC 3339 offsets parse into unnamed zones.
+    if got.TS.Equal(tt.want.TS) {
+      got.TS = tt.want.TS
+    }
+    if !reflect.DeepEqual(*got, tt.want) {
+      t.Errorf("Parse(%q)\ngot  %+v\nwant %+v", tt.line, *got, tt.want)
+    }
+  }
+}
+
+func TestParseTS(t *testing.T) {
+  ny, err := time.LoadLocation("America/New_York")
+  if err != nil {
+    t.Skip(err)
+  }
+  utc := func(s string) time.Time {
+    ts, err := time.Parse(time.RFC3339, s)
+    if err != nil {
+      t.Fatal(err)
+    }
+    return ts
+  }
+  tests := []struct {
+    name   string
+    prefix string
+    now    time.Time
+    want   time.Time
+  }{
+    {"same day", "Mar  8 14:19:59", utc("2026-03-08T15:00:00Z"), utc("2026-03-08T14:19:59Z")},
+    {"dec 31 read after midnight", "Dec 31 23:59:58", utc("2027-01-01T00:00:05Z"), utc("2026-12-31T23:59:58Z")},
+    {"jan 1 read before midnight", "Jan  1 00:00:02", utc("2026-12-31T23:59:59Z"), utc("2027-01-01T00:00:02Z")},
+    {"replay from last autumn", "Oct  1 08:00:00", utc("2026-03-08T15:00:00Z"), utc("2025-10-01T08:00:00Z")},
+    {"replay from this summer", "Jul  1 08:00:00", utc("2026-12-01T15:00:00Z"), utc("2026-07-01T08:00:00Z")},
+    {"replay from last summer", "Jun  1 08:00:00", utc("2026-03-08T15:00:00Z"), utc("2025-06-01T08:00:00Z")},
+    {"clock skew within a day", "Mar  9 14:59:59", utc("2026-03-08T15:00:00Z"), utc("2026-03-09T14:59:59Z")},
+    {"more than a day ahead", "Mar  9 15:00:01", utc("2026-03-08T15:00:00Z"), utc("2025-03-09T15:00:01Z")},
+    {"feb 29 outside a leap year", "Feb 29 12:00:00", utc("2026-03-08T15:00:00Z"), utc("2024-02-29T12:00:00Z")},
+    {"feb 29 in a leap year", "Feb 29 12:00:00", utc("2028-03-01T15:00:00Z"), utc("2028-02-29T12:00:00Z")},
+    {"zone from now", "Mar  8 14:19:59", time.Date(2026, 3, 8, 15, 0, 0, 0, ny), utc("2026-03-08T18:19:59Z")},
+    {"zone across year end", "Dec 31 23:30:00", time.Date(2027, 1, 1, 0, 10, 0, 0, ny), utc("2027-01-01T04:30:00Z")},
+    {"rfc3339 keeps its year", "2019-12-31T23:59:58.5-05:00", utc("2026-03-08T15:00:00Z"), utc("2020-01-01T04:59:58.5Z")},
+    {"rfc3339 utc", "2026-03-08T14:19:59Z", time.Date(2026, 3, 8, 15, 0, 0, 0, ny), utc("2026-03-08T14:19:59Z")},
+  }
+  for _, tt := range tests {
+    got, err := parseTS(tt.prefix, tt.now)
+    if err != nil {
+      t.Errorf("%s: %v", tt.name, err)
+      continue
+    }
+    if !got.Equal(tt.want) {
+      t.Errorf("%s: parseTS(%q) = %s, want %s", tt.name, tt.prefix, got.UTC(), tt.want)
+    }
+  }
+  if _, err := parseTS("Smarch 8 14:19:59", utc("2026-03-08T15:00:00Z")); err == nil {
+    t.Error("invalid month parsed")
+  }
+}
+
+func TestParseUnmatched(t *testing.T) {
+  for _, line := range []string{
+    "",
+    "Mar  8 14:19:59 dnsmasq[812]: started, version 2.89 cachesize 150",
+    "Mar  8 14:19:59 sshd[90]: query[A] github.com from 10.0.0.20",
+  } {
+    if _, err := Parse(line, fixtureNow); err == nil {
+      t.Errorf("Parse(%q) succeeded", line)
+    }
+  }
+}
+
+func TestParseFixtures(t *testing.T) {
+  for _, name := range []string{"testdata/dnsmasq.log", "testdata/dnsmasq_extra.log"} {
+    for i, line := range readFixture(t, name) {
+      if _, err := Parse(line, fixtureNow); err != nil {
+        t.Errorf("%s:%d: %v", name, i+1, err)
+      }
+    }
+  }
+}
+
+func readFixture(t *testing.T, name string) []string {
+  t.Helper()
+  f, err := os.Open(name)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer f.Close()
+  var lines []string
+  sc := bufio.NewScanner(f)
+  for sc.Scan() {
+    lines = append(lines, sc.Text())
+  }
+  if err := sc.Err(); err != nil {
+    t.Fatal(err)
+  }
+  return lines
+}
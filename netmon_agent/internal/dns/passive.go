@@ -0,0 +1,152 @@
+package dns
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/google/gopacket"
+  "github.com/google/gopacket/layers"
+
+  "netmon_agent/internal/event"
+)
+
+const dnsPort = 53
+
+var errNotDNS = errors.New("not a DNS message")
+
+// DecodePacket decodes a DNS message captured from the wire, e.g. through an
+// NFLOG group with kind: dns. raw starts at the IP header. A query becomes a
+// "query" line from its source; a response becomes a self-contained
+// "response" line for its destination with the answers and TTLs, and the
+// responding server as Resolver. TCP messages must fit in one segment.
+func DecodePacket(raw []byte, ts time.Time) (*ParsedLine, error) {
+  if len(raw) == 0 {
+    return nil, errNotDNS
+  }
+  first := layers.LayerTypeIPv4
+  switch raw[0] >> 4 {
+  case 4:
+  case 6:
+    first = layers.LayerTypeIPv6
+  default:
+    return nil, errNotDNS
+  }
+  pkt := gopacket.NewPacket(raw, first, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+  var srcIP, dstIP string
+  if ip, ok := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+    srcIP, dstIP = ip.SrcIP.String(), ip.DstIP.String()
+  } else if ip, ok := pkt.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+    srcIP, dstIP = ip.SrcIP.String(), ip.DstIP.String()
+  } else {
+    return nil, errNotDNS
+  }
+
+  var payload []byte
+  if udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+    if udp.SrcPort != dnsPort && udp.DstPort != dnsPort {
+      return nil, errNotDNS
+    }
+    payload = udp.Payload
+  } else if tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+    if tcp.SrcPort != dnsPort && tcp.DstPort != dnsPort {
+      return nil, errNotDNS
+    }
+    // DNS over TCP carries a two-byte length prefix.
+    if len(tcp.Payload) < 2 || int(binary.BigEndian.Uint16(tcp.Payload)) > len(tcp.Payload)-2 {
+      return nil, errNotDNS
+    }
+    payload = tcp.Payload[2 : 2+binary.BigEndian.Uint16(tcp.Payload)]
+  } else {
+    return nil, errNotDNS
+  }
+
+  var msg layers.DNS
+  if err := msg.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+    return nil, fmt.Errorf("decode dns: %w", err)
+  }
+  if len(msg.Questions) == 0 {
+    return nil, errNotDNS
+  }
+  q := msg.Questions[0]
+  p := &ParsedLine{
+    TS: ts,
+    QName: strings.TrimSuffix(string(q.Name), "."),
+    QType: dnsTypeName(q.Type),
+  }
+  if !msg.QR {
+    p.Action, p.ClientIP, p.Resolver = "query", srcIP, dstIP
+    return p, nil
+  }
+  p.Action, p.ClientIP, p.Resolver = "response", dstIP, srcIP
+  p.RCode = rcodeName(msg.ResponseCode)
+  p.NXDomain = msg.ResponseCode == layers.DNSResponseCodeNXDomain
+  p.Answers = make([]event.DNSAnswer, 0, len(msg.Answers))
+  for _, rr := range msg.Answers {
+    ttl := int(rr.TTL)
+    p.Answers = append(p.Answers, event.DNSAnswer{
+      Name: strings.TrimSuffix(string(rr.Name), "."),
+      Type: dnsTypeName(rr.Type),
+      Data: rrData(rr),
+      TTL: &ttl,
+    })
+  }
+  return p, nil
+}
+
+func rrData(rr layers.DNSResourceRecord) string {
+  switch rr.Type {
+  case layers.DNSTypeA, layers.DNSTypeAAAA:
+    if rr.IP != nil {
+      return rr.IP.String()
+    }
+  case layers.DNSTypeCNAME:
+    return strings.TrimSuffix(string(rr.CNAME), ".")
+  case layers.DNSTypePTR:
+    return strings.TrimSuffix(string(rr.PTR), ".")
+  case layers.DNSTypeNS:
+    return strings.TrimSuffix(string(rr.NS), ".")
+  case layers.DNSTypeMX:
+    return strconv.Itoa(int(rr.MX.Preference)) + " " + strings.TrimSuffix(string(rr.MX.Name), ".")
+  case layers.DNSTypeSRV:
+    return fmt.Sprintf("%d %d %d %s", rr.SRV.Priority, rr.SRV.Weight, rr.SRV.Port, strings.TrimSuffix(string(rr.SRV.Name), "."))
+  case layers.DNSTypeTXT:
+    parts := make([]string, len(rr.TXTs))
+    for i, t := range rr.TXTs {
+      parts[i] = string(t)
+    }
+    return strings.Join(parts, "")
+  }
+  return ""
+}
+
+// dnsTypeName falls back to the RFC 3597 TYPEnn form for types gopacket does
+// not name (HTTPS, SVCB, ...).
+func dnsTypeName(t layers.DNSType) string {
+  if s := t.String(); s != "Unknown" {
+    return s
+  }
+  return "TYPE" + strconv.Itoa(int(t))
+}
+
+func rcodeName(rc layers.DNSResponseCode) string {
+  switch rc {
+  case layers.DNSResponseCodeNoErr:
+    return "NOERROR"
+  case layers.DNSResponseCodeFormErr:
+    return "FORMERR"
+  case layers.DNSResponseCodeServFail:
+    return "SERVFAIL"
+  case layers.DNSResponseCodeNXDomain:
+    return "NXDOMAIN"
+  case layers.DNSResponseCodeNotImp:
+    return "NOTIMP"
+  case layers.DNSResponseCodeRefused:
+    return "REFUSED"
+  }
+  return "RCODE" + strconv.Itoa(int(rc))
+}
@@ -0,0 +1,103 @@
+package dns
+
+import (
+  "os"
+  "reflect"
+  "testing"
+  "time"
+
+  "github.com/google/gopacket/pcapgo"
+
+  "netmon_agent/internal/event"
+)
+
+// readPcap returns the packets of a LinkTypeRaw capture, i.e. what a dns
+// NFLOG group hands to DecodePacket.
+func readPcap(t *testing.T, name string) ([][]byte, []time.Time) {
+  t.Helper()
+  f, err := os.Open(name)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer f.Close()
+  r, err := pcapgo.NewReader(f)
+  if err != nil {
+    t.Fatal(err)
+  }
+  var pkts [][]byte
+  var stamps []time.Time
+  for {
+    data, ci, err := r.ReadPacketData()
+    if err != nil {
+      break
+    }
+    pkts = append(pkts, data)
+    stamps = append(stamps, ci.Timestamp)
+  }
+  return pkts, stamps
+}
+
+func TestDecodePacket(t *testing.T) {
+  pkts, stamps := readPcap(t, "testdata/dns.pcap")
+  if len(pkts) != 7 {
+    t.Fatalf("got %d packets, want 7", len(pkts))
+  }
+  ttl := func(n int) *int { return &n }
+  want := []*ParsedLine{
+    {Action: "query", ClientIP: "10.0.0.20", Resolver: "9.9.9.9", QName: "github.com", QType: "A"},
+    {Action: "response", ClientIP: "10.0.0.20", Resolver: "9.9.9.9", QName: "github.com", QType: "A", RCode: "NOERROR",
+      Answers: []event.DNSAnswer{{Name: "github.com", Type: "A", Data: "140.82.113.3", TTL: ttl(60)}}},
+    {Action: "response", ClientIP: "10.0.0.20", Resolver: "9.9.9.9", QName: "www.netflix.com", QType: "AAAA", RCode: "NOERROR",
+      Answers: []event.DNSAnswer{
+        {Name: "www.netflix.com", Type: "CNAME", Data: "www.dradis.netflix.com", TTL: ttl(300)},
+        {Name: "www.dradis.netflix.com", Type: "AAAA", Data: "2600:1f14:62a:de82:822d:a423:9e4c:da8d", TTL: ttl(60)},
+      }},
+    {Action: "response", ClientIP: "10.0.0.20", Resolver: "9.9.9.9", QName: "does-not-exist.example", QType: "A", RCode: "NXDOMAIN",
+      NXDomain: true, Answers: []event.DNSAnswer{}},
+    {Action: "response", ClientIP: "fd00::20", Resolver: "2620:fe::fe", QName: "example.org", QType: "A", RCode: "NOERROR",
+      Answers: []event.DNSAnswer{{Name: "example.org", Type: "A", Data: "93.184.215.14", TTL: ttl(3600)}}},
+    {Action: "response", ClientIP: "10.0.0.20", Resolver: "9.9.9.9", QName: "_dmarc.example.com", QType: "TXT", RCode: "NOERROR",
+      Answers: []event.DNSAnswer{{Name: "_dmarc.example.com", Type: "TXT", Data: "v=DMARC1; p=none", TTL: ttl(600)}}},
+  }
+  for i, w := range want {
+    got, err := DecodePacket(pkts[i], stamps[i])
+    if err != nil {
+      t.Errorf("packet %d: %v", i+1, err)
+      continue
+    }
+    w.TS = stamps[i]
+    if !reflect.DeepEqual(got, w) {
+      t.Errorf("packet %d\ngot  %+v\nwant %+v", i+1, got, w)
+    }
+  }
+  if _, err := DecodePacket(pkts[6], stamps[6]); err == nil {
+    t.Error("non-DNS packet decoded")
+  }
+  if _, err := DecodePacket([]byte{0x45, 0x00}, stamps[0]); err == nil {
+    t.Error("truncated packet decoded")
+  }
+}
+
+func TestPassiveResponses(t *testing.T) {
+  pkts, stamps := readPcap(t, "testdata/dns.pcap")
+  m := newResponseMatcher(10*time.Second, 100)
+  var got []event.Event
+  for i, pkt := range pkts {
+    p, err := DecodePacket(pkt, stamps[i])
+    if err != nil {
+      continue
+    }
+    got = append(got, m.observe(p, stamps[i])...)
+  }
+  got = append(got, m.flush(stamps[len(stamps)-1].Add(time.Minute))...)
+  if len(got) != 5 {
+    t.Fatalf("got %d responses, want 5", len(got))
+  }
+  resp := got[0].Data.(event.DNSResponse)
+  if resp.QName != "github.com" || resp.Resolver != "9.9.9.9" || *resp.Answers[0].TTL != 60 {
+    t.Fatalf("got %+v", resp)
+  }
+  if m.len() != 0 {
+    t.Fatalf("%d queries still pending", m.len())
+  }
+}
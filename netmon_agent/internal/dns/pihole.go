@@ -0,0 +1,38 @@
+package dns
+
+import (
+  "regexp"
+  "strings"
+  "time"
+
+  "netmon_agent/internal/config"
+)
+
+// Pi-hole's FTL is a dnsmasq fork and pihole.log uses the dnsmasq format,
+// under either process name, plus lines for blocked queries:
+// Mar  8 14:20:02 dnsmasq[812]: gravity blocked ads.example.com is 0.0.0.0
+// Mar  8 14:20:02 pihole-FTL[812]: regex blacklisted tracker.example.net is NXDOMAIN
+//
+// Blocked and Pi-hole-internal answers become config answers whose resolver is
+// the reason FTL logged.
+
+var (
+  piholeLineRe    = regexp.MustCompile(`^` + rfc5424Header + `(?P<ts>` + syslogTS + `)\s+(?:\S+\s+)?(?:dnsmasq|pihole-FTL)(?:\[\d+\]:|` + rfc5424Tag + `)\s+(?:(?P<serial>\d+)\s+\S+/\d+\s+)?(?P<msg>.*)$`)
+  piholeBlockedRe = regexp.MustCompile(`^(?P<reason>gravity blocked|regex blacklisted|exactly blacklisted|regex denied|exactly denied|special domain|Pi-hole hostname)\s+(?P<qname>\S+)\s+is\s+(?P<answer>\S+)`)
+)
+
+type piholeSource struct{}
+
+func (piholeSource) Name() string { return config.DNSSourcePihole }
+
+func (piholeSource) Parse(line string, now time.Time) (*ParsedLine, error) {
+  return parseDnsmasq(piholeLineRe, line, now, func(msg string, p *ParsedLine) bool {
+    b := piholeBlockedRe.FindStringSubmatch(msg)
+    if b == nil {
+      return false
+    }
+    p.Action, p.Resolver, p.QName, p.Answer = "config", b[1], b[2], b[3]
+    p.NXDomain = strings.EqualFold(p.Answer, "NXDOMAIN")
+    return true
+  })
+}
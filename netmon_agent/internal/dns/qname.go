@@ -0,0 +1,116 @@
+package dns
+
+import (
+  "crypto/sha256"
+  "encoding/base64"
+  "net/netip"
+  "sort"
+  "strings"
+
+  "golang.org/x/net/publicsuffix"
+
+  "netmon_agent/internal/config"
+  "netmon_agent/internal/event"
+)
+
+// qnamePolicy decides how a client's qnames appear in dns_bucket,
+// host_identity, dns_response, dns_anomaly and flow dns_context and
+// dst_domain: salted hash, plain, or reduced to the
+// registrable domain (eTLD+1). The most specific matching override wins.
+type qnamePolicy struct {
+  mode      string
+  salt      string
+  overrides []qnameOverride
+}
+
+type qnameOverride struct {
+  prefix netip.Prefix
+  mode   string
+}
+
+func newQNamePolicy(cfg *config.Config) *qnamePolicy {
+  p := &qnamePolicy{mode: cfg.QnameMode, salt: cfg.QnameHashSalt}
+  if p.mode == "" {
+    p.mode = config.QnameModeHash
+  }
+  for _, o := range cfg.QnameModeOverrides {
+    // Validated by config.Load.
+    prefix, err := netip.ParsePrefix(o.Subnet)
+    if err != nil {
+      continue
+    }
+    p.overrides = append(p.overrides, qnameOverride{prefix: prefix.Masked(), mode: o.Mode})
+  }
+  sort.SliceStable(p.overrides, func(i, j int) bool {
+    return p.overrides[i].prefix.Bits() > p.overrides[j].prefix.Bits()
+  })
+  return p
+}
+
+// modeFor returns the mode for a client address.
+func (p *qnamePolicy) modeFor(clientIP string) string {
+  if len(p.overrides) == 0 {
+    return p.mode
+  }
+  addr, err := netip.ParseAddr(clientIP)
+  if err != nil {
+    return p.mode
+  }
+  addr = addr.Unmap()
+  for _, o := range p.overrides {
+    if o.prefix.Contains(addr) {
+      return o.mode
+    }
+  }
+  return p.mode
+}
+
+// render returns qname as clientIP's mode presents it.
+func (p *qnamePolicy) render(clientIP, qname string) string {
+  return p.renderMode(p.modeFor(clientIP), qname)
+}
+
+func (p *qnamePolicy) renderMode(mode, qname string) string {
+  q := strings.ToLower(strings.TrimSpace(qname))
+  switch mode {
+  case config.QnameModePlain:
+    return strings.TrimSuffix(q, ".")
+  case config.QnameModeETLD1:
+    q = strings.TrimSuffix(q, ".")
+    if d, err := publicsuffix.EffectiveTLDPlusOne(q); err == nil {
+      return d
+    }
+    return q
+  default:
+    sum := sha256.Sum256([]byte(p.salt + q))
+    return "b64:" + base64.StdEncoding.EncodeToString(sum[:])
+  }
+}
+
+// renderResponse applies the client's mode to the names in a response: the
+// qname, each answer's owner name and the target of name records. Other
+// record data can carry names too (MX, SRV, TXT), so outside plain mode only
+// addresses are kept.
+func (p *qnamePolicy) renderResponse(resp event.DNSResponse) event.DNSResponse {
+  mode := p.modeFor(resp.ClientIP)
+  resp.QNameMode = mode
+  resp.QName = p.renderMode(mode, resp.QName)
+  answers := make([]event.DNSAnswer, len(resp.Answers))
+  for i, ans := range resp.Answers {
+    ans.Name = p.renderMode(mode, ans.Name)
+    switch ans.Type {
+    case "A", "AAAA":
+    case "CNAME", "DNAME", "NS", "PTR":
+      if ans.Data != "" {
+        ans.Data = p.renderMode(mode, ans.Data)
+      }
+    default:
+      if mode != config.QnameModePlain {
+        ans.Data = ""
+      }
+    }
+    answers[i] = ans
+  }
+  resp.Answers = answers
+  return resp
+}
@@ -0,0 +1,46 @@
+package dns
+
+import (
+  "testing"
+
+  "netmon_agent/internal/config"
+)
+
+func TestQNamePolicy(t *testing.T) {
+  p := newQNamePolicy(&config.Config{
+    QnameMode: config.QnameModePlain,
+    QnameHashSalt: "salt",
+    QnameModeOverrides: []config.QnameModeOverride{
+      {Subnet: "10.0.0.0/16", Mode: config.QnameModeETLD1},
+      {Subnet: "10.0.50.0/24", Mode: config.QnameModeHash},
+    },
+  })
+  tests := []struct {
+    client string
+    qname  string
+    want   string
+  }{
+    {"192.168.1.5", "WWW.GitHub.com.", "www.github.com"},
+    {"10.0.0.20", "www.bbc.co.uk", "bbc.co.uk"},
+    {"10.0.0.20", "alice.github.io", "alice.github.io"},
+    {"10.0.0.20", "router.lan", "router.lan"},
+    {"::ffff:10.0.0.20", "api.github.com", "github.com"},
+    {"10.0.50.7", "github.com", "b64:AGKTI5nFzmjN8ZGpc2GPqoBFS0PZWqo3O/QPNoFBsps="},
+  }
+  for _, tt := range tests {
+    if got := p.render(tt.client, tt.qname); got != tt.want {
+      t.Errorf("render(%s, %s) = %q, want %q", tt.client, tt.qname, got, tt.want)
+    }
+  }
+  if got := p.modeFor("10.0.50.7"); got != config.QnameModeHash {
+    t.Errorf("most specific override not applied: %s", got)
+  }
+}
+
+func TestQNamePolicyDefaultHash(t *testing.T) {
+  p := newQNamePolicy(&config.Config{QnameHashSalt: "salt"})
+  a, b := p.render("10.0.0.20", "GitHub.com"), p.render("10.0.0.21", "github.com")
+  if a != b || a[:4] != "b64:" {
+    t.Fatalf("hash mode: %q vs %q", a, b)
+  }
+}
@@ -0,0 +1,396 @@
+package dns
+
+import (
+  "container/list"
+  "fmt"
+  "net/netip"
+  "strings"
+  "time"
+
+  "netmon_agent/internal/event"
+)
+
+// responseSettle is how long an answered query waits for further answer lines
+// before it is emitted when nothing else ends its run.
+const responseSettle = 2 * time.Second
+
+// Drop reasons reported through responseMatcher.onDrop.
+const (
+  dropTimeout = "timeout"
+  dropEvicted = "evicted"
+  dropOrphan  = "orphan"
+)
+
+// responseMatcher stitches dnsmasq query, forwarded and answer lines into one
+// dns_response per client query. dnsmasq logs every record of a reply on
+// consecutive lines, so without log-queries=extra an answer run ends at the
+// first line that is not part of it. With extra, lines carry the query serial
+// and are matched on it directly. Unanswered queries are dropped after window
+// and at most max queries are held.
+type responseMatcher struct {
+  window time.Duration
+  max    int
+  onDrop func(reason string)
+
+  order    *list.List // *pendingQuery, oldest first
+  byName   map[string][]*pendingQuery
+  bySerial map[int]*pendingQuery
+
+  run     []*pendingQuery
+  runName string
+  runAt   time.Time
+  chain   []string // CNAME owners awaiting the terminal answer
+}
+
+type pendingQuery struct {
+  elem      *list.Element
+  serial    int
+  key       string
+  created   time.Time
+  answered  time.Time
+  ts        time.Time
+  cnameFrom string
+  done      bool
+  resp      event.DNSResponse
+}
+
+func newResponseMatcher(window time.Duration, max int) *responseMatcher {
+  return &responseMatcher{
+    window: window,
+    max: max,
+    order: list.New(),
+    byName: make(map[string][]*pendingQuery),
+    bySerial: make(map[int]*pendingQuery),
+  }
+}
+
+func (m *responseMatcher) len() int {
+  return m.order.Len()
+}
+
+// observe feeds one parsed line and returns any responses it completed.
+func (m *responseMatcher) observe(p *ParsedLine, now time.Time) []event.Event {
+  var out []event.Event
+  switch p.Action {
+  case "query":
+    out = m.endRun(out)
+    out = m.addQuery(p, now, out)
+  case "forwarded":
+    out = m.endRun(out)
+    for _, pq := range m.lookup(p) {
+      pq.resp.Resolver = p.Resolver
+    }
+  case "reply", "cached", "config":
+    out = m.answer(p, now, out)
+  case "response":
+    out = m.endRun(out)
+    out = m.response(p, out)
+  }
+  return out
+}
+
+// response handles sources that log a whole response on one line. It closes
+// out the matching query, if that was logged, and emits directly.
+func (m *responseMatcher) response(p *ParsedLine, out []event.Event) []event.Event {
+  resp := event.DNSResponse{
+    ClientIP: p.ClientIP,
+    QName: p.QName,
+    QType: p.QType,
+    RCode: p.RCode,
+    Answers: p.Answers,
+    Resolver: p.Resolver,
+  }
+  if resp.Answers == nil {
+    resp.Answers = []event.DNSAnswer{}
+  }
+  for _, pq := range m.open(p.QName) {
+    if pq.resp.ClientIP == p.ClientIP && pq.resp.QType == p.QType {
+      if resp.Resolver == "" {
+        resp.Resolver = pq.resp.Resolver
+      }
+      m.remove(pq)
+      break
+    }
+  }
+  if resp.RCode == "" {
+    resp.RCode = "NOERROR"
+  }
+  return append(out, event.Event{Type: "dns_response", TS: p.TS.UTC(), Data: resp})
+}
+
+// flush emits answered queries that have settled and drops queries that never
+// got an answer within the window.
+func (m *responseMatcher) flush(now time.Time) []event.Event {
+  var out []event.Event
+  if (len(m.run) > 0 || len(m.chain) > 0) && now.Sub(m.runAt) >= responseSettle {
+    out = m.endRun(out)
+  }
+  for e := m.order.Front(); e != nil; {
+    next := e.Next()
+    pq := e.Value.(*pendingQuery)
+    switch {
+    case !pq.answered.IsZero():
+      if now.Sub(pq.answered) >= responseSettle {
+        out = m.emit(pq, out)
+      }
+    case now.Sub(pq.created) >= m.window:
+      m.remove(pq)
+      m.drop(dropTimeout)
+    }
+    e = next
+  }
+  return out
+}
+
+func (m *responseMatcher) addQuery(p *ParsedLine, now time.Time, out []event.Event) []event.Event {
+  key := nameKey(p.QName)
+  if p.Serial == 0 {
+    // A client retry for the same question keeps the original entry.
+    for _, pq := range m.byName[key] {
+      if pq.serial == 0 && pq.answered.IsZero() && pq.resp.ClientIP == p.ClientIP && pq.resp.QType == p.QType {
+        return out
+      }
+    }
+  }
+  for m.max > 0 && m.order.Len() >= m.max {
+    oldest := m.order.Front().Value.(*pendingQuery)
+    if oldest.answered.IsZero() {
+      m.remove(oldest)
+      m.drop(dropEvicted)
+    } else {
+      out = m.emit(oldest, out)
+    }
+  }
+  pq := &pendingQuery{
+    serial: p.Serial,
+    key: key,
+    created: now,
+    resp: event.DNSResponse{ClientIP: p.ClientIP, QName: p.QName, QType: p.QType},
+  }
+  pq.elem = m.order.PushBack(pq)
+  m.byName[key] = append(m.byName[key], pq)
+  if p.Serial != 0 {
+    m.bySerial[p.Serial] = pq
+  }
+  return out
+}
+
+func (m *responseMatcher) answer(p *ParsedLine, now time.Time, out []event.Event) []event.Event {
+  var targets []*pendingQuery
+  switch {
+  case p.Serial != 0:
+    targets = m.lookup(p)
+  case len(m.chain) > 0:
+    // The CNAME chain so far belongs to whichever open query for its head
+    // the terminal answer fits.
+    if p.Answer == "<CNAME>" {
+      m.chain = append(m.chain, p.QName)
+      m.runAt = now
+      return out
+    }
+    targets = compatible(m.open(m.chain[0]), p.Answer)
+    for _, pq := range targets {
+      for i, name := range m.chain {
+        next := p.QName
+        if i+1 < len(m.chain) {
+          next = m.chain[i+1]
+        }
+        pq.resp.Answers = append(pq.resp.Answers, event.DNSAnswer{Name: name, Type: "CNAME", Data: next})
+      }
+    }
+    m.chain = nil
+  default:
+    if len(m.run) > 0 && p.Answer != "<CNAME>" && strings.EqualFold(p.QName, m.runName) {
+      targets = compatible(m.run, p.Answer)
+    }
+    if len(targets) == 0 {
+      out = m.endRun(out)
+      if p.Answer == "<CNAME>" {
+        m.chain, m.runAt = []string{p.QName}, now
+        return out
+      }
+      targets = compatible(m.open(p.QName), p.Answer)
+    }
+  }
+  if len(targets) == 0 {
+    m.drop(dropOrphan)
+    return out
+  }
+  for _, pq := range targets {
+    applyAnswer(pq, p)
+    pq.answered = now
+  }
+  if p.Serial == 0 {
+    m.run, m.runName, m.runAt = targets, p.QName, now
+  }
+  return out
+}
+
+// open returns the unanswered queries for name.
+func (m *responseMatcher) open(name string) []*pendingQuery {
+  var out []*pendingQuery
+  for _, pq := range m.byName[nameKey(name)] {
+    if pq.answered.IsZero() {
+      out = append(out, pq)
+    }
+  }
+  return out
+}
+
+func (m *responseMatcher) lookup(p *ParsedLine) []*pendingQuery {
+  if p.Serial != 0 {
+    if pq := m.bySerial[p.Serial]; pq != nil {
+      return []*pendingQuery{pq}
+    }
+    return nil
+  }
+  return m.byName[nameKey(p.QName)]
+}
+
+// nameKey is the lookup key for a name. dnsmasq logs PTR answers under the
+// address rather than the in-addr.arpa/ip6.arpa name that was queried.
+func nameKey(name string) string {
+  addr, err := netip.ParseAddr(name)
+  if err != nil {
+    return strings.ToLower(name)
+  }
+  b := addr.AsSlice()
+  var sb strings.Builder
+  if addr.Is4() {
+    for i := len(b) - 1; i >= 0; i-- {
+      fmt.Fprintf(&sb, "%d.", b[i])
+    }
+    sb.WriteString("in-addr.arpa")
+    return sb.String()
+  }
+  for i := len(b) - 1; i >= 0; i-- {
+    fmt.Fprintf(&sb, "%x.%x.", b[i]&0x0f, b[i]>>4)
+  }
+  sb.WriteString("ip6.arpa")
+  return sb.String()
+}
+
+func (m *responseMatcher) endRun(out []event.Event) []event.Event {
+  for _, pq := range m.run {
+    out = m.emit(pq, out)
+  }
+  if len(m.chain) > 0 {
+    m.drop(dropOrphan)
+  }
+  m.run, m.runName, m.chain = nil, "", nil
+  return out
+}
+
+func (m *responseMatcher) emit(pq *pendingQuery, out []event.Event) []event.Event {
+  if pq.done {
+    return out
+  }
+  m.remove(pq)
+  resp := pq.resp
+  if resp.RCode == "" {
+    resp.RCode = "NOERROR"
+  }
+  if resp.Answers == nil {
+    resp.Answers = []event.DNSAnswer{}
+  }
+  return append(out, event.Event{Type: "dns_response", TS: pq.ts.UTC(), Data: resp})
+}
+
+func (m *responseMatcher) remove(pq *pendingQuery) {
+  pq.done = true
+  m.order.Remove(pq.elem)
+  peers := m.byName[pq.key]
+  for i, other := range peers {
+    if other == pq {
+      peers = append(peers[:i], peers[i+1:]...)
+      break
+    }
+  }
+  if len(peers) == 0 {
+    delete(m.byName, pq.key)
+  } else {
+    m.byName[pq.key] = peers
+  }
+  if pq.serial != 0 && m.bySerial[pq.serial] == pq {
+    delete(m.bySerial, pq.serial)
+  }
+}
+
+func (m *responseMatcher) drop(reason string) {
+  if m.onDrop != nil {
+    m.onDrop(reason)
+  }
+}
+
+// compatible narrows candidates to the queries an answer can belong to, so
+// concurrent A and AAAA lookups for one name get their own addresses. Rcodes
+// and other record types fit any qtype. If nothing matches, all candidates
+// are kept rather than losing the answer.
+func compatible(cands []*pendingQuery, answer string) []*pendingQuery {
+  want := ""
+  if addr, err := netip.ParseAddr(answer); err == nil {
+    want = "A"
+    if addr.Is6() && !addr.Is4In6() {
+      want = "AAAA"
+    }
+  } else if answer == "NODATA-IPv4" {
+    want = "A"
+  } else if answer == "NODATA-IPv6" {
+    want = "AAAA"
+  }
+  if want == "" || len(cands) == 0 {
+    return cands
+  }
+  var out []*pendingQuery
+  for _, pq := range cands {
+    if pq.resp.QType == want || pq.resp.QType == "ANY" {
+      out = append(out, pq)
+    }
+  }
+  if len(out) == 0 {
+    return cands
+  }
+  return out
+}
+
+// applyAnswer adds one dnsmasq answer value to a pending response. Values are
+// an address, <CNAME> (the target follows on the next line), <TYPE> for other
+// record types, an rcode word, or record data such as a PTR name.
+func applyAnswer(pq *pendingQuery, p *ParsedLine) {
+  r := &pq.resp
+  pq.ts = p.TS
+  if p.Resolver != "" {
+    r.Resolver = p.Resolver
+  }
+  if pq.cnameFrom != "" {
+    r.Answers = append(r.Answers, event.DNSAnswer{Name: pq.cnameFrom, Type: "CNAME", Data: p.QName})
+    pq.cnameFrom = ""
+  }
+  answer := p.Answer
+  if addr, err := netip.ParseAddr(answer); err == nil {
+    typ := "A"
+    if addr.Is6() && !addr.Is4In6() {
+      typ = "AAAA"
+    }
+    r.Answers = append(r.Answers, event.DNSAnswer{Name: p.QName, Type: typ, Data: addr.String()})
+    return
+  }
+  switch upper := strings.ToUpper(answer); {
+  case answer == "<CNAME>":
+    pq.cnameFrom = p.QName
+  case strings.HasPrefix(answer, "<") && strings.HasSuffix(answer, ">"):
+    r.Answers = append(r.Answers, event.DNSAnswer{Name: p.QName, Type: strings.Trim(answer, "<>")})
+  case upper == "NXDOMAIN":
+    r.RCode = "NXDOMAIN"
+  case strings.HasPrefix(upper, "NODATA"):
+    r.RCode = "NOERROR"
+  case upper == "SERVFAIL" || upper == "REFUSED":
+    r.RCode = upper
+  default:
+    name := p.QName
+    if _, err := netip.ParseAddr(name); err == nil {
+      name = r.QName
+    }
+    r.Answers = append(r.Answers, event.DNSAnswer{Name: name, Type: r.QType, Data: answer})
+  }
+}
@@ -0,0 +1,144 @@
+package dns
+
+import (
+  "reflect"
+  "testing"
+  "time"
+
+  "netmon_agent/internal/event"
+)
+
+// replay feeds fixture lines 100ms apart, then flushes past the window.
+func replay(t *testing.T, m *responseMatcher, src DNSSource, lines []string) []event.DNSResponse {
+  t.Helper()
+  now := time.Date(2026, 3, 8, 14, 20, 0, 0, time.UTC)
+  var evs []event.Event
+  for _, line := range lines {
+    p, err := src.Parse(line, fixtureNow)
+    if err != nil {
+      continue
+    }
+    evs = append(evs, m.observe(p, now)...)
+    now = now.Add(100 * time.Millisecond)
+  }
+  evs = append(evs, m.flush(now.Add(time.Minute))...)
+  var out []event.DNSResponse
+  for _, ev := range evs {
+    if ev.Type != "dns_response" {
+      t.Fatalf("unexpected event type %q", ev.Type)
+    }
+    out = append(out, ev.Data.(event.DNSResponse))
+  }
+  return out
+}
+
+func TestResponseMatcherFixture(t *testing.T) {
+  var drops []string
+  m := newResponseMatcher(10*time.Second, 100)
+  m.onDrop = func(reason string) { drops = append(drops, reason) }
+  got := replay(t, m, dnsmasqSource{}, readFixture(t, "testdata/dnsmasq.log"))
+
+  cname := func(from, to string) event.DNSAnswer {
+    return event.DNSAnswer{Name: from, Type: "CNAME", Data: to}
+  }
+  const dradis = "www.us-west-2.internal.dradis.netflix.com"
+  want := []event.DNSResponse{
+    {ClientIP: "10.0.0.20", QName: "github.com", QType: "A", RCode: "NOERROR", Resolver: "8.8.8.8",
+      Answers: []event.DNSAnswer{{Name: "github.com", Type: "A", Data: "140.82.113.3"}}},
+    {ClientIP: "10.0.0.31", QName: "www.netflix.com", QType: "A", RCode: "NOERROR", Resolver: "1.1.1.1",
+      Answers: []event.DNSAnswer{
+        cname("www.netflix.com", "www.dradis.netflix.com"),
+        cname("www.dradis.netflix.com", dradis),
+        {Name: dradis, Type: "A", Data: "54.186.4.192"},
+        {Name: dradis, Type: "A", Data: "44.242.13.161"},
+        {Name: dradis, Type: "A", Data: "52.38.7.83"},
+      }},
+    {ClientIP: "10.0.0.31", QName: "www.netflix.com", QType: "AAAA", RCode: "NOERROR", Resolver: "1.1.1.1",
+      Answers: []event.DNSAnswer{
+        cname("www.netflix.com", "www.dradis.netflix.com"),
+        cname("www.dradis.netflix.com", dradis),
+        {Name: dradis, Type: "AAAA", Data: "2600:1f14:62a:de82:822d:a423:9e4c:da8d"},
+      }},
+    {ClientIP: "10.0.0.31", QName: "github.com", QType: "A", RCode: "NOERROR", Resolver: "cache",
+      Answers: []event.DNSAnswer{{Name: "github.com", Type: "A", Data: "140.82.113.3"}}},
+    {ClientIP: "10.0.0.20", QName: "router.lan", QType: "A", RCode: "NOERROR", Resolver: "config",
+      Answers: []event.DNSAnswer{{Name: "router.lan", Type: "A", Data: "10.0.0.1"}}},
+    {ClientIP: "10.0.0.20", QName: "nas.lan", QType: "A", RCode: "NOERROR", Resolver: "/etc/hosts",
+      Answers: []event.DNSAnswer{{Name: "nas.lan", Type: "A", Data: "10.0.0.5"}}},
+    {ClientIP: "10.0.0.20", QName: "does-not-exist.example", QType: "A", RCode: "NXDOMAIN", Resolver: "8.8.8.8",
+      Answers: []event.DNSAnswer{}},
+    {ClientIP: "10.0.0.20", QName: "ipv4only.example", QType: "AAAA", RCode: "NOERROR", Resolver: "8.8.8.8",
+      Answers: []event.DNSAnswer{}},
+    {ClientIP: "10.0.0.20", QName: "_dmarc.example.com", QType: "TXT", RCode: "NOERROR", Resolver: "8.8.8.8",
+      Answers: []event.DNSAnswer{{Name: "_dmarc.example.com", Type: "TXT"}}},
+    {ClientIP: "10.0.0.31", QName: "20.0.0.10.in-addr.arpa", QType: "PTR", RCode: "NOERROR", Resolver: "/etc/hosts",
+      Answers: []event.DNSAnswer{{Name: "20.0.0.10.in-addr.arpa", Type: "PTR", Data: "laptop.lan"}}},
+  }
+  if len(got) != len(want) {
+    t.Fatalf("got %d responses, want %d:\n%+v", len(got), len(want), got)
+  }
+  for i := range want {
+    if !reflect.DeepEqual(got[i], want[i]) {
+      t.Errorf("response %d\ngot  %+v\nwant %+v", i, got[i], want[i])
+    }
+  }
+  if !reflect.DeepEqual(drops, []string{dropTimeout}) {
+    t.Errorf("drops = %v, want [timeout] for slow.example", drops)
+  }
+  if m.len() != 0 {
+    t.Errorf("%d queries still pending", m.len())
+  }
+}
+
+func TestResponseMatcherSerials(t *testing.T) {
+  m := newResponseMatcher(10*time.Second, 100)
+  got := replay(t, m, dnsmasqSource{}, readFixture(t, "testdata/dnsmasq_extra.log"))
+  answer := []event.DNSAnswer{{Name: "github.com", Type: "A", Data: "140.82.113.3"}}
+  want := []event.DNSResponse{
+    {ClientIP: "10.0.0.20", QName: "github.com", QType: "A", RCode: "NOERROR", Resolver: "8.8.8.8", Answers: answer},
+    {ClientIP: "10.0.0.31", QName: "github.com", QType: "A", RCode: "NOERROR", Answers: answer},
+    {ClientIP: "10.0.0.20", QName: "github.com", QType: "AAAA", RCode: "NOERROR", Resolver: "8.8.8.8", Answers: []event.DNSAnswer{}},
+  }
+  if !reflect.DeepEqual(got, want) {
+    t.Fatalf("got  %+v\nwant %+v", got, want)
+  }
+}
+
+func TestResponseMatcherBounded(t *testing.T) {
+  var drops []string
+  m := newResponseMatcher(10*time.Second, 2)
+  m.onDrop = func(reason string) { drops = append(drops, reason) }
+  got := replay(t, m, dnsmasqSource{}, []string{
+    "Mar  8 14:20:00 dnsmasq[812]: query[A] a.example from 10.0.0.20",
+    "Mar  8 14:20:00 dnsmasq[812]: query[A] b.example from 10.0.0.20",
+    "Mar  8 14:20:00 dnsmasq[812]: query[A] c.example from 10.0.0.20",
+    "Mar  8 14:20:00 dnsmasq[812]: reply a.example is 192.0.2.1",
+    "Mar  8 14:20:00 dnsmasq[812]: reply c.example is 192.0.2.3",
+  })
+  if len(got) != 1 || got[0].QName != "c.example" {
+    t.Fatalf("got %+v, want only c.example", got)
+  }
+  if !reflect.DeepEqual(drops, []string{dropEvicted, dropOrphan, dropTimeout}) {
+    t.Fatalf("drops = %v", drops)
+  }
+}
+
+func TestResponseMatcherOneLineResponses(t *testing.T) {
+  var drops []string
+  m := newResponseMatcher(10*time.Second, 100)
+  m.onDrop = func(reason string) { drops = append(drops, reason) }
+  got := replay(t, m, unboundSource{}, readFixture(t, "testdata/unbound.log"))
+  if len(got) != 5 {
+    t.Fatalf("got %d responses, want 5: %+v", len(got), got)
+  }
+  want := event.DNSResponse{ClientIP: "10.0.0.20", QName: "does-not-exist.example", QType: "A", RCode: "NXDOMAIN", Answers: []event.DNSAnswer{}}
+  if !reflect.DeepEqual(got[2], want) {
+    t.Fatalf("got  %+v\nwant %+v", got[2], want)
+  }
+  if got[1].Resolver != "cache" || got[4].RCode != "SERVFAIL" {
+    t.Fatalf("got %+v", got)
+  }
+  if len(drops) != 0 || m.len() != 0 {
+    t.Fatalf("drops = %v, pending = %d", drops, m.len())
+  }
+}
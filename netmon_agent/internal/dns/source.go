@@ -0,0 +1,39 @@
+package dns
+
+import (
+  "fmt"
+  "time"
+
+  "netmon_agent/internal/config"
+)
+
+// DNSSource parses one resolver's query log into ParsedLines for the
+// Correlator. Sources that log no answers (BIND) only feed dns_bucket and
+// host_identity; unbound reply lines become dns_response without answers.
+type DNSSource interface {
+  Name() string
+  Parse(line string, now time.Time) (*ParsedLine, error)
+}
+
+// NewSource returns the parser for a dns_source name.
+func NewSource(name string) (DNSSource, error) {
+  switch name {
+  case "", config.DNSSourceDnsmasq:
+    return dnsmasqSource{}, nil
+  case config.DNSSourceUnbound:
+    return unboundSource{}, nil
+  case config.DNSSourceBIND:
+    return bindSource{}, nil
+  case config.DNSSourcePihole:
+    return piholeSource{}, nil
+  }
+  return nil, fmt.Errorf("unknown dns_source %q", name)
+}
+
+type dnsmasqSource struct{}
+
+func (dnsmasqSource) Name() string { return config.DNSSourceDnsmasq }
+
+func (dnsmasqSource) Parse(line string, now time.Time) (*ParsedLine, error) {
+  return Parse(line, now)
+}
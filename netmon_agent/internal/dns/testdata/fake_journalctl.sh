@@ -0,0 +1,6 @@
+#!/bin/sh
+# Stands in for journalctl in journal_test.go: records its arguments, prints
+# an export-format fixture and then waits like `journalctl -f`.
+echo "$@" >> "$FAKE_JOURNALCTL_ARGS"
+cat "$FAKE_JOURNALCTL_EXPORT"
+exec sleep 60
@@ -0,0 +1,68 @@
+package dns
+
+import (
+  "errors"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+
+  "netmon_agent/internal/config"
+)
+
+// Example unbound lines with log-queries/log-replies (log-time-ascii off, then
+// on, then through syslog):
+// [1772979599] unbound[812:0] query: 10.0.0.20 github.com. A IN
+// Mar 08 14:19:59 unbound[812:0] reply: 10.0.0.20 github.com. A IN NOERROR 0.012873 0 56
+// Mar  8 14:19:59 gw unbound: [812:0] info: 10.0.0.20 github.com. A IN
+//
+// Reply fields after the class are rcode, resolution time, cached flag and
+// response size. unbound does not log the answer records.
+
+var unboundRe = regexp.MustCompile(`^(?:\[(?P<epoch>\d+)\]|(?P<ts>` + syslogTS + `)(?:\s+\S+)?)\s+unbound(?:\[\d+\])?(?::\s+)?\[\d+:\d+\]\s+(?P<kind>query|info|reply):\s+(?P<client>\S+)\s+(?P<qname>\S+)\s+(?P<qtype>\S+)\s+(?P<class>IN|CH|HS|ANY|CLASS\d+)(?:\s+(?P<rcode>\S+)\s+\S+\s+(?P<cached>[01])\s+\d+)?\s*$`)
+
+type unboundSource struct{}
+
+func (unboundSource) Name() string { return config.DNSSourceUnbound }
+
+func (unboundSource) Parse(line string, now time.Time) (*ParsedLine, error) {
+  line = strings.TrimSpace(line)
+  if line == "" {
+    return nil, errors.New("empty")
+  }
+  m := unboundRe.FindStringSubmatch(line)
+  if m == nil {
+    return nil, errors.New("unmatched")
+  }
+  var ts time.Time
+  if m[1] != "" {
+    sec, err := strconv.ParseInt(m[1], 10, 64)
+    if err != nil {
+      return nil, err
+    }
+    ts = time.Unix(sec, 0).In(now.Location())
+  } else {
+    var err error
+    if ts, err = parseTS(m[2], now); err != nil {
+      return nil, err
+    }
+  }
+  client := m[4]
+  if i := strings.IndexByte(client, '@'); i >= 0 {
+    client = client[:i]
+  }
+  p := &ParsedLine{TS: ts, ClientIP: client, QName: strings.TrimSuffix(m[5], "."), QType: m[6]}
+  if m[3] != "reply" {
+    p.Action = "query"
+    return p, nil
+  }
+  if m[8] == "" {
+    return nil, errors.New("reply without rcode")
+  }
+  p.Action, p.RCode = "response", m[8]
+  p.NXDomain = p.RCode == "NXDOMAIN"
+  if m[9] == "1" {
+    p.Resolver = "cache"
+  }
+  return p, nil
+}
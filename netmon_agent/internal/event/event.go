@@ -8,7 +8,10 @@ type Batch struct {
   Events   []Event   `json:"events"`
 }
 
+// Event is one record in a batch. ID is "<router_id>:<sequence>", unique per
+// router across restarts, so the server can drop events it already stored.
 type Event struct {
+  ID   string      `json:"id,omitempty"`
   Type string      `json:"type"`
   TS   time.Time   `json:"ts"`
   Data interface{} `json:"data"`
@@ -20,12 +23,37 @@ type FirewallDrop struct {
   NflogGroup int     `json:"nflog_group"`
   IfIn       string  `json:"if_in"`
   IfOut      *string `json:"if_out"`
+  IPVersion  int     `json:"ip_version"`
   SrcIP      string  `json:"src_ip"`
   DstIP      string  `json:"dst_ip"`
   SrcPort    int     `json:"src_port"`
   DstPort    int     `json:"dst_port"`
   L4Proto    int     `json:"l4proto"`
   TCPSyn     bool    `json:"tcp_syn"`
+  ICMP       *ICMP   `json:"icmp,omitempty"`
+  SrcMAC     string  `json:"src_mac,omitempty"`
+  UID        *int    `json:"uid,omitempty"`
+  GID        *int    `json:"gid,omitempty"`
+  Mark       uint32  `json:"mark,omitempty"`
+  PhysIn     string  `json:"physdev_in,omitempty"`
+  PhysOut    string  `json:"physdev_out,omitempty"`
+}
+
+// ICMP describes an ICMP/ICMPv6 packet or flow. Inner is the quoted packet of
+// an error message (unreachable, time exceeded, ...).
+type ICMP struct {
+  Type   int        `json:"type"`
+  Code   int        `json:"code"`
+  EchoID *int       `json:"echo_id,omitempty"`
+  Inner  *ICMPInner `json:"inner,omitempty"`
+}
+
+type ICMPInner struct {
+  SrcIP   string `json:"src_ip"`
+  DstIP   string `json:"dst_ip"`
+  SrcPort int    `json:"src_port,omitempty"`
+  DstPort int    `json:"dst_port,omitempty"`
+  L4Proto int    `json:"l4proto"`
 }
 
 type Flow struct {
@@ -38,13 +66,68 @@ type Flow struct {
   DstPort     int       `json:"dst_port"`
   L4Proto     int       `json:"l4proto"`
   Dir         string    `json:"dir"`
+  ReplySrcIP   string   `json:"reply_src_ip,omitempty"`
+  ReplyDstIP   string   `json:"reply_dst_ip,omitempty"`
+  ReplySrcPort int      `json:"reply_src_port,omitempty"`
+  ReplyDstPort int      `json:"reply_dst_port,omitempty"`
+  SNAT         bool     `json:"snat"`
+  DNAT         bool     `json:"dnat"`
+  NATSrcIP     string   `json:"nat_src_ip,omitempty"`
+  NATSrcPort   int      `json:"nat_src_port,omitempty"`
+  NATDstIP     string   `json:"nat_dst_ip,omitempty"`
+  NATDstPort   int      `json:"nat_dst_port,omitempty"`
+  ICMP         *ICMP    `json:"icmp,omitempty"`
   BytesOrig   uint64    `json:"bytes_orig"`
   BytesReply  uint64    `json:"bytes_reply"`
   PacketsOrig uint64    `json:"packets_orig"`
   PacketsReply uint64   `json:"packets_reply"`
   FirstSeen   time.Time `json:"first_seen"`
   LastSeen    time.Time `json:"last_seen"`
+  DurationMS  int64     `json:"duration_ms"`
   DNSContext  *DNSContext `json:"dns_context,omitempty"`
+  DstDomain   string      `json:"dst_domain,omitempty"`
+  DstDomainResolvedAt *time.Time `json:"dst_domain_resolved_at,omitempty"`
+  DstDomainMode       string     `json:"dst_domain_mode,omitempty"`
+}
+
+// FlowUpdate is an interim accounting record for a still-open flow. The
+// embedded Flow carries running totals; the delta fields cover IntervalMS.
+type FlowUpdate struct {
+  Flow
+  BytesOrigDelta    uint64 `json:"bytes_orig_delta"`
+  BytesReplyDelta   uint64 `json:"bytes_reply_delta"`
+  PacketsOrigDelta  uint64 `json:"packets_orig_delta"`
+  PacketsReplyDelta uint64 `json:"packets_reply_delta"`
+  IntervalMS        int64  `json:"interval_ms"`
+}
+
+// FlowTable is one chunk of a periodic conntrack dump. A dump is split into
+// Chunks events sharing SnapshotAt.
+type FlowTable struct {
+  SnapshotAt time.Time        `json:"snapshot_at"`
+  Chunk      int              `json:"chunk"`
+  Chunks     int              `json:"chunks"`
+  Total      int              `json:"total"`
+  Truncated  bool             `json:"truncated"`
+  Flows      []FlowTableEntry `json:"flows"`
+}
+
+type FlowTableEntry struct {
+  ID           uint32    `json:"id"`
+  State        string    `json:"state,omitempty"`
+  SrcIP        string    `json:"src_ip"`
+  DstIP        string    `json:"dst_ip"`
+  SrcPort      int       `json:"src_port"`
+  DstPort      int       `json:"dst_port"`
+  L4Proto      int       `json:"l4proto"`
+  Dir          string    `json:"dir"`
+  NATSrcIP     string    `json:"nat_src_ip,omitempty"`
+  NATSrcPort   int       `json:"nat_src_port,omitempty"`
+  BytesOrig    uint64    `json:"bytes_orig"`
+  BytesReply   uint64    `json:"bytes_reply"`
+  PacketsOrig  uint64    `json:"packets_orig"`
+  PacketsReply uint64    `json:"packets_reply"`
+  FirstSeen    time.Time `json:"first_seen"`
 }
 
 type DNSBucket struct {
@@ -52,17 +135,59 @@ type DNSBucket struct {
   ClientIP    string    `json:"client_ip"`
   QType       string    `json:"qtype"`
   QNameHash   string    `json:"qname_hash"`
+  QNameMode   string    `json:"qname_mode,omitempty"`
   Count       int       `json:"count"`
   NXDomain    int       `json:"nxdomain"`
 }
 
+// DNSAnomaly flags a client whose recent queries look like DGA lookups or DNS
+// tunneling. Score is in [0, 1]; Features lists the heuristics that
+// contributed, highest score first.
+type DNSAnomaly struct {
+  ClientIP     string              `json:"client_ip"`
+  Kind         string              `json:"kind"`
+  Score        float64             `json:"score"`
+  WindowStart  time.Time           `json:"window_start"`
+  Queries      int                 `json:"queries"`
+  NXDomain     int                 `json:"nxdomain"`
+  Features     []DNSAnomalyFeature `json:"features"`
+  SampleQNames []string            `json:"sample_qnames,omitempty"`
+  QNameMode    string              `json:"qname_mode,omitempty"`
+}
+
+// DNSAnomalyFeature is one heuristic's raw value and its [0, 1] score.
+type DNSAnomalyFeature struct {
+  Name  string  `json:"name"`
+  Value float64 `json:"value"`
+  Score float64 `json:"score"`
+}
+
 type HostIdentity struct {
   IP                string    `json:"ip"`
   LastSeen          time.Time `json:"last_seen"`
   RecentQNameHashes []string  `json:"recent_qname_hashes"`
+  QNameMode         string    `json:"qname_mode,omitempty"`
 }
 
 type DNSContext struct {
   RecentQNameHashes []string `json:"recent_qname_hashes"`
   LastSeen          string   `json:"last_seen"`
+  QNameMode         string   `json:"qname_mode,omitempty"`
+}
+
+type DNSResponse struct {
+  ClientIP  string      `json:"client_ip"`
+  QName     string      `json:"qname"`
+  QNameMode string      `json:"qname_mode,omitempty"`
+  QType     string      `json:"qtype"`
+  RCode     string      `json:"rcode"`
+  Answers   []DNSAnswer `json:"answers"`
+  Resolver  string      `json:"resolver,omitempty"`
+}
+
+type DNSAnswer struct {
+  Name string `json:"name"`
+  Type string `json:"type"`
+  Data string `json:"data,omitempty"`
+  TTL  *int   `json:"ttl,omitempty"`
 }
@@ -0,0 +1,77 @@
+package eventid
+
+import (
+  "crypto/rand"
+  "encoding/hex"
+  "log"
+  "strconv"
+  "sync"
+  "time"
+
+  "netmon_agent/internal/metrics"
+  "netmon_agent/internal/util"
+)
+
+// reserveBlock is how many sequence numbers are reserved per state file write.
+const reserveBlock = 10000
+
+// Sequence hands out event IDs of the form <router_id>:<n>, with n increasing
+// across restarts. Rather than saving every n, it saves the end of a reserved
+// block before using it and resumes there after a restart, so a crash skips
+// numbers but never reuses one. While the block cannot be saved it hands out
+// random IDs of the form <router_id>:r<hex> instead, which never clash with a
+// sequence number.
+type Sequence struct {
+  routerID string
+  path     string
+  metrics  *metrics.Metrics
+
+  mu       sync.Mutex
+  next     uint64
+  reserved uint64
+  lastLog  time.Time
+}
+
+// New resumes the sequence saved at path.
+func New(routerID, path string, m *metrics.Metrics) *Sequence {
+  n, err := strconv.ParseUint(util.ReadStateFile(path), 10, 64)
+  if err != nil {
+    // First start or a lost state dir: start from the clock so IDs handed out
+    // before are not reused.
+    n = uint64(time.Now().UnixMicro())
+    log.Printf("eventid: no saved sequence in %s, starting at %d", path, n)
+  }
+  return &Sequence{routerID: routerID, path: path, metrics: m, next: n, reserved: n}
+}
+
+// Next returns a new event ID.
+func (s *Sequence) Next() string {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.next >= s.reserved {
+    reserved := s.next + reserveBlock
+    if err := util.WriteStateFile(s.path, strconv.FormatUint(reserved, 10)); err != nil {
+      // A number from an unsaved block would be handed out again after a
+      // restart, and the server would drop that event as a replay.
+      return s.fallback(err)
+    }
+    s.reserved = reserved
+  }
+  n := s.next
+  s.next++
+  return s.routerID + ":" + strconv.FormatUint(n, 10)
+}
+
+// fallback returns a random ID and logs err at most once a minute.
+func (s *Sequence) fallback(err error) string {
+  if s.metrics != nil {
+    s.metrics.EventIDFallbacks.Inc()
+  }
+  if time.Since(s.lastLog) >= time.Minute {
+    s.lastLog = time.Now()
+    log.Printf("eventid: save sequence: %v; using random ids", err)
+  }
+  var b [16]byte
+  _, _ = rand.Read(b[:])
+  return s.routerID + ":r" + hex.EncodeToString(b[:])
+}
@@ -0,0 +1,88 @@
+package eventid
+
+import (
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/prometheus/client_golang/prometheus/testutil"
+
+  "netmon_agent/internal/metrics"
+)
+
+func seqOf(t *testing.T, id string) uint64 {
+  t.Helper()
+  router, n, ok := strings.Cut(id, ":")
+  if !ok || router != "router-01" {
+    t.Fatalf("bad id %q", id)
+  }
+  v, err := strconv.ParseUint(n, 10, 64)
+  if err != nil {
+    t.Fatalf("bad id %q", id)
+  }
+  return v
+}
+
+func TestSequenceSurvivesRestart(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "state", "event_id.seq")
+  start := uint64(time.Now().UnixMicro())
+  s := New("router-01", path, nil)
+  first := seqOf(t, s.Next())
+  if first < start {
+    t.Fatalf("fresh sequence starts at %d, before the clock (%d)", first, start)
+  }
+  last := first
+  for i := 0; i < reserveBlock+5; i++ {
+    n := seqOf(t, s.Next())
+    if n != last+1 {
+      t.Fatalf("after %d got %d", last, n)
+    }
+    last = n
+  }
+
+  // A restart, crash or not, continues after everything handed out.
+  for i := 0; i < 2; i++ {
+    s = New("router-01", path, nil)
+    n := seqOf(t, s.Next())
+    if n <= last {
+      t.Fatalf("restart %d: %d after %d", i, n, last)
+    }
+    last = n
+  }
+}
+
+func TestSequenceUnsavedBlock(t *testing.T) {
+  m := metrics.New()
+  // A file where the state dir should be makes every save fail.
+  blocker := filepath.Join(t.TempDir(), "state")
+  if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+    t.Fatal(err)
+  }
+  path := filepath.Join(blocker, "event_id.seq")
+  s := New("router-01", path, m)
+
+  seen := make(map[string]bool)
+  for i := 0; i < 3; i++ {
+    id := s.Next()
+    if !strings.HasPrefix(id, "router-01:r") || seen[id] {
+      t.Fatalf("unsaved block: id %q, want a new random id", id)
+    }
+    seen[id] = true
+  }
+  if got := testutil.ToFloat64(m.EventIDFallbacks); got != 3 {
+    t.Fatalf("fallbacks = %v, want 3", got)
+  }
+
+  // Once the block is saved, the sequence carries on from it.
+  if err := os.Remove(blocker); err != nil {
+    t.Fatal(err)
+  }
+  first := seqOf(t, s.Next())
+  s = New("router-01", path, nil)
+  if n := seqOf(t, s.Next()); n <= first {
+    t.Fatalf("restart: %d after %d", n, first)
+  }
+}
@@ -0,0 +1,173 @@
+package httpclient
+
+import (
+  "errors"
+  "log"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "netmon_agent/internal/metrics"
+)
+
+// Breaker states, as exported by the http_breaker_state gauge.
+const (
+  breakerClosed   = 0
+  breakerOpen     = 1
+  breakerHalfOpen = 2
+)
+
+const (
+  // breakerMaxCooldown caps the open period, which doubles after each failed
+  // probe.
+  breakerMaxCooldown = 5 * time.Minute
+  // maxRetryAfter caps how long a Retry-After header can hold uploads.
+  maxRetryAfter = 10 * time.Minute
+)
+
+// errBreakerOpen is returned instead of sending while the breaker is open.
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// breaker is the delivery state shared by the flush workers and the spool
+// replay. It opens for the cooldown after threshold consecutive failures, or
+// at once for exactly the Retry-After the server sends, and then lets no
+// request through until the open period ends. The first request after that
+// is a probe: success closes the breaker; failure opens it again, for twice
+// as long once the threshold has been reached.
+type breaker struct {
+  threshold int
+  cooldown  time.Duration
+  metrics   *metrics.Metrics
+  now       func() time.Time
+
+  mu        sync.Mutex
+  state     int
+  failures  int
+  openFor   time.Duration
+  openUntil time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration, m *metrics.Metrics) *breaker {
+  if threshold <= 0 {
+    threshold = 1
+  }
+  if cooldown <= 0 {
+    cooldown = time.Second
+  }
+  return &breaker{threshold: threshold, cooldown: cooldown, metrics: m, now: time.Now}
+}
+
+// allow reports whether a request may be sent. Once the open period is over
+// it lets exactly one probe through until that probe is recorded.
+func (b *breaker) allow() bool {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  switch b.state {
+  case breakerClosed:
+    return true
+  case breakerOpen:
+    if b.now().Before(b.openUntil) {
+      return false
+    }
+    b.setState(breakerHalfOpen)
+    return true
+  }
+  // Half-open: a probe is in flight.
+  return false
+}
+
+// success records a request the server answered.
+func (b *breaker) success() {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  b.failures = 0
+  b.openFor = 0
+  if b.state != breakerClosed {
+    log.Printf("httpclient: server reachable again, closing circuit breaker")
+    b.setState(breakerClosed)
+  }
+}
+
+// failure records a failed request. retryAfter is the server's Retry-After,
+// or 0.
+func (b *breaker) failure(retryAfter time.Duration) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  b.failures++
+  now := b.now()
+  if b.state == breakerOpen {
+    // A request that was in flight when the breaker opened.
+    if retryAfter > 0 && now.Add(retryAfter).After(b.openUntil) {
+      b.openUntil = now.Add(retryAfter)
+    }
+    return
+  }
+  if b.state == breakerClosed && b.failures < b.threshold && retryAfter <= 0 {
+    return
+  }
+  if b.failures < b.threshold && retryAfter > 0 {
+    // The server said when to come back; that is not a reason to back off
+    // any further.
+    if b.state == breakerClosed {
+      log.Printf("httpclient: server asked to retry after %s, opening circuit breaker", retryAfter)
+    }
+    b.openUntil = now.Add(retryAfter)
+    b.setState(breakerOpen)
+    return
+  }
+  if b.openFor == 0 {
+    b.openFor = b.cooldown
+  } else {
+    // openFor is reset on success, so this is a failed probe.
+    b.openFor *= 2
+    if b.openFor > breakerMaxCooldown {
+      b.openFor = breakerMaxCooldown
+    }
+  }
+  wait := b.openFor
+  if retryAfter > wait {
+    wait = retryAfter
+  }
+  if b.state == breakerClosed {
+    log.Printf("httpclient: %d consecutive send failures, opening circuit breaker for %s", b.failures, wait)
+  }
+  b.openUntil = now.Add(wait)
+  b.setState(breakerOpen)
+}
+
+func (b *breaker) setState(state int) {
+  b.state = state
+  if b.metrics != nil {
+    b.metrics.HTTPBreakerState.Set(float64(state))
+  }
+}
+
+// isAvailabilityFailure reports whether a status means the server cannot
+// take uploads right now, as opposed to refusing this batch.
+func isAvailabilityFailure(status int) bool {
+  return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+// parseRetryAfter returns the wait a Retry-After header asks for, given as
+// seconds or an HTTP date, capped at maxRetryAfter.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+  header = strings.TrimSpace(header)
+  if header == "" {
+    return 0
+  }
+  var d time.Duration
+  if secs, err := strconv.Atoi(header); err == nil {
+    d = time.Duration(secs) * time.Second
+  } else if t, err := http.ParseTime(header); err == nil {
+    d = t.Sub(now)
+  }
+  if d < 0 {
+    return 0
+  }
+  if d > maxRetryAfter {
+    return maxRetryAfter
+  }
+  return d
+}
@@ -0,0 +1,174 @@
+package httpclient
+
+import (
+  "context"
+  "errors"
+  "net/http"
+  "testing"
+  "time"
+
+  "github.com/prometheus/client_golang/prometheus/testutil"
+
+  "netmon_agent/internal/util"
+)
+
+// fakeClock drives a breaker's clock from a test.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time         { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func withFakeClock(c *Client) *fakeClock {
+  clock := &fakeClock{t: time.Date(2026, 3, 8, 14, 0, 0, 0, time.UTC)}
+  c.breaker.now = clock.now
+  return clock
+}
+
+func breakerState() float64 {
+  return testutil.ToFloat64(testMetrics.HTTPBreakerState)
+}
+
+func TestRetryAfterOpensBreaker(t *testing.T) {
+  srv := newFakeServer(t)
+  srv.status, srv.retryAfter = http.StatusServiceUnavailable, "120"
+  c := newTestClient(t, srv.URL, util.EncodingIdentity)
+  clock := withFakeClock(c)
+  ctx := context.Background()
+
+  // One 503 with Retry-After is enough; the live batch goes to the spool.
+  c.sendOrSpool(ctx, "router-01", testBatch())
+  if srv.requests != 1 || breakerState() != breakerOpen || c.spool.Count() != 1 {
+    t.Fatalf("requests %d, state %v, spooled %d", srv.requests, breakerState(), c.spool.Count())
+  }
+
+  // While open, neither the flush workers nor the replay touch the network.
+  c.sendOrSpool(ctx, "router-01", testBatch())
+  c.replaySpool(ctx, "")
+  clock.advance(119 * time.Second)
+  c.replaySpool(ctx, "")
+  if srv.requests != 1 || c.spool.Count() != 2 {
+    t.Fatalf("requests %d, spooled %d", srv.requests, c.spool.Count())
+  }
+
+  // After Retry-After the replay probes and, on success, drains the spool.
+  srv.mu.Lock()
+  srv.status = 0
+  srv.mu.Unlock()
+  clock.advance(2 * time.Second)
+  c.replaySpool(ctx, "")
+  if srv.requests != 3 || breakerState() != breakerClosed || c.spool.Count() != 0 {
+    t.Fatalf("requests %d, state %v, spooled %d", srv.requests, breakerState(), c.spool.Count())
+  }
+}
+
+func TestBreakerOpensAfterFailures(t *testing.T) {
+  srv := newFakeServer(t)
+  srv.status = http.StatusInternalServerError
+  c := newTestClient(t, srv.URL, util.EncodingIdentity)
+  clock := withFakeClock(c)
+  ctx := context.Background()
+
+  for i := 0; i < 3; i++ {
+    if err := c.flushOnce(ctx, "router-01", testBatch()); errors.Is(err, errBreakerOpen) {
+      t.Fatalf("breaker open after %d failures", i)
+    }
+  }
+  if err := c.flushOnce(ctx, "router-01", testBatch()); !errors.Is(err, errBreakerOpen) {
+    t.Fatalf("after 3 failures: %v", err)
+  }
+
+  // A failed probe opens the breaker for twice the cooldown.
+  clock.advance(30 * time.Second)
+  if err := c.flushOnce(ctx, "router-01", testBatch()); err == nil || errors.Is(err, errBreakerOpen) {
+    t.Fatalf("probe: %v", err)
+  }
+  clock.advance(59 * time.Second)
+  if err := c.flushOnce(ctx, "router-01", testBatch()); !errors.Is(err, errBreakerOpen) {
+    t.Fatalf("before doubled cooldown: %v", err)
+  }
+  if srv.requests != 4 {
+    t.Fatalf("requests %d, want 4", srv.requests)
+  }
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+  b := newBreaker(1, time.Minute, nil)
+  clock := &fakeClock{t: time.Date(2026, 3, 8, 14, 0, 0, 0, time.UTC)}
+  b.now = clock.now
+
+  b.failure(0)
+  if b.allow() {
+    t.Fatal("open breaker allowed a request")
+  }
+  clock.advance(time.Minute)
+  if !b.allow() || b.allow() {
+    t.Fatal("want exactly one probe")
+  }
+  b.success()
+  if !b.allow() || !b.allow() {
+    t.Fatal("closed breaker refused a request")
+  }
+}
+
+func TestBreakerRetryAfter(t *testing.T) {
+  b := newBreaker(3, 30*time.Second, nil)
+  clock := &fakeClock{t: time.Date(2026, 3, 8, 14, 0, 0, 0, time.UTC)}
+  b.now = clock.now
+
+  // Below the threshold a short Retry-After is honored as given.
+  b.failure(5 * time.Second)
+  clock.advance(4 * time.Second)
+  if b.allow() {
+    t.Fatal("allowed before Retry-After")
+  }
+  clock.advance(time.Second)
+  if !b.allow() {
+    t.Fatal("held past Retry-After by the cooldown")
+  }
+
+  // The probe fails with Retry-After again: still as given.
+  b.failure(2 * time.Second)
+  clock.advance(2 * time.Second)
+  if !b.allow() {
+    t.Fatal("second Retry-After not honored as given")
+  }
+
+  // The third consecutive failure reaches the threshold: the cooldown
+  // applies, or Retry-After if longer.
+  b.failure(2 * time.Second)
+  clock.advance(29 * time.Second)
+  if b.allow() {
+    t.Fatal("threshold open shorter than the cooldown")
+  }
+  clock.advance(time.Second)
+  if !b.allow() {
+    t.Fatal("no probe after the cooldown")
+  }
+  b.failure(90 * time.Second)
+  clock.advance(89 * time.Second)
+  if b.allow() {
+    t.Fatal("doubled cooldown cut short of a longer Retry-After")
+  }
+  clock.advance(time.Second)
+  if !b.allow() {
+    t.Fatal("no probe after Retry-After")
+  }
+}
+
+func TestParseRetryAfter(t *testing.T) {
+  now := time.Date(2026, 3, 8, 14, 0, 0, 0, time.UTC)
+  for header, want := range map[string]time.Duration{
+    "":                              0,
+    "30":                            30 * time.Second,
+    " 5 ":                           5 * time.Second,
+    "-1":                            0,
+    "86400":                         maxRetryAfter,
+    "Sun, 08 Mar 2026 14:01:30 GMT": 90 * time.Second,
+    "Sun, 08 Mar 2026 13:00:00 GMT": 0,
+    "soon":                          0,
+  } {
+    if got := parseRetryAfter(header, now); got != want {
+      t.Errorf("parseRetryAfter(%q) = %v, want %v", header, got, want)
+    }
+  }
+}
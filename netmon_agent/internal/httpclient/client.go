@@ -10,11 +10,15 @@ import (
   "log"
   "math/rand"
   "net/http"
+  "sort"
+  "strings"
+  "sync"
   "time"
 
   "netmon_agent/internal/event"
   "netmon_agent/internal/metrics"
   "netmon_agent/internal/spool"
+  "netmon_agent/internal/util"
 )
 
 func init() {
@@ -32,16 +36,29 @@ type Client struct {
   spoolReplayInterval time.Duration
   metrics   *metrics.Metrics
   spool     *spool.Spool
+  deadLetter *spool.Spool
   httpClient *http.Client
+  breaker   *breaker
+
+  // encoding is the Content-Encoding for uploads. It only moves towards
+  // identity, when the server answers 415.
+  encMu    sync.Mutex
+  encoding string
 
   inCh chan event.Event
   priorityCh chan event.Event
+  // wg tracks the flush and priority loops, which spool what is queued when
+  // ctx ends.
+  wg sync.WaitGroup
 }
 
-func New(baseURL, token string, batchMax int, batchWait time.Duration, metrics *metrics.Metrics, spool *spool.Spool, queueDepth int, httpTimeout time.Duration, retryMax int, retryBase time.Duration, flushWorkers int, spoolReplayInterval time.Duration) *Client {
+func New(baseURL, token string, batchMax int, batchWait time.Duration, metrics *metrics.Metrics, spool *spool.Spool, deadLetter *spool.Spool, queueDepth int, httpTimeout time.Duration, retryMax int, retryBase time.Duration, flushWorkers int, spoolReplayInterval time.Duration, encoding string, breakerThreshold int, breakerCooldown time.Duration) *Client {
   if flushWorkers <= 0 {
     flushWorkers = 1
   }
+  if encoding == "" {
+    encoding = util.EncodingIdentity
+  }
   return &Client{
     baseURL: baseURL,
     token: token,
@@ -53,7 +70,10 @@ func New(baseURL, token string, batchMax int, batchWait time.Duration, metrics *
     spoolReplayInterval: spoolReplayInterval,
     metrics: metrics,
     spool: spool,
+    deadLetter: deadLetter,
     httpClient: &http.Client{Timeout: httpTimeout},
+    breaker: newBreaker(breakerThreshold, breakerCooldown, metrics),
+    encoding: encoding,
     inCh: make(chan event.Event, queueDepth),
     priorityCh: make(chan event.Event, 32),
   }
@@ -81,13 +101,26 @@ func (c *Client) PriorityDepth() int {
 }
 
 func (c *Client) Start(ctx context.Context, routerID string) {
+  c.wg.Add(c.flushWorkers + 1)
   for i := 0; i < c.flushWorkers; i++ {
-    go c.flushSupervisor(ctx, routerID)
+    go func() {
+      defer c.wg.Done()
+      c.flushSupervisor(ctx, routerID)
+    }()
   }
-  go c.priorityLoop(ctx, routerID)
+  go func() {
+    defer c.wg.Done()
+    c.priorityLoop(ctx, routerID)
+  }()
   go c.spoolReplayLoop(ctx)
 }
 
+// Wait blocks until the flush and priority loops have spooled what was queued
+// when ctx ended.
+func (c *Client) Wait() {
+  c.wg.Wait()
+}
+
 func (c *Client) IngestPriority(event event.Event) bool {
   if c.metrics != nil {
     c.metrics.HTTPLastEnqueue.Set(float64(time.Now().Unix()))
@@ -102,10 +135,8 @@ func (c *Client) IngestPriority(event event.Event) bool {
 }
 
 func (c *Client) flushSupervisor(ctx context.Context, routerID string) {
+  // flushLoop runs even if ctx has already ended, to spool the queue.
   for {
-    if ctx.Err() != nil {
-      return
-    }
     func() {
       defer func() {
         if r := recover(); r != nil {
@@ -125,6 +156,7 @@ func (c *Client) priorityLoop(ctx context.Context, routerID string) {
   for {
     select {
     case <-ctx.Done():
+      c.spoolQueued(routerID, c.priorityCh, nil)
       return
     case ev := <-c.priorityCh:
       batch := []event.Event{ev}
@@ -152,7 +184,7 @@ func (c *Client) flushLoop(ctx context.Context, routerID string) {
   for {
     select {
     case <-ctx.Done():
-      c.sendOrSpool(ctx, routerID, batch)
+      c.spoolQueued(routerID, c.inCh, batch)
       return
     case ev := <-c.inCh:
       batch = append(batch, ev)
@@ -169,54 +201,154 @@ func (c *Client) flushLoop(ctx context.Context, routerID string) {
 
 func (c *Client) sendOrSpool(ctx context.Context, routerID string, batch []event.Event) []event.Event {
   if err := c.flushOnce(ctx, routerID, batch); err != nil {
-    payload, _ := json.Marshal(event.Batch{RouterID: routerID, SentAt: time.Now().UTC(), Events: batch})
-    if err := c.spool.Enqueue(payload); err != nil {
-      c.metrics.SpoolDroppedTotal.Inc()
-    }
+    c.spoolEvents(routerID, batch)
   }
   return batch[:0]
 }
 
+// spoolQueued spools batch and whatever is left in ch, in batches of at most
+// batchMax, for the next run to replay. It is used on shutdown, when there is
+// no time left to upload.
+func (c *Client) spoolQueued(routerID string, ch <-chan event.Event, batch []event.Event) {
+  max := c.batchMax
+  if max <= 0 {
+    max = 1
+  }
+  for {
+    select {
+    case ev := <-ch:
+      batch = append(batch, ev)
+      if len(batch) < max {
+        continue
+      }
+    default:
+    }
+    if len(batch) == 0 {
+      return
+    }
+    full := len(batch) >= max
+    c.spoolEvents(routerID, batch)
+    batch = batch[:0]
+    if !full {
+      return
+    }
+  }
+}
+
+func (c *Client) spoolEvents(routerID string, events []event.Event) {
+  payload, _ := json.Marshal(event.Batch{RouterID: routerID, SentAt: time.Now().UTC(), Events: events})
+  if err := c.spool.Enqueue(payload); err != nil {
+    c.metrics.SpoolDroppedTotal.Inc()
+  }
+}
+
 func (c *Client) flushOnce(ctx context.Context, routerID string, batch []event.Event) error {
   if len(batch) == 0 {
     return nil
   }
-  payload, err := json.Marshal(event.Batch{RouterID: routerID, SentAt: time.Now().UTC(), Events: batch})
+  b := event.Batch{RouterID: routerID, SentAt: time.Now().UTC(), Events: batch}
+  payload, err := json.Marshal(b)
   if err != nil {
     return err
   }
   // Keep live ingest non-blocking: on any transient error, spool and move on.
-  return c.post(ctx, payload)
+  res, err := c.post(ctx, payload)
+  if status, ok := refusedBatch(err); ok {
+    c.rejectBatch(b, status)
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  if retry := c.settle(b, res); len(retry) > 0 {
+    c.spoolEvents(routerID, retry)
+  }
+  return nil
 }
 
-func (c *Client) postWithRetry(ctx context.Context, payload []byte) error {
+func (c *Client) postWithRetry(ctx context.Context, payload []byte) (*batchResult, error) {
   delays := backoffSchedule(c.retryBase, c.retryMax)
   var lastErr error
   for i := 0; i < len(delays); i++ {
     if i > 0 {
       select {
       case <-ctx.Done():
-        return ctx.Err()
+        return nil, ctx.Err()
       case <-time.After(delays[i]):
       }
     }
-    if err := c.post(ctx, payload); err == nil {
-      return nil
-    } else {
-      lastErr = err
+    res, err := c.post(ctx, payload)
+    if err == nil {
+      return res, nil
+    }
+    if _, refused := refusedBatch(err); refused || errors.Is(err, errBreakerOpen) {
+      return nil, err
+    }
+    lastErr = err
+  }
+  return nil, lastErr
+}
+
+// statusError is a non-2xx response.
+type statusError struct {
+  status     int
+  retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+  return fmt.Sprintf("http status %d", e.status)
+}
+
+// post uploads a batch unless the breaker is open and records the outcome in
+// the breaker. The result is nil if the server did not return one.
+func (c *Client) post(ctx context.Context, payload []byte) (*batchResult, error) {
+  if !c.breaker.allow() {
+    return nil, errBreakerOpen
+  }
+  res, err := c.send(ctx, payload)
+  var se *statusError
+  switch {
+  case err == nil:
+    c.breaker.success()
+  case errors.As(err, &se) && isAvailabilityFailure(se.status):
+    c.breaker.failure(se.retryAfter)
+  case se != nil:
+    // The server is up but refused this batch.
+    c.breaker.success()
+  default:
+    c.breaker.failure(0)
+  }
+  return res, err
+}
+
+func (c *Client) send(ctx context.Context, payload []byte) (*batchResult, error) {
+  for {
+    encoding := c.currentEncoding()
+    res, retry, err := c.sendEncoded(ctx, payload, encoding)
+    if !retry {
+      return res, err
     }
   }
-  return lastErr
 }
 
-func (c *Client) post(ctx context.Context, payload []byte) error {
+// sendEncoded posts payload once in encoding. retry reports a 415 for a
+// compressed body, after which the encoding has been downgraded and the
+// payload should be sent again.
+func (c *Client) sendEncoded(ctx context.Context, payload []byte, encoding string) (res *batchResult, retry bool, err error) {
+  body, err := util.Encode(encoding, payload)
+  if err != nil {
+    encoding, body = util.EncodingIdentity, payload
+  }
   url := fmt.Sprintf("%s/api/v1/netmon/events/batch", c.baseURL)
-  req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+  req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
   if err != nil {
-    return err
+    return nil, false, err
   }
   req.Header.Set("Authorization", "Bearer "+c.token)
   req.Header.Set("Content-Type", "application/json")
+  if encoding != util.EncodingIdentity {
+    req.Header.Set("Content-Encoding", encoding)
+  }
 
   resp, err := c.httpClient.Do(req)
   if err != nil {
@@ -224,22 +356,207 @@ func (c *Client) post(ctx context.Context, payload []byte) error {
     if c.metrics != nil {
       c.metrics.HTTPLastSendError.Set(float64(time.Now().Unix()))
     }
-    return err
+    return nil, false, err
   }
   defer resp.Body.Close()
+  respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxResultBytes))
   _, _ = io.Copy(io.Discard, resp.Body)
+  if resp.StatusCode == http.StatusUnsupportedMediaType && encoding != util.EncodingIdentity {
+    c.downgradeEncoding(encoding, resp.Header.Get("Accept-Encoding"))
+    return nil, true, nil
+  }
+  // Counted once per request the server took as encoded, not for a body
+  // refused for its coding and sent again.
+  if c.metrics != nil {
+    c.metrics.PayloadBytes.WithLabelValues("http", "raw").Add(float64(len(payload)))
+    c.metrics.PayloadBytes.WithLabelValues("http", "encoded").Add(float64(len(body)))
+  }
   if resp.StatusCode < 200 || resp.StatusCode >= 300 {
     c.metrics.HTTPSendErrors.WithLabelValues(fmt.Sprintf("%d", resp.StatusCode)).Inc()
     if c.metrics != nil {
       c.metrics.HTTPLastSendError.Set(float64(time.Now().Unix()))
     }
-    return errors.New("http error")
+    return nil, false, &statusError{status: resp.StatusCode, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
   }
   c.metrics.HTTPBatchesSent.Inc()
   if c.metrics != nil {
     c.metrics.HTTPLastSendSuccess.Set(float64(time.Now().Unix()))
   }
-  return nil
+  var result batchResult
+  if err := json.Unmarshal(respBody, &result); err != nil {
+    return nil, false, nil
+  }
+  return &result, false, nil
+}
+
+func (c *Client) currentEncoding() string {
+  c.encMu.Lock()
+  defer c.encMu.Unlock()
+  return c.encoding
+}
+
+// downgradeEncoding handles a 415 for a request sent with rejected. Per RFC
+// 7694 the server may list the codings it accepts in Accept-Encoding; gzip is
+// used if listed when zstd was rejected, identity otherwise.
+func (c *Client) downgradeEncoding(rejected, accept string) {
+  next := util.EncodingIdentity
+  if rejected == util.EncodingZstd && acceptsCoding(accept, util.EncodingGzip) {
+    next = util.EncodingGzip
+  }
+  c.encMu.Lock()
+  defer c.encMu.Unlock()
+  if c.encoding != rejected {
+    // Another worker already downgraded.
+    return
+  }
+  log.Printf("httpclient: server rejected Content-Encoding %s, using %s", rejected, next)
+  c.encoding = next
+}
+
+func acceptsCoding(header, coding string) bool {
+  for _, part := range strings.Split(header, ",") {
+    name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+    if !strings.EqualFold(strings.TrimSpace(name), coding) {
+      continue
+    }
+    return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+  }
+  return false
+}
+
+// maxResultBytes bounds how much of a response body is read for the result.
+const maxResultBytes = 1 << 20
+
+// batchResult is the server's answer to a batch upload. Rejections lists
+// rejected events by their index in the batch; a server that only reports
+// counts leaves it empty.
+type batchResult struct {
+  Accepted   int         `json:"accepted"`
+  Rejected   int         `json:"rejected"`
+  Rejections []rejection `json:"rejections"`
+}
+
+type rejection struct {
+  Index  int    `json:"index"`
+  Reason string `json:"reason"`
+  // Retryable marks a transient failure, such as a database timeout. The
+  // event is spooled and sent again; other rejections are dead-lettered.
+  Retryable bool `json:"retryable"`
+}
+
+// deadLetterBatch is the format of dead letter files: the events of one batch
+// the server rejected for good, with its reasons.
+type deadLetterBatch struct {
+  RouterID   string            `json:"router_id"`
+  SentAt     time.Time         `json:"sent_at"`
+  RejectedAt time.Time         `json:"rejected_at"`
+  Events     []deadLetterEvent `json:"events"`
+}
+
+type deadLetterEvent struct {
+  Reason string      `json:"reason"`
+  Event  event.Event `json:"event"`
+}
+
+// settle counts the server's result for b per event type, dead-letters
+// permanently rejected events and returns the ones to send again.
+func (c *Client) settle(b event.Batch, res *batchResult) []event.Event {
+  if res != nil && res.Rejected > 0 && len(res.Rejections) == 0 {
+    // Counts only: there is no telling which events were rejected.
+    log.Printf("httpclient: server rejected %d of %d events without details", res.Rejected, len(b.Events))
+    c.countEvents("unknown", "accepted", res.Accepted)
+    c.countEvents("unknown", "rejected", res.Rejected)
+    return nil
+  }
+  rejected := make(map[int]rejection)
+  if res != nil {
+    for _, r := range res.Rejections {
+      if r.Index >= 0 && r.Index < len(b.Events) {
+        rejected[r.Index] = r
+      }
+    }
+  }
+  var retry []event.Event
+  var dead []deadLetterEvent
+  deadByType := make(map[string]int)
+  reasonByType := make(map[string]string)
+  for i, ev := range b.Events {
+    r, ok := rejected[i]
+    switch {
+    case !ok:
+      c.countEvents(ev.Type, "accepted", 1)
+    case r.Retryable:
+      c.countEvents(ev.Type, "retried", 1)
+      retry = append(retry, ev)
+    default:
+      c.countEvents(ev.Type, "rejected", 1)
+      dead = append(dead, deadLetterEvent{Reason: r.Reason, Event: ev})
+      deadByType[ev.Type]++
+      if reasonByType[ev.Type] == "" {
+        reasonByType[ev.Type] = r.Reason
+      }
+    }
+  }
+  types := make([]string, 0, len(deadByType))
+  for t := range deadByType {
+    types = append(types, t)
+  }
+  sort.Strings(types)
+  for _, t := range types {
+    log.Printf("httpclient: server rejected %d %s events: %s", deadByType[t], t, reasonByType[t])
+  }
+  if len(dead) > 0 {
+    c.writeDeadLetter(deadLetterBatch{RouterID: b.RouterID, SentAt: b.SentAt, RejectedAt: time.Now().UTC(), Events: dead})
+  }
+  return retry
+}
+
+// refusedBatch reports the status of a response refusing a whole batch for
+// good, such as a 422 for a body that fails validation. Timeouts, rate limits
+// and auth failures are not: the batch may be taken later, or once the token
+// is fixed.
+func refusedBatch(err error) (int, bool) {
+  var se *statusError
+  if !errors.As(err, &se) || se.status < 400 || se.status >= 500 || isAvailabilityFailure(se.status) {
+    return 0, false
+  }
+  switch se.status {
+  case http.StatusUnauthorized, http.StatusForbidden:
+    return 0, false
+  }
+  return se.status, true
+}
+
+// rejectBatch dead-letters every event of a batch the server refused.
+func (c *Client) rejectBatch(b event.Batch, status int) {
+  reason := fmt.Sprintf("batch refused with http status %d", status)
+  res := &batchResult{Rejected: len(b.Events)}
+  for i := range b.Events {
+    res.Rejections = append(res.Rejections, rejection{Index: i, Reason: reason})
+  }
+  c.settle(b, res)
+}
+
+func (c *Client) writeDeadLetter(d deadLetterBatch) {
+  if c.metrics != nil {
+    c.metrics.DeadLetterEvents.Add(float64(len(d.Events)))
+  }
+  if c.deadLetter == nil {
+    return
+  }
+  payload, err := json.Marshal(d)
+  if err == nil {
+    err = c.deadLetter.Enqueue(payload)
+  }
+  if err != nil {
+    log.Printf("httpclient: dead letter: %v", err)
+  }
+}
+
+func (c *Client) countEvents(eventType, result string, n int) {
+  if c.metrics != nil && n > 0 {
+    c.metrics.HTTPEventsTotal.WithLabelValues(eventType, result).Add(float64(n))
+  }
 }
 
 func (c *Client) replaySpool(ctx context.Context, routerID string) {
@@ -255,13 +572,44 @@ func (c *Client) replaySpool(ctx context.Context, routerID string) {
     }
     path, payload, err := c.spool.DequeueOldest()
     if err != nil {
+      if path != "" {
+        // Unreadable file: drop it rather than block the spool.
+        log.Printf("httpclient: dropping spooled batch: %v", err)
+        _ = c.spool.Ack(path)
+        c.metrics.SpoolDroppedTotal.Inc()
+        continue
+      }
       return
     }
-    if err := c.postWithRetry(ctx, payload); err != nil {
+    var b event.Batch
+    decodeErr := json.Unmarshal(payload, &b)
+    res, err := c.postWithRetry(ctx, payload)
+    if status, ok := refusedBatch(err); ok {
+      // Sending it again would only be refused again.
+      if decodeErr == nil {
+        c.rejectBatch(b, status)
+      } else {
+        log.Printf("httpclient: dropping spooled batch refused with status %d", status)
+        c.metrics.SpoolDroppedTotal.Inc()
+      }
+      _ = c.spool.Ack(path)
+      replayed++
+      continue
+    }
+    if err != nil {
       return
     }
+    var retry []event.Event
+    if decodeErr == nil {
+      retry = c.settle(b, res)
+    }
     _ = c.spool.Ack(path)
     replayed++
+    if len(retry) > 0 {
+      // Spooled behind the rest; end the pass so it is not resent at once.
+      c.spoolEvents(b.RouterID, retry)
+      return
+    }
   }
 }
 
@@ -0,0 +1,385 @@
+package httpclient
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/prometheus/client_golang/prometheus/testutil"
+
+  "netmon_agent/internal/event"
+  "netmon_agent/internal/metrics"
+  "netmon_agent/internal/spool"
+  "netmon_agent/internal/util"
+)
+
+var (
+  testMetricsOnce sync.Once
+  testMetrics     *metrics.Metrics
+)
+
+func newTestClient(t *testing.T, url, encoding string) *Client {
+  t.Helper()
+  testMetricsOnce.Do(func() { testMetrics = metrics.New() })
+  sp := spool.New(t.TempDir(), 1<<20, util.EncodingGzip, testMetrics)
+  dl := spool.New(t.TempDir(), 1<<20, util.EncodingIdentity, nil)
+  for _, s := range []*spool.Spool{sp, dl} {
+    if err := s.Ensure(); err != nil {
+      t.Fatal(err)
+    }
+  }
+  return New(url, "token", 10, time.Second, testMetrics, sp, dl, 10, 5*time.Second, 1, time.Millisecond, 1, time.Second, encoding, 3, 30*time.Second)
+}
+
+// fakeServer decodes uploads like a server supporting the codings in accept
+// and records the Content-Encoding and batch of each accepted request.
+// respond, if set, returns the JSON result for a batch. A non-zero status
+// fails every request with it and retryAfter.
+type fakeServer struct {
+  *httptest.Server
+  mu        sync.Mutex
+  requests  int
+  status    int
+  retryAfter string
+  accept    map[string]bool
+  respond   func(event.Batch) interface{}
+  encodings []string
+  batches   []event.Batch
+  rawBytes  int // decoded size of accepted bodies
+  bodyBytes int // size of accepted bodies as sent
+}
+
+func newFakeServer(t *testing.T, accept ...string) *fakeServer {
+  s := &fakeServer{accept: map[string]bool{"": true}}
+  for _, a := range accept {
+    s.accept[a] = true
+  }
+  s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+  t.Cleanup(s.Close)
+  return s
+}
+
+func (s *fakeServer) handle(w http.ResponseWriter, r *http.Request) {
+  s.mu.Lock()
+  s.requests++
+  status, retryAfter := s.status, s.retryAfter
+  s.mu.Unlock()
+  if status != 0 {
+    if retryAfter != "" {
+      w.Header().Set("Retry-After", retryAfter)
+    }
+    w.WriteHeader(status)
+    return
+  }
+  enc := r.Header.Get("Content-Encoding")
+  if !s.accept[enc] {
+    if s.accept[util.EncodingGzip] {
+      w.Header().Set("Accept-Encoding", "gzip")
+    }
+    w.WriteHeader(http.StatusUnsupportedMediaType)
+    return
+  }
+  body, _ := io.ReadAll(r.Body)
+  raw, err := util.Decode(enc, body)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  var b event.Batch
+  if err := json.Unmarshal(raw, &b); err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  s.mu.Lock()
+  s.encodings = append(s.encodings, enc)
+  s.batches = append(s.batches, b)
+  s.rawBytes += len(raw)
+  s.bodyBytes += len(body)
+  s.mu.Unlock()
+  if s.respond != nil {
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(s.respond(b))
+    return
+  }
+  w.WriteHeader(http.StatusAccepted)
+}
+
+func testBatch() []event.Event {
+  var evs []event.Event
+  for i := 0; i < 50; i++ {
+    evs = append(evs, event.Event{Type: "heartbeat", TS: time.Date(2026, 3, 8, 14, 20, i, 0, time.UTC), Data: map[string]string{"router_id": "router-01"}})
+  }
+  return evs
+}
+
+func TestPostCompressed(t *testing.T) {
+  for _, enc := range []string{util.EncodingIdentity, util.EncodingGzip, util.EncodingZstd} {
+    srv := newFakeServer(t, util.EncodingGzip, util.EncodingZstd)
+    c := newTestClient(t, srv.URL, enc)
+    raw := testutil.ToFloat64(testMetrics.PayloadBytes.WithLabelValues("http", "raw"))
+    encoded := testutil.ToFloat64(testMetrics.PayloadBytes.WithLabelValues("http", "encoded"))
+    if err := c.flushOnce(context.Background(), "router-01", testBatch()); err != nil {
+      t.Fatalf("%s: %v", enc, err)
+    }
+    want := enc
+    if enc == util.EncodingIdentity {
+      want = ""
+    }
+    if len(srv.batches) != 1 || srv.encodings[0] != want || len(srv.batches[0].Events) != 50 {
+      t.Fatalf("%s: server got %v %+v", enc, srv.encodings, srv.batches)
+    }
+    raw = testutil.ToFloat64(testMetrics.PayloadBytes.WithLabelValues("http", "raw")) - raw
+    encoded = testutil.ToFloat64(testMetrics.PayloadBytes.WithLabelValues("http", "encoded")) - encoded
+    if enc == util.EncodingIdentity && raw != encoded || enc != util.EncodingIdentity && encoded*3 > raw {
+      t.Fatalf("%s: %v raw bytes, %v encoded", enc, raw, encoded)
+    }
+  }
+}
+
+func TestPostUnsupportedEncodingFallback(t *testing.T) {
+  // zstd is refused with Accept-Encoding: gzip, so the client moves to gzip.
+  srv := newFakeServer(t, util.EncodingGzip)
+  c := newTestClient(t, srv.URL, util.EncodingZstd)
+  raw := testutil.ToFloat64(testMetrics.PayloadBytes.WithLabelValues("http", "raw"))
+  encoded := testutil.ToFloat64(testMetrics.PayloadBytes.WithLabelValues("http", "encoded"))
+  for i := 0; i < 2; i++ {
+    if err := c.flushOnce(context.Background(), "router-01", testBatch()); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if len(srv.encodings) != 2 || srv.encodings[0] != "gzip" || srv.encodings[1] != "gzip" {
+    t.Fatalf("encodings = %v", srv.encodings)
+  }
+  // The refused zstd body is not counted.
+  raw = testutil.ToFloat64(testMetrics.PayloadBytes.WithLabelValues("http", "raw")) - raw
+  encoded = testutil.ToFloat64(testMetrics.PayloadBytes.WithLabelValues("http", "encoded")) - encoded
+  if raw != float64(srv.rawBytes) || encoded != float64(srv.bodyBytes) {
+    t.Fatalf("counted %v raw, %v encoded bytes; server took %d raw, %d encoded", raw, encoded, srv.rawBytes, srv.bodyBytes)
+  }
+
+  // No Accept-Encoding: fall back to identity.
+  srv = newFakeServer(t)
+  c = newTestClient(t, srv.URL, util.EncodingGzip)
+  if err := c.flushOnce(context.Background(), "router-01", testBatch()); err != nil {
+    t.Fatal(err)
+  }
+  if len(srv.encodings) != 1 || srv.encodings[0] != "" || c.currentEncoding() != util.EncodingIdentity {
+    t.Fatalf("encodings = %v, client uses %s", srv.encodings, c.currentEncoding())
+  }
+}
+
+func TestAcceptsCoding(t *testing.T) {
+  for header, want := range map[string]bool{
+    "":                   false,
+    "gzip":               true,
+    "br, GZIP;q=0.5":     true,
+    "gzip;q=0":           false,
+    "identity, x-gzip":   false,
+  } {
+    if got := acceptsCoding(header, "gzip"); got != want {
+      t.Errorf("acceptsCoding(%q) = %v, want %v", header, got, want)
+    }
+  }
+}
+
+func mixedBatch() []event.Event {
+  ts := time.Date(2026, 3, 8, 14, 20, 0, 0, time.UTC)
+  return []event.Event{
+    {Type: "flow", TS: ts, Data: map[string]interface{}{"n": 0}},
+    {Type: "dns_anomaly", TS: ts, Data: map[string]interface{}{"n": 1}},
+    {Type: "flow", TS: ts, Data: map[string]interface{}{"n": 2}},
+    {Type: "flow", TS: ts, Data: map[string]interface{}{"n": 3}},
+  }
+}
+
+// rejectMixed rejects the dns_anomaly for good and fails the last flow.
+func rejectMixed(b event.Batch) interface{} {
+  return map[string]interface{}{
+    "accepted": len(b.Events) - 2,
+    "rejected": 2,
+    "rejections": []map[string]interface{}{
+      {"index": 1, "reason": "unknown event type dns_anomaly"},
+      {"index": len(b.Events) - 1, "reason": "deadlock detected", "retryable": true},
+    },
+  }
+}
+
+func eventsMetric(eventType, result string) float64 {
+  return testutil.ToFloat64(testMetrics.HTTPEventsTotal.WithLabelValues(eventType, result))
+}
+
+func dequeue(t *testing.T, s *spool.Spool, v interface{}) {
+  t.Helper()
+  path, payload, err := s.DequeueOldest()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := json.Unmarshal(payload, v); err != nil {
+    t.Fatal(err)
+  }
+  _ = s.Ack(path)
+}
+
+func TestPartialRejection(t *testing.T) {
+  srv := newFakeServer(t)
+  srv.respond = rejectMixed
+  c := newTestClient(t, srv.URL, util.EncodingIdentity)
+  accepted, rejected, retried := eventsMetric("flow", "accepted"), eventsMetric("dns_anomaly", "rejected"), eventsMetric("flow", "retried")
+
+  if err := c.flushOnce(context.Background(), "router-01", mixedBatch()); err != nil {
+    t.Fatal(err)
+  }
+  if d := eventsMetric("flow", "accepted") - accepted; d != 2 {
+    t.Errorf("flow accepted += %v, want 2", d)
+  }
+  if d := eventsMetric("dns_anomaly", "rejected") - rejected; d != 1 {
+    t.Errorf("dns_anomaly rejected += %v, want 1", d)
+  }
+  if d := eventsMetric("flow", "retried") - retried; d != 1 {
+    t.Errorf("flow retried += %v, want 1", d)
+  }
+
+  var dead deadLetterBatch
+  dequeue(t, c.deadLetter, &dead)
+  if dead.RouterID != "router-01" || len(dead.Events) != 1 || dead.Events[0].Event.Type != "dns_anomaly" || dead.Events[0].Reason != "unknown event type dns_anomaly" {
+    t.Fatalf("dead letter = %+v", dead)
+  }
+
+  var retry event.Batch
+  dequeue(t, c.spool, &retry)
+  if len(retry.Events) != 1 || retry.Events[0].Data.(map[string]interface{})["n"] != 3.0 {
+    t.Fatalf("spooled retry = %+v", retry)
+  }
+}
+
+func TestReplayPartialRejection(t *testing.T) {
+  srv := newFakeServer(t)
+  srv.respond = rejectMixed
+  c := newTestClient(t, srv.URL, util.EncodingIdentity)
+  payload, _ := json.Marshal(event.Batch{RouterID: "router-01", Events: mixedBatch()})
+  if err := c.spool.Enqueue(payload); err != nil {
+    t.Fatal(err)
+  }
+
+  c.replaySpool(context.Background(), "")
+  // The replayed batch is acked and its transient failure spooled again, to
+  // be sent on the next pass.
+  if len(srv.batches) != 1 || c.spool.Count() != 1 || c.deadLetter.Count() != 1 {
+    t.Fatalf("server got %d batches; spool %d, dead letter %d", len(srv.batches), c.spool.Count(), c.deadLetter.Count())
+  }
+  c.replaySpool(context.Background(), "")
+  if len(srv.batches) != 2 || len(srv.batches[1].Events) != 1 {
+    t.Fatalf("server got %+v", srv.batches)
+  }
+}
+
+func TestCountsOnlyResult(t *testing.T) {
+  srv := newFakeServer(t)
+  srv.respond = func(b event.Batch) interface{} {
+    return map[string]int{"accepted": len(b.Events) - 1, "rejected": 1}
+  }
+  c := newTestClient(t, srv.URL, util.EncodingIdentity)
+  rejected := eventsMetric("unknown", "rejected")
+  if err := c.flushOnce(context.Background(), "router-01", mixedBatch()); err != nil {
+    t.Fatal(err)
+  }
+  if d := eventsMetric("unknown", "rejected") - rejected; d != 1 {
+    t.Errorf("unknown rejected += %v, want 1", d)
+  }
+  if c.spool.Count() != 0 || c.deadLetter.Count() != 0 {
+    t.Fatalf("spool %d, dead letter %d", c.spool.Count(), c.deadLetter.Count())
+  }
+}
+
+func TestRefusedBatchDeadLettered(t *testing.T) {
+  srv := newFakeServer(t)
+  srv.status = http.StatusUnprocessableEntity
+  c := newTestClient(t, srv.URL, util.EncodingIdentity)
+  ctx := context.Background()
+  rejected := eventsMetric("flow", "rejected")
+
+  c.sendOrSpool(ctx, "router-01", mixedBatch())
+  // A batch spooled before the server started refusing it.
+  payload, _ := json.Marshal(event.Batch{RouterID: "router-01", Events: mixedBatch()})
+  if err := c.spool.Enqueue(payload); err != nil {
+    t.Fatal(err)
+  }
+  c.replaySpool(ctx, "")
+
+  if c.spool.Count() != 0 || c.deadLetter.Count() != 2 {
+    t.Fatalf("spool %d, dead letter %d; want 0 and 2", c.spool.Count(), c.deadLetter.Count())
+  }
+  if srv.requests != 2 {
+    t.Fatalf("server got %d requests, want each batch sent once", srv.requests)
+  }
+  var dead deadLetterBatch
+  dequeue(t, c.deadLetter, &dead)
+  if len(dead.Events) != len(mixedBatch()) || dead.Events[0].Reason != "batch refused with http status 422" {
+    t.Fatalf("dead letter = %+v", dead)
+  }
+  if d := eventsMetric("flow", "rejected") - rejected; d != 6 {
+    t.Errorf("flow rejected += %v, want 6", d)
+  }
+}
+
+func TestReplayKeepsEventIDs(t *testing.T) {
+  srv := newFakeServer(t)
+  srv.status = http.StatusGatewayTimeout
+  c := newTestClient(t, srv.URL, util.EncodingIdentity)
+  ctx := context.Background()
+  batch := mixedBatch()
+  for i := range batch {
+    batch[i].ID = fmt.Sprintf("router-01:%d", 1000+i)
+  }
+
+  // The server may have committed the batch before timing out.
+  c.sendOrSpool(ctx, "router-01", append([]event.Event(nil), batch...))
+  srv.mu.Lock()
+  srv.status = 0
+  srv.mu.Unlock()
+  c.replaySpool(ctx, "")
+
+  // The server dedups by event id, so the replay must carry the same ones.
+  if srv.requests != 2 || len(srv.batches) != 1 {
+    t.Fatalf("server got %d requests, %d batches", srv.requests, len(srv.batches))
+  }
+  for i, ev := range srv.batches[0].Events {
+    if ev.ID != batch[i].ID {
+      t.Fatalf("replayed event %d has id %q, want %q", i, ev.ID, batch[i].ID)
+    }
+  }
+}
+
+func TestWaitSpoolsQueued(t *testing.T) {
+  srv := newFakeServer(t)
+  c := newTestClient(t, srv.URL, util.EncodingIdentity)
+  for i := 0; i < 10; i++ {
+    if !c.Ingest(event.Event{Type: "flow"}) {
+      t.Fatal("queue full")
+    }
+  }
+  c.IngestPriority(event.Event{Type: "heartbeat"})
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  c.Start(ctx, "router-01")
+  c.Wait()
+
+  if c.QueueDepth() != 0 || c.PriorityDepth() != 0 {
+    t.Fatalf("left queued: %d, priority %d", c.QueueDepth(), c.PriorityDepth())
+  }
+  spooled := 0
+  for c.spool.Count() > 0 {
+    var b event.Batch
+    dequeue(t, c.spool, &b)
+    spooled += len(b.Events)
+  }
+  if spooled != 11 || len(srv.batches) != 0 {
+    t.Fatalf("spooled %d events, server got %d batches; want all 11 spooled", spooled, len(srv.batches))
+  }
+}
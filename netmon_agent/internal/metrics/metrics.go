@@ -5,21 +5,43 @@ import "github.com/prometheus/client_golang/prometheus"
 type Metrics struct {
   NFLogEventsTotal    *prometheus.CounterVec
   NFLogParseErrors    prometheus.Counter
+  NFLogReconnects     *prometheus.CounterVec
+  NFLogLastEvent      *prometheus.GaugeVec
   ConntrackDestroy    prometheus.Counter
   ConntrackParseErrors prometheus.Counter
+  ConntrackFlowTable  prometheus.Gauge
+  ConntrackFlowTableEvictions prometheus.Counter
+  ConntrackSnapshotFlows prometheus.Gauge
+  ConntrackSnapshotErrors prometheus.Counter
+  ConntrackFlowUpdates prometheus.Counter
   DNSLinesTotal       prometheus.Counter
   DNSParseErrors      prometheus.Counter
   DNSBucketsEmitted   prometheus.Counter
+  DNSResponsesEmitted prometheus.Counter
+  DNSResponsesDropped *prometheus.CounterVec
+  DNSResponsesPending prometheus.Gauge
+  DNSAnswerMapEntries prometheus.Gauge
+  DNSAnomaliesEmitted *prometheus.CounterVec
+  DNSCacheEntries     *prometheus.GaugeVec
+  DNSCacheEvictions   *prometheus.CounterVec
   QueueDepth          *prometheus.GaugeVec
   DroppedLocalTotal   *prometheus.CounterVec
   HTTPBatchesSent     prometheus.Counter
   HTTPSendErrors      *prometheus.CounterVec
+  HTTPEventsTotal     *prometheus.CounterVec
   HTTPLastEnqueue     prometheus.Gauge
   HTTPLastSendSuccess prometheus.Gauge
   HTTPLastSendError   prometheus.Gauge
+  HTTPBreakerState    prometheus.Gauge
   SpoolBytes          prometheus.Gauge
   SpoolBatches        prometheus.Gauge
   SpoolDroppedTotal   prometheus.Counter
+  DeadLetterEvents    prometheus.Counter
+  PayloadBytes        *prometheus.CounterVec
+  SinkEvents          *prometheus.CounterVec
+  SinkWriteErrors     *prometheus.CounterVec
+  SinkOversized       *prometheus.CounterVec
+  EventIDFallbacks    prometheus.Counter
 }
 
 func New() *Metrics {
@@ -32,6 +54,14 @@ func New() *Metrics {
       Name: "nflog_parse_errors_total",
       Help: "NFLOG parse errors",
     }),
+    NFLogReconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+      Name: "nflog_reconnects_total",
+      Help: "NFLOG group rebinds after a socket failure or idle timeout",
+    }, []string{"group"}),
+    NFLogLastEvent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+      Name: "nflog_last_event_ts",
+      Help: "Unix timestamp of the last packet received per NFLOG group",
+    }, []string{"group"}),
     ConntrackDestroy: prometheus.NewCounter(prometheus.CounterOpts{
       Name: "conntrack_destroy_total",
       Help: "Conntrack destroy events",
@@ -40,6 +70,26 @@ func New() *Metrics {
       Name: "conntrack_parse_errors_total",
       Help: "Conntrack parse errors",
     }),
+    ConntrackFlowTable: prometheus.NewGauge(prometheus.GaugeOpts{
+      Name: "conntrack_flow_table_entries",
+      Help: "Flows tracked locally for first-seen timestamps",
+    }),
+    ConntrackFlowTableEvictions: prometheus.NewCounter(prometheus.CounterOpts{
+      Name: "conntrack_flow_table_evictions_total",
+      Help: "Flows evicted from the local flow table before DESTROY",
+    }),
+    ConntrackSnapshotFlows: prometheus.NewGauge(prometheus.GaugeOpts{
+      Name: "conntrack_snapshot_flows",
+      Help: "Active flows seen in the last conntrack dump",
+    }),
+    ConntrackSnapshotErrors: prometheus.NewCounter(prometheus.CounterOpts{
+      Name: "conntrack_snapshot_errors_total",
+      Help: "Conntrack dump failures",
+    }),
+    ConntrackFlowUpdates: prometheus.NewCounter(prometheus.CounterOpts{
+      Name: "conntrack_flow_updates_total",
+      Help: "Interim flow_update events emitted",
+    }),
     DNSLinesTotal: prometheus.NewCounter(prometheus.CounterOpts{
       Name: "dns_lines_total",
       Help: "DNS log lines processed",
@@ -52,6 +102,34 @@ func New() *Metrics {
       Name: "dns_buckets_emitted_total",
       Help: "DNS buckets emitted",
     }),
+    DNSResponsesEmitted: prometheus.NewCounter(prometheus.CounterOpts{
+      Name: "dns_responses_emitted_total",
+      Help: "dns_response events emitted",
+    }),
+    DNSResponsesDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+      Name: "dns_responses_dropped_total",
+      Help: "DNS queries or answers that could not be stitched into a dns_response",
+    }, []string{"reason"}),
+    DNSResponsesPending: prometheus.NewGauge(prometheus.GaugeOpts{
+      Name: "dns_responses_pending",
+      Help: "DNS queries waiting for an answer",
+    }),
+    DNSAnswerMapEntries: prometheus.NewGauge(prometheus.GaugeOpts{
+      Name: "dns_answer_map_entries",
+      Help: "Entries in the answer address to domain map",
+    }),
+    DNSAnomaliesEmitted: prometheus.NewCounterVec(prometheus.CounterOpts{
+      Name: "dns_anomalies_emitted_total",
+      Help: "dns_anomaly events emitted",
+    }, []string{"kind"}),
+    DNSCacheEntries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+      Name: "dns_cache_entries",
+      Help: "Entries in the DNS correlator caches",
+    }, []string{"cache"}),
+    DNSCacheEvictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+      Name: "dns_cache_evictions_total",
+      Help: "DNS correlator cache entries evicted by size or age",
+    }, []string{"cache", "reason"}),
     QueueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
       Name: "queue_depth",
       Help: "Queue depth by stream",
@@ -76,10 +154,18 @@ func New() *Metrics {
       Name: "http_last_send_success_ts",
       Help: "Unix timestamp of last successful HTTP batch send",
     }),
+    HTTPEventsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+      Name: "http_events_total",
+      Help: "Uploaded events by type and server result (accepted, rejected, retried; type unknown when the server gave no indices)",
+    }, []string{"type", "result"}),
     HTTPLastSendError: prometheus.NewGauge(prometheus.GaugeOpts{
       Name: "http_last_send_error_ts",
       Help: "Unix timestamp of last HTTP batch send error",
     }),
+    HTTPBreakerState: prometheus.NewGauge(prometheus.GaugeOpts{
+      Name: "http_breaker_state",
+      Help: "Upload circuit breaker state: 0 closed, 1 open, 2 half-open",
+    }),
     SpoolBytes: prometheus.NewGauge(prometheus.GaugeOpts{
       Name: "spool_bytes",
       Help: "Spool size in bytes",
@@ -92,26 +178,72 @@ func New() *Metrics {
       Name: "spool_dropped_batches_total",
       Help: "Spool dropped batches",
     }),
+    DeadLetterEvents: prometheus.NewCounter(prometheus.CounterOpts{
+      Name: "dead_letter_events_total",
+      Help: "Events permanently rejected by the server and written to the dead letter dir",
+    }),
+    PayloadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+      Name: "payload_bytes_total",
+      Help: "Batch payload bytes by target (http, spool) before (raw) and after (encoded) compression",
+    }, []string{"target", "form"}),
+    SinkEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+      Name: "sink_events_total",
+      Help: "Events handed to each sink, by result (queued, dropped when its queue is full)",
+    }, []string{"sink", "result"}),
+    SinkWriteErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+      Name: "sink_write_errors_total",
+      Help: "Events a file, stdout or syslog sink failed to write",
+    }, []string{"sink"}),
+    SinkOversized: prometheus.NewCounterVec(prometheus.CounterOpts{
+      Name: "sink_oversized_total",
+      Help: "Events a sink dropped as too large for its transport (syslog over udp)",
+    }, []string{"sink"}),
+    EventIDFallbacks: prometheus.NewCounter(prometheus.CounterOpts{
+      Name: "event_id_fallback_total",
+      Help: "Event IDs handed out at random because the sequence could not be saved",
+    }),
   }
 
   prometheus.MustRegister(
     m.NFLogEventsTotal,
     m.NFLogParseErrors,
+    m.NFLogReconnects,
+    m.NFLogLastEvent,
     m.ConntrackDestroy,
     m.ConntrackParseErrors,
+    m.ConntrackFlowTable,
+    m.ConntrackFlowTableEvictions,
+    m.ConntrackSnapshotFlows,
+    m.ConntrackSnapshotErrors,
+    m.ConntrackFlowUpdates,
     m.DNSLinesTotal,
     m.DNSParseErrors,
     m.DNSBucketsEmitted,
+    m.DNSResponsesEmitted,
+    m.DNSResponsesDropped,
+    m.DNSResponsesPending,
+    m.DNSAnswerMapEntries,
+    m.DNSAnomaliesEmitted,
+    m.DNSCacheEntries,
+    m.DNSCacheEvictions,
     m.QueueDepth,
     m.DroppedLocalTotal,
     m.HTTPBatchesSent,
     m.HTTPSendErrors,
+    m.HTTPEventsTotal,
     m.HTTPLastEnqueue,
     m.HTTPLastSendSuccess,
     m.HTTPLastSendError,
+    m.HTTPBreakerState,
     m.SpoolBytes,
     m.SpoolBatches,
     m.SpoolDroppedTotal,
+    m.DeadLetterEvents,
+    m.PayloadBytes,
+    m.SinkEvents,
+    m.SinkWriteErrors,
+    m.SinkOversized,
+    m.EventIDFallbacks,
   )
 
   return m
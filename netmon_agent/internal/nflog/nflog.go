@@ -4,38 +4,230 @@ package nflog
 
 import (
   "context"
+  "fmt"
+  "log"
   "net"
   "strconv"
+  "sync"
+  "sync/atomic"
   "time"
 
   nflog "github.com/florianl/go-nflog"
-  "github.com/google/gopacket"
-  "github.com/google/gopacket/layers"
 
+  "netmon_agent/internal/config"
+  "netmon_agent/internal/dns"
   "netmon_agent/internal/event"
   "netmon_agent/internal/metrics"
   "netmon_agent/internal/util"
 )
 
 type Handler struct {
-  group   int
-  hook    string
-  metrics *metrics.Metrics
-  out     chan<- event.Event
+  cfg       config.NFLogGroup
+  group     int
+  hook      string
+  ruleTag   string
+  eventType string
+  metrics   *metrics.Metrics
+  out       chan<- event.Event
+  dnsOut    chan<- *dns.ParsedLine
+
+  lastEvent atomic.Int64
+  mu        sync.Mutex
+  state     string
+  reconnects int
+  lastError string
+
+  // listenFn and after are replaced in tests.
+  listenFn func(ctx context.Context) (time.Duration, error)
+  after    func(time.Duration) <-chan time.Time
+}
+
+// GroupHealth is the per-group state reported on the health endpoint.
+type GroupHealth struct {
+  Group      int    `json:"group"`
+  Hook       string `json:"hook"`
+  State      string `json:"state"`
+  Reconnects int    `json:"reconnects"`
+  LastEvent  string `json:"last_event,omitempty"`
+  LastError  string `json:"last_error,omitempty"`
+}
+
+const (
+  stateConnecting = "connecting"
+  stateRunning    = "running"
+  stateBackoff    = "backoff"
+  stateStopped    = "stopped"
+)
+
+// Start supervises an NFLOG group: it binds the group and rebinds it with
+// backoff whenever the socket fails (e.g. ENOBUFS) or, with idle_reconnect
+// set, when the group has been silent for that long. Groups of kind dns send
+// decoded DNS messages to dnsOut instead of events to out.
+func Start(ctx context.Context, group config.NFLogGroup, metrics *metrics.Metrics, out chan<- event.Event, dnsOut chan<- *dns.ParsedLine) *Handler {
+  h := &Handler{
+    cfg: group,
+    group: group.Group,
+    hook: group.Hook,
+    ruleTag: group.RuleTag,
+    eventType: eventType(group.Kind),
+    metrics: metrics,
+    out: out,
+    state: stateConnecting,
+  }
+  if group.Kind == config.NFLogKindDNS {
+    h.dnsOut = dnsOut
+  }
+  h.listenFn = h.listen
+  h.after = time.After
+  go h.run(ctx)
+  return h
+}
+
+func (h *Handler) Health() GroupHealth {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  gh := GroupHealth{Group: h.group, Hook: h.hook, State: h.state, Reconnects: h.reconnects, LastError: h.lastError}
+  if ts := h.lastEvent.Load(); ts != 0 {
+    gh.LastEvent = time.Unix(0, ts).UTC().Format(time.RFC3339)
+  }
+  return gh
+}
+
+func (h *Handler) setState(state string, err error) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  h.state = state
+  if err != nil {
+    h.lastError = err.Error()
+  }
 }
 
-func Start(ctx context.Context, group int, hook string, metrics *metrics.Metrics, out chan<- event.Event) error {
-  h := &Handler{group: group, hook: hook, metrics: metrics, out: out}
-  cfg := nflog.Config{Group: uint16(group), Copymode: nflog.NfUlnlCopyPacket, Bufsize: 128}
+func (h *Handler) run(ctx context.Context) {
+  backoff := 1 * time.Second
+  maxBackoff := 30 * time.Second
+  groupLabel := strconv.Itoa(h.group)
+
+  for attempt := 0; ; attempt++ {
+    if ctx.Err() != nil {
+      h.setState(stateStopped, nil)
+      return
+    }
+    if attempt > 0 {
+      h.mu.Lock()
+      h.reconnects++
+      h.mu.Unlock()
+      h.metrics.NFLogReconnects.WithLabelValues(groupLabel).Inc()
+    }
+
+    h.setState(stateConnecting, nil)
+    uptime, err := h.listenFn(ctx)
+    if ctx.Err() != nil {
+      h.setState(stateStopped, nil)
+      return
+    }
+    log.Printf("nflog group %d: %v", h.group, err)
+    h.setState(stateBackoff, err)
+
+    // A bind that held for longer than the longest backoff was working;
+    // start over from a short wait instead of the previous failure's.
+    if uptime > maxBackoff {
+      backoff = 1 * time.Second
+    }
+    select {
+    case <-ctx.Done():
+      h.setState(stateStopped, nil)
+      return
+    case <-h.after(backoff):
+    }
+    backoff = nextBackoff(backoff, maxBackoff)
+  }
+}
+
+// listen binds the group and blocks until the socket fails, the group goes
+// idle or ctx is cancelled. It returns how long the group was bound, 0 if
+// binding failed.
+func (h *Handler) listen(ctx context.Context) (time.Duration, error) {
+  cfg := nflog.Config{
+    Group: uint16(h.cfg.Group),
+    Copymode: nflog.NfUlnlCopyPacket,
+    Bufsize: uint32(h.cfg.CopyRange),
+    QThresh: uint32(h.cfg.QThreshold),
+    // kernel flush timeout is in 1/100s
+    Timeout: uint32(h.cfg.Timeout / (10 * time.Millisecond)),
+  }
   n, err := nflog.Open(&cfg)
   if err != nil {
-    return err
+    return 0, fmt.Errorf("open: %w", err)
   }
-  go func() {
-    <-ctx.Done()
-    _ = n.Close()
-  }()
-  return n.Register(ctx, h.cb)
+  defer n.Close()
+  if h.cfg.BufferSize > 0 {
+    if err := n.Con.SetReadBuffer(h.cfg.BufferSize); err != nil {
+      log.Printf("nflog group %d SetReadBuffer failed: %v", h.group, err)
+    }
+  }
+
+  lctx, cancel := context.WithCancel(ctx)
+  defer cancel()
+  errCh := make(chan error, 1)
+  errfn := func(e error) int {
+    select {
+    case errCh <- e:
+    default:
+    }
+    return 1
+  }
+  if err := n.RegisterWithErrorFunc(lctx, h.cb, errfn); err != nil {
+    return 0, fmt.Errorf("register: %w", err)
+  }
+  h.setState(stateRunning, nil)
+  bound := time.Now()
+  err = h.wait(ctx, errCh, bound)
+  return time.Since(bound), err
+}
+
+// wait blocks until errCh delivers a socket error, ctx is cancelled or, with
+// idle_reconnect set, no packet has arrived for that long since bound.
+func (h *Handler) wait(ctx context.Context, errCh <-chan error, bound time.Time) error {
+  var idle <-chan time.Time
+  if h.cfg.IdleReconnect > 0 {
+    ticker := time.NewTicker(h.cfg.IdleReconnect / 2)
+    defer ticker.Stop()
+    idle = ticker.C
+  }
+
+  for {
+    select {
+    case <-ctx.Done():
+      return ctx.Err()
+    case err := <-errCh:
+      return fmt.Errorf("receive: %w", err)
+    case <-idle:
+      last := bound
+      if ts := h.lastEvent.Load(); ts > bound.UnixNano() {
+        last = time.Unix(0, ts)
+      }
+      if time.Since(last) >= h.cfg.IdleReconnect {
+        return fmt.Errorf("no packets for %s; rebinding", h.cfg.IdleReconnect)
+      }
+    }
+  }
+}
+
+func nextBackoff(cur, max time.Duration) time.Duration {
+  next := cur * 2
+  if next > max {
+    return max
+  }
+  return next
+}
+
+// eventType maps a group kind to the event it produces. accept_log groups reuse
+// the firewall_drop payload.
+func eventType(kind string) string {
+  if kind == config.NFLogKindAcceptLog {
+    return "firewall_accept"
+  }
+  return "firewall_drop"
 }
 
 func (h *Handler) cb(m nflog.Msg) int {
@@ -48,50 +240,35 @@ func (h *Handler) cb(m nflog.Msg) int {
   if !ok || len(raw) == 0 {
     return 0
   }
-  pkt := gopacket.NewPacket(raw, layers.LayerTypeIPv4, gopacket.Default)
-  ipLayer := pkt.Layer(layers.LayerTypeIPv4)
-  if ipLayer == nil {
+  if h.dnsOut != nil {
+    h.handleDNS(raw, m)
+    return 0
+  }
+  hwProto, _ := m[nflog.AttrHwProtocol].(uint16)
+  pkt, err := decodePacket(raw, hwProto)
+  if err != nil {
     h.metrics.NFLogParseErrors.Inc()
     return 0
   }
-  ip := ipLayer.(*layers.IPv4)
 
-  var srcPort, dstPort int
-  var l4proto int
-  var tcpSyn bool
-
-  if tcpLayer := pkt.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-    tcp := tcpLayer.(*layers.TCP)
-    srcPort = int(tcp.SrcPort)
-    dstPort = int(tcp.DstPort)
-    l4proto = 6
-    tcpSyn = tcp.SYN
-  } else if udpLayer := pkt.Layer(layers.LayerTypeUDP); udpLayer != nil {
-    udp := udpLayer.(*layers.UDP)
-    srcPort = int(udp.SrcPort)
-    dstPort = int(udp.DstPort)
-    l4proto = 17
-  } else {
-    l4proto = int(ip.Protocol)
-  }
+  meta := decodeMeta(m)
 
   var ifIn, ifOut string
   if idx, ok := m[nflog.AttrIfindexIndev].(uint32); ok {
-    if iface, err := net.InterfaceByIndex(int(idx)); err == nil {
-      ifIn = iface.Name
-    }
+    ifIn = ifName(idx)
   }
   if idx, ok := m[nflog.AttrIfindexOutdev].(uint32); ok {
-    if iface, err := net.InterfaceByIndex(int(idx)); err == nil {
-      ifOut = iface.Name
-    }
+    ifOut = ifName(idx)
   }
 
-  tag := ""
-  if pfx, ok := m[nflog.AttrPrefix].(string); ok {
+  tag := h.ruleTag
+  if pfx, ok := m[nflog.AttrPrefix].(string); ok && pfx != "" {
     tag = pfx
   }
 
+  now := time.Now()
+  h.lastEvent.Store(now.UnixNano())
+  h.metrics.NFLogLastEvent.WithLabelValues(strconv.Itoa(h.group)).Set(float64(now.Unix()))
   h.metrics.NFLogEventsTotal.WithLabelValues(strconv.Itoa(h.group), tag).Inc()
 
   var ifOutPtr *string
@@ -99,19 +276,66 @@ func (h *Handler) cb(m nflog.Msg) int {
     ifOutPtr = &ifOut
   }
 
-  util.TrySend(h.out, h.metrics, "firewall_drop", event.Event{Type: "firewall_drop", TS: time.Now().UTC(), Data: event.FirewallDrop{
+  ts := meta.Timestamp
+  if ts.IsZero() {
+    ts = now.UTC()
+  }
+
+  util.TrySend(h.out, h.metrics, h.eventType, event.Event{Type: h.eventType, TS: ts, Data: event.FirewallDrop{
     Hook: h.hook,
     RuleTag: tag,
     NflogGroup: h.group,
     IfIn: ifIn,
     IfOut: ifOutPtr,
-    SrcIP: ip.SrcIP.String(),
-    DstIP: ip.DstIP.String(),
-    SrcPort: srcPort,
-    DstPort: dstPort,
-    L4Proto: l4proto,
-    TCPSyn: tcpSyn,
+    IPVersion: pkt.IPVersion,
+    SrcIP: pkt.SrcIP,
+    DstIP: pkt.DstIP,
+    SrcPort: pkt.SrcPort,
+    DstPort: pkt.DstPort,
+    L4Proto: pkt.L4Proto,
+    TCPSyn: pkt.TCPSyn,
+    ICMP: pkt.ICMP,
+    SrcMAC: meta.SrcMAC,
+    UID: meta.UID,
+    GID: meta.GID,
+    Mark: meta.Mark,
+    PhysIn: ifName(meta.PhysIn),
+    PhysOut: ifName(meta.PhysOut),
   }})
 
   return 0
 }
+
+// handleDNS decodes a packet from a dns group and hands it to the DNS
+// correlator.
+func (h *Handler) handleDNS(raw []byte, m nflog.Msg) {
+  now := time.Now()
+  h.lastEvent.Store(now.UnixNano())
+  h.metrics.NFLogLastEvent.WithLabelValues(strconv.Itoa(h.group)).Set(float64(now.Unix()))
+  h.metrics.NFLogEventsTotal.WithLabelValues(strconv.Itoa(h.group), h.ruleTag).Inc()
+
+  ts := decodeMeta(m).Timestamp
+  if ts.IsZero() {
+    ts = now
+  }
+  parsed, err := dns.DecodePacket(raw, ts)
+  if err != nil {
+    h.metrics.DNSParseErrors.Inc()
+    return
+  }
+  select {
+  case h.dnsOut <- parsed:
+  default:
+    h.metrics.DroppedLocalTotal.WithLabelValues("dns_packets").Inc()
+  }
+}
+
+func ifName(idx uint32) string {
+  if idx == 0 {
+    return ""
+  }
+  if iface, err := net.InterfaceByIndex(int(idx)); err == nil {
+    return iface.Name
+  }
+  return ""
+}
@@ -0,0 +1,112 @@
+//go:build linux
+
+package nflog
+
+import (
+  "context"
+  "errors"
+  "reflect"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/prometheus/client_golang/prometheus/testutil"
+
+  "netmon_agent/internal/config"
+  "netmon_agent/internal/metrics"
+)
+
+var (
+  testMetricsOnce sync.Once
+  testMetrics     *metrics.Metrics
+)
+
+func TestRunBackoff(t *testing.T) {
+  testMetricsOnce.Do(func() { testMetrics = metrics.New() })
+  m := testMetrics
+  reconnects := testutil.ToFloat64(m.NFLogReconnects.WithLabelValues("5"))
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+
+  // How long each bind held before failing. The long one was a working
+  // group, so the wait after it starts over.
+  uptimes := []time.Duration{0, 0, 0, 0, 0, 0, 0, time.Minute, 0, 0}
+  h := &Handler{group: 5, metrics: m, state: stateConnecting}
+  binds := 0
+  h.listenFn = func(ctx context.Context) (time.Duration, error) {
+    if got := h.Health().State; got != stateConnecting {
+      t.Errorf("bind %d: state = %q, want %q", binds, got, stateConnecting)
+    }
+    if binds == len(uptimes) {
+      cancel()
+      return 0, ctx.Err()
+    }
+    up := uptimes[binds]
+    binds++
+    return up, errors.New("receive: no buffer space available")
+  }
+  var waits []time.Duration
+  h.after = func(d time.Duration) <-chan time.Time {
+    if got := h.Health(); got.State != stateBackoff || got.LastError != "receive: no buffer space available" {
+      t.Errorf("wait %d: health = %+v, want backoff with the last error", len(waits), got)
+    }
+    waits = append(waits, d)
+    ch := make(chan time.Time, 1)
+    ch <- time.Time{}
+    return ch
+  }
+  h.run(ctx)
+
+  s := time.Second
+  want := []time.Duration{1 * s, 2 * s, 4 * s, 8 * s, 16 * s, 30 * s, 30 * s, 1 * s, 2 * s, 4 * s}
+  if !reflect.DeepEqual(waits, want) {
+    t.Fatalf("waits = %v, want %v", waits, want)
+  }
+  health := h.Health()
+  if health.State != stateStopped || health.Reconnects != len(uptimes) {
+    t.Fatalf("health = %+v, want stopped after %d reconnects", health, len(uptimes))
+  }
+  if got := testutil.ToFloat64(m.NFLogReconnects.WithLabelValues("5")) - reconnects; got != float64(len(uptimes)) {
+    t.Fatalf("nflog reconnects metric = %v, want %d", got, len(uptimes))
+  }
+}
+
+func TestWaitIdleReconnect(t *testing.T) {
+  idle := 40 * time.Millisecond
+  h := &Handler{cfg: config.NFLogGroup{IdleReconnect: idle}}
+
+  bound := time.Now()
+  err := h.wait(context.Background(), make(chan error), bound)
+  if err == nil || !strings.Contains(err.Error(), "no packets") {
+    t.Fatalf("silent group: err = %v, want idle rebind", err)
+  }
+  if since := time.Since(bound); since < idle {
+    t.Fatalf("rebound after %s, before idle_reconnect", since)
+  }
+
+  // A group that keeps delivering packets stays bound.
+  ctx, cancel := context.WithTimeout(context.Background(), 4*idle)
+  defer cancel()
+  go func() {
+    tick := time.NewTicker(idle / 8)
+    defer tick.Stop()
+    for {
+      select {
+      case <-ctx.Done():
+        return
+      case now := <-tick.C:
+        h.lastEvent.Store(now.UnixNano())
+      }
+    }
+  }()
+  if err := h.wait(ctx, make(chan error), time.Now()); !errors.Is(err, context.DeadlineExceeded) {
+    t.Fatalf("busy group: err = %v, want it to stay bound until ctx ends", err)
+  }
+
+  errCh := make(chan error, 1)
+  errCh <- errors.New("no buffer space available")
+  if err := h.wait(context.Background(), errCh, time.Now()); err == nil || err.Error() != "receive: no buffer space available" {
+    t.Fatalf("socket error: err = %v", err)
+  }
+}
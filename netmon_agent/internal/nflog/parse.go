@@ -1,4 +1,234 @@
 package nflog
 
-// Placeholder for NFLOG parsing helpers.
-// Parsing is currently handled inline in nflog.go.
+import (
+  "encoding/binary"
+  "errors"
+  "net"
+  "time"
+
+  nflog "github.com/florianl/go-nflog"
+  "github.com/google/gopacket"
+  "github.com/google/gopacket/layers"
+
+  "netmon_agent/internal/event"
+)
+
+const (
+  ethertypeIPv4 = 0x0800
+  ethertypeIPv6 = 0x86dd
+)
+
+var errNotIP = errors.New("payload is not IPv4 or IPv6")
+
+// packetInfo is the subset of a logged packet that ends up on a firewall_drop.
+type packetInfo struct {
+  IPVersion int
+  SrcIP     string
+  DstIP     string
+  SrcPort   int
+  DstPort   int
+  L4Proto   int
+  TCPSyn    bool
+  ICMP      *event.ICMP
+}
+
+// packetMeta is the NFLOG metadata carried alongside the payload.
+type packetMeta struct {
+  SrcMAC    string
+  UID       *int
+  GID       *int
+  Mark      uint32
+  PhysIn    uint32
+  PhysOut   uint32
+  Timestamp time.Time
+}
+
+// decodeMeta reads the optional NFLOG attributes. UID/GID are only present when
+// the packet belongs to a local socket; the MAC is the L2 source on ingress.
+func decodeMeta(m nflog.Msg) packetMeta {
+  var meta packetMeta
+  if hw, ok := m[nflog.AttrHwAddr].([]byte); ok && len(hw) > 0 {
+    meta.SrcMAC = net.HardwareAddr(hw).String()
+  }
+  if uid, ok := m[nflog.AttrUID].(uint32); ok {
+    v := int(uid)
+    meta.UID = &v
+  }
+  if gid, ok := m[nflog.AttrGID].(uint32); ok {
+    v := int(gid)
+    meta.GID = &v
+  }
+  if mark, ok := m[nflog.AttrMark].([]byte); ok && len(mark) >= 4 {
+    meta.Mark = binary.BigEndian.Uint32(mark[:4])
+  }
+  if idx, ok := m[nflog.AttrIfindexPhysIndev].(uint32); ok {
+    meta.PhysIn = idx
+  }
+  if idx, ok := m[nflog.AttrIfindexPhysOutdev].(uint32); ok {
+    meta.PhysOut = idx
+  }
+  if ts, ok := m[nflog.AttrTimestamp].(time.Time); ok && ts.Unix() > 0 {
+    meta.Timestamp = ts.UTC()
+  }
+  return meta
+}
+
+// decodePacket decodes an NFLOG payload, which starts at the network header.
+// hwProto is AttrHwProtocol when the kernel supplied it, else 0; the IP version
+// nibble is used as a fallback.
+func decodePacket(raw []byte, hwProto uint16) (*packetInfo, error) {
+  if len(raw) == 0 {
+    return nil, errNotIP
+  }
+  first := layers.LayerTypeIPv4
+  switch {
+  case hwProto == ethertypeIPv6:
+    first = layers.LayerTypeIPv6
+  case hwProto == ethertypeIPv4:
+  case raw[0]>>4 == 6:
+    first = layers.LayerTypeIPv6
+  case raw[0]>>4 != 4:
+    return nil, errNotIP
+  }
+
+  pkt := gopacket.NewPacket(raw, first, gopacket.Default)
+  info := &packetInfo{}
+  if l := pkt.Layer(layers.LayerTypeIPv4); l != nil {
+    ip := l.(*layers.IPv4)
+    info.IPVersion = 4
+    info.SrcIP = ip.SrcIP.String()
+    info.DstIP = ip.DstIP.String()
+    info.L4Proto = int(ip.Protocol)
+  } else if l := pkt.Layer(layers.LayerTypeIPv6); l != nil {
+    ip := l.(*layers.IPv6)
+    info.IPVersion = 6
+    info.SrcIP = ip.SrcIP.String()
+    info.DstIP = ip.DstIP.String()
+    info.L4Proto = int(ipv6UpperProtocol(pkt, ip))
+  } else {
+    return nil, errNotIP
+  }
+
+  if tcpLayer := pkt.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+    tcp := tcpLayer.(*layers.TCP)
+    info.SrcPort = int(tcp.SrcPort)
+    info.DstPort = int(tcp.DstPort)
+    info.L4Proto = int(layers.IPProtocolTCP)
+    info.TCPSyn = tcp.SYN
+  } else if udpLayer := pkt.Layer(layers.LayerTypeUDP); udpLayer != nil {
+    udp := udpLayer.(*layers.UDP)
+    info.SrcPort = int(udp.SrcPort)
+    info.DstPort = int(udp.DstPort)
+    info.L4Proto = int(layers.IPProtocolUDP)
+  } else if icmpLayer := pkt.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
+    icmp := icmpLayer.(*layers.ICMPv4)
+    typ, code := icmp.TypeCode.Type(), icmp.TypeCode.Code()
+    info.ICMP = &event.ICMP{Type: int(typ), Code: int(code)}
+    switch typ {
+    case layers.ICMPv4TypeEchoRequest, layers.ICMPv4TypeEchoReply:
+      id := int(icmp.Id)
+      info.ICMP.EchoID = &id
+    case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench, layers.ICMPv4TypeRedirect,
+      layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+      info.ICMP.Inner = quotedTuple(icmp.Payload)
+    }
+  } else if icmpLayer := pkt.Layer(layers.LayerTypeICMPv6); icmpLayer != nil {
+    icmp := icmpLayer.(*layers.ICMPv6)
+    typ, code := icmp.TypeCode.Type(), icmp.TypeCode.Code()
+    info.ICMP = &event.ICMP{Type: int(typ), Code: int(code)}
+    switch typ {
+    case layers.ICMPv6TypeEchoRequest, layers.ICMPv6TypeEchoReply:
+      if echo, ok := pkt.Layer(layers.LayerTypeICMPv6Echo).(*layers.ICMPv6Echo); ok {
+        id := int(echo.Identifier)
+        info.ICMP.EchoID = &id
+      }
+    case layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6TypePacketTooBig,
+      layers.ICMPv6TypeTimeExceeded, layers.ICMPv6TypeParameterProblem:
+      // The first 4 bytes are unused/MTU/pointer, then the quoted packet.
+      if len(icmp.Payload) > 4 {
+        info.ICMP.Inner = quotedTuple(icmp.Payload[4:])
+      }
+    }
+  }
+  return info, nil
+}
+
+// quotedTuple extracts the 5-tuple of the packet quoted in an ICMP error. Only
+// the IP header plus the first 8 bytes of transport are guaranteed, so this is
+// parsed by hand rather than through gopacket's full decoders.
+func quotedTuple(b []byte) *event.ICMPInner {
+  if len(b) == 0 {
+    return nil
+  }
+  var inner event.ICMPInner
+  var l4 []byte
+  switch b[0] >> 4 {
+  case 4:
+    ihl := int(b[0]&0x0f) * 4
+    if ihl < 20 || len(b) < ihl {
+      return nil
+    }
+    inner.L4Proto = int(b[9])
+    inner.SrcIP = net.IP(b[12:16]).String()
+    inner.DstIP = net.IP(b[16:20]).String()
+    l4 = b[ihl:]
+  case 6:
+    if len(b) < 40 {
+      return nil
+    }
+    inner.SrcIP = net.IP(b[8:24]).String()
+    inner.DstIP = net.IP(b[24:40]).String()
+    proto := b[6]
+    l4 = b[40:]
+    // Skip the common extension headers; each is 8*(len+1) bytes.
+    for isIPv6Ext(proto) && len(l4) >= 8 {
+      n := 8 * (int(l4[1]) + 1)
+      if proto == byte(layers.IPProtocolIPv6Fragment) {
+        n = 8
+      }
+      if len(l4) < n {
+        break
+      }
+      proto = l4[0]
+      l4 = l4[n:]
+    }
+    inner.L4Proto = int(proto)
+  default:
+    return nil
+  }
+  switch layers.IPProtocol(inner.L4Proto) {
+  case layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolUDPLite, layers.IPProtocolSCTP:
+    if len(l4) >= 4 {
+      inner.SrcPort = int(binary.BigEndian.Uint16(l4[0:2]))
+      inner.DstPort = int(binary.BigEndian.Uint16(l4[2:4]))
+    }
+  }
+  return &inner
+}
+
+func isIPv6Ext(proto byte) bool {
+  switch layers.IPProtocol(proto) {
+  case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Fragment, layers.IPProtocolIPv6Destination:
+    return true
+  }
+  return false
+}
+
+// ipv6UpperProtocol walks the extension header chain and returns the final
+// next-header value, so a SYN behind a hop-by-hop header still reports 6.
+func ipv6UpperProtocol(pkt gopacket.Packet, ip *layers.IPv6) layers.IPProtocol {
+  proto := ip.NextHeader
+  for _, l := range pkt.Layers() {
+    switch ext := l.(type) {
+    case *layers.IPv6HopByHop:
+      proto = ext.NextHeader
+    case *layers.IPv6Routing:
+      proto = ext.NextHeader
+    case *layers.IPv6Fragment:
+      proto = ext.NextHeader
+    case *layers.IPv6Destination:
+      proto = ext.NextHeader
+    }
+  }
+  return proto
+}
@@ -0,0 +1,178 @@
+package nflog
+
+import (
+  "reflect"
+  "testing"
+  "time"
+
+  nflog "github.com/florianl/go-nflog"
+
+  "netmon_agent/internal/event"
+)
+
+func intp(v int) *int { return &v }
+
+// Packet payloads as delivered by NFLOG (network header first).
+var (
+  ipv4TCPSyn = []byte{
+    0x45, 0x00, 0x00, 0x28, 0x00, 0x00, 0x40, 0x00, 0x34, 0x06, 0xe0, 0x90, 0xcb, 0x00, 0x71, 0x09,
+    0xc6, 0x33, 0x64, 0x02, 0xc9, 0x38, 0x00, 0x16, 0x0b, 0xad, 0xca, 0xfe, 0x00, 0x00, 0x00, 0x00,
+    0x50, 0x02, 0xfa, 0xf0, 0xae, 0xb7, 0x00, 0x00,
+  }
+  ipv6TCPSyn = []byte{
+    0x60, 0x00, 0x00, 0x00, 0x00, 0x14, 0x06, 0x3a, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x01, 0x00, 0x00,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09, 0x20, 0x01, 0x0d, 0xb8, 0xff, 0xff, 0x00, 0x00,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xc9, 0x38, 0x00, 0x16, 0x1a, 0x2b, 0x3c, 0x4d,
+    0x00, 0x00, 0x00, 0x00, 0x50, 0x02, 0xfd, 0x20, 0x37, 0x7d, 0x00, 0x00,
+  }
+  // TCP SYN behind a destination options header (PadN).
+  ipv6DstOptsTCPSyn = []byte{
+    0x60, 0x00, 0x00, 0x00, 0x00, 0x1c, 0x3c, 0x3a, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x01, 0x00, 0x00,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09, 0x20, 0x01, 0x0d, 0xb8, 0xff, 0xff, 0x00, 0x00,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x06, 0x00, 0x01, 0x04, 0x00, 0x00, 0x00, 0x00,
+    0xc9, 0x38, 0x00, 0x16, 0x1a, 0x2b, 0x3c, 0x4d, 0x00, 0x00, 0x00, 0x00, 0x50, 0x02, 0xfd, 0x20,
+    0x37, 0x7d, 0x00, 0x00,
+  }
+  // UDP behind a hop-by-hop header carrying a router alert option.
+  ipv6HopByHopUDP = []byte{
+    0x60, 0x00, 0x00, 0x00, 0x00, 0x14, 0x00, 0x01, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x01, 0x00, 0x00,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09, 0x20, 0x01, 0x0d, 0xb8, 0xff, 0xff, 0x00, 0x00,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x11, 0x00, 0x05, 0x02, 0x00, 0x00, 0x01, 0x00,
+    0x14, 0xe9, 0x14, 0xe9, 0x00, 0x0c, 0x7a, 0x86, 0x00, 0x00, 0x00, 0x00,
+  }
+  ipv6ICMPv6Echo = []byte{
+    0x60, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x3a, 0x40, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x01, 0x00, 0x00,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09, 0x20, 0x01, 0x0d, 0xb8, 0xff, 0xff, 0x00, 0x00,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x80, 0x00, 0x33, 0x35, 0x12, 0x34, 0x00, 0x01,
+    0x70, 0x69, 0x6e, 0x67,
+  }
+  ipv4ICMPEcho = []byte{
+    0x45, 0x00, 0x00, 0x24, 0x00, 0x00, 0x00, 0x00, 0x40, 0x01, 0x14, 0x9a, 0xcb, 0x00, 0x71, 0x09,
+    0xc6, 0x33, 0x64, 0x02, 0x08, 0x00, 0x24, 0x25, 0x42, 0x42, 0x00, 0x03, 0x61, 0x62, 0x63, 0x64,
+    0x65, 0x66, 0x67, 0x68,
+  }
+  // Port unreachable quoting a UDP traceroute probe 198.51.100.2:53001 -> 203.0.113.9:33434.
+  ipv4ICMPPortUnreachable = []byte{
+    0x45, 0x00, 0x00, 0x38, 0x00, 0x00, 0x00, 0x00, 0x40, 0x01, 0x14, 0x86, 0xcb, 0x00, 0x71, 0x09,
+    0xc6, 0x33, 0x64, 0x02, 0x03, 0x03, 0x67, 0x60, 0x00, 0x00, 0x00, 0x00, 0x45, 0x00, 0x00, 0x20,
+    0x00, 0x00, 0x00, 0x00, 0x01, 0x11, 0x53, 0x8e, 0xc6, 0x33, 0x64, 0x02, 0xcb, 0x00, 0x71, 0x09,
+    0xcf, 0x09, 0x82, 0x9a, 0x00, 0x0c, 0x43, 0xec,
+  }
+  // Port unreachable quoting TCP 2001:db8:ffff::2:443 -> 2001:db8:1::9:51512.
+  ipv6ICMPv6PortUnreachable = []byte{
+    0x60, 0x00, 0x00, 0x00, 0x00, 0x38, 0x3a, 0x40, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x01, 0x00, 0x00,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09, 0x20, 0x01, 0x0d, 0xb8, 0xff, 0xff, 0x00, 0x00,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x01, 0x04, 0x16, 0x44, 0x00, 0x00, 0x00, 0x00,
+    0x60, 0x00, 0x00, 0x00, 0x00, 0x14, 0x06, 0x40, 0x20, 0x01, 0x0d, 0xb8, 0xff, 0xff, 0x00, 0x00,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x01, 0x00, 0x00,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09, 0x01, 0xbb, 0xc9, 0x38, 0x00, 0x00, 0x00, 0x01,
+  }
+)
+
+func TestDecodePacket(t *testing.T) {
+  tests := []struct {
+    name    string
+    raw     []byte
+    hwProto uint16
+    want    packetInfo
+  }{
+    {
+      name: "ipv4 tcp syn",
+      raw:  ipv4TCPSyn,
+      want: packetInfo{IPVersion: 4, SrcIP: "203.0.113.9", DstIP: "198.51.100.2", SrcPort: 51512, DstPort: 22, L4Proto: 6, TCPSyn: true},
+    },
+    {
+      name:    "ipv4 tcp syn with hw protocol",
+      raw:     ipv4TCPSyn,
+      hwProto: ethertypeIPv4,
+      want:    packetInfo{IPVersion: 4, SrcIP: "203.0.113.9", DstIP: "198.51.100.2", SrcPort: 51512, DstPort: 22, L4Proto: 6, TCPSyn: true},
+    },
+    {
+      name: "ipv6 tcp syn",
+      raw:  ipv6TCPSyn,
+      want: packetInfo{IPVersion: 6, SrcIP: "2001:db8:1::9", DstIP: "2001:db8:ffff::2", SrcPort: 51512, DstPort: 22, L4Proto: 6, TCPSyn: true},
+    },
+    {
+      name:    "ipv6 tcp syn with hw protocol",
+      raw:     ipv6TCPSyn,
+      hwProto: ethertypeIPv6,
+      want:    packetInfo{IPVersion: 6, SrcIP: "2001:db8:1::9", DstIP: "2001:db8:ffff::2", SrcPort: 51512, DstPort: 22, L4Proto: 6, TCPSyn: true},
+    },
+    {
+      name: "ipv6 destination options then tcp",
+      raw:  ipv6DstOptsTCPSyn,
+      want: packetInfo{IPVersion: 6, SrcIP: "2001:db8:1::9", DstIP: "2001:db8:ffff::2", SrcPort: 51512, DstPort: 22, L4Proto: 6, TCPSyn: true},
+    },
+    {
+      name: "ipv6 hop-by-hop then udp",
+      raw:  ipv6HopByHopUDP,
+      want: packetInfo{IPVersion: 6, SrcIP: "2001:db8:1::9", DstIP: "2001:db8:ffff::2", SrcPort: 5353, DstPort: 5353, L4Proto: 17},
+    },
+    {
+      name: "icmpv6 echo request",
+      raw:  ipv6ICMPv6Echo,
+      want: packetInfo{IPVersion: 6, SrcIP: "2001:db8:1::9", DstIP: "2001:db8:ffff::2", L4Proto: 58,
+        ICMP: &event.ICMP{Type: 128, Code: 0, EchoID: intp(0x1234)}},
+    },
+    {
+      name: "icmp echo request",
+      raw:  ipv4ICMPEcho,
+      want: packetInfo{IPVersion: 4, SrcIP: "203.0.113.9", DstIP: "198.51.100.2", L4Proto: 1,
+        ICMP: &event.ICMP{Type: 8, Code: 0, EchoID: intp(0x4242)}},
+    },
+    {
+      name: "icmp port unreachable",
+      raw:  ipv4ICMPPortUnreachable,
+      want: packetInfo{IPVersion: 4, SrcIP: "203.0.113.9", DstIP: "198.51.100.2", L4Proto: 1,
+        ICMP: &event.ICMP{Type: 3, Code: 3, Inner: &event.ICMPInner{SrcIP: "198.51.100.2", DstIP: "203.0.113.9", SrcPort: 53001, DstPort: 33434, L4Proto: 17}}},
+    },
+    {
+      name: "icmpv6 port unreachable",
+      raw:  ipv6ICMPv6PortUnreachable,
+      want: packetInfo{IPVersion: 6, SrcIP: "2001:db8:1::9", DstIP: "2001:db8:ffff::2", L4Proto: 58,
+        ICMP: &event.ICMP{Type: 1, Code: 4, Inner: &event.ICMPInner{SrcIP: "2001:db8:ffff::2", DstIP: "2001:db8:1::9", SrcPort: 443, DstPort: 51512, L4Proto: 6}}},
+    },
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      got, err := decodePacket(tt.raw, tt.hwProto)
+      if err != nil {
+        t.Fatalf("decodePacket: %v", err)
+      }
+      if !reflect.DeepEqual(*got, tt.want) {
+        t.Fatalf("got %+v (icmp %+v)\nwant %+v (icmp %+v)", *got, got.ICMP, tt.want, tt.want.ICMP)
+      }
+    })
+  }
+}
+
+func TestDecodePacketNotIP(t *testing.T) {
+  for _, raw := range [][]byte{nil, {0x00, 0x01, 0x02}, {0x20, 0x00}} {
+    if _, err := decodePacket(raw, 0); err == nil {
+      t.Fatalf("expected error for %x", raw)
+    }
+  }
+}
+
+func TestDecodeMeta(t *testing.T) {
+  ts := time.Date(2026, 2, 20, 14, 21, 33, 123000000, time.UTC)
+  meta := decodeMeta(nflog.Msg{
+    nflog.AttrHwAddr:            []byte{0x3c, 0x22, 0xfb, 0x01, 0x02, 0x03},
+    nflog.AttrUID:               uint32(1000),
+    nflog.AttrGID:               uint32(100),
+    nflog.AttrMark:              []byte{0x00, 0x00, 0x01, 0x2c},
+    nflog.AttrIfindexPhysIndev:  uint32(4),
+    nflog.AttrIfindexPhysOutdev: uint32(5),
+    nflog.AttrTimestamp:         ts.Local(),
+  })
+  want := packetMeta{SrcMAC: "3c:22:fb:01:02:03", UID: intp(1000), GID: intp(100), Mark: 300, PhysIn: 4, PhysOut: 5, Timestamp: ts}
+  if !reflect.DeepEqual(meta, want) {
+    t.Fatalf("got %+v\nwant %+v", meta, want)
+  }
+
+  empty := decodeMeta(nflog.Msg{nflog.AttrTimestamp: time.Unix(0, 0)})
+  if !reflect.DeepEqual(empty, packetMeta{}) {
+    t.Fatalf("expected empty meta, got %+v", empty)
+  }
+}
@@ -0,0 +1,130 @@
+package sink
+
+import (
+  "bufio"
+  "fmt"
+  "os"
+  "path/filepath"
+
+  "netmon_agent/internal/event"
+  "netmon_agent/internal/metrics"
+)
+
+// NewFile returns a sink appending events as JSON lines to path. Once the
+// file would grow past maxBytes it is renamed to path.1, older files move up
+// one number and path.<maxFiles> is removed.
+func NewFile(name, path string, maxBytes int64, maxFiles int, routerID string, queueDepth int, m *metrics.Metrics) Sink {
+  return newQueued(name, &fileWriter{path: path, maxBytes: maxBytes, maxFiles: maxFiles, routerID: routerID}, queueDepth, m)
+}
+
+// NewStdout returns a sink writing events as JSON lines to stdout, for
+// journalctl or a pipe.
+func NewStdout(name, routerID string, queueDepth int, m *metrics.Metrics) Sink {
+  return newQueued(name, &streamWriter{w: bufio.NewWriter(os.Stdout), routerID: routerID}, queueDepth, m)
+}
+
+type streamWriter struct {
+  w        *bufio.Writer
+  routerID string
+}
+
+func (s *streamWriter) WriteEvent(ev event.Event) error {
+  line, err := marshalRecord(s.routerID, ev)
+  if err != nil {
+    return err
+  }
+  _, err = s.w.Write(append(line, '\n'))
+  return err
+}
+
+func (s *streamWriter) Flush() error {
+  return s.w.Flush()
+}
+
+func (s *streamWriter) Close() error {
+  return s.w.Flush()
+}
+
+type fileWriter struct {
+  path     string
+  maxBytes int64
+  maxFiles int
+  routerID string
+
+  f    *os.File
+  w    *bufio.Writer
+  size int64
+}
+
+func (f *fileWriter) WriteEvent(ev event.Event) error {
+  line, err := marshalRecord(f.routerID, ev)
+  if err != nil {
+    return err
+  }
+  line = append(line, '\n')
+  if f.f != nil && f.maxBytes > 0 && f.size > 0 && f.size+int64(len(line)) > f.maxBytes {
+    if err := f.rotate(); err != nil {
+      return err
+    }
+  }
+  if f.f == nil {
+    if err := f.open(); err != nil {
+      return err
+    }
+  }
+  n, err := f.w.Write(line)
+  f.size += int64(n)
+  return err
+}
+
+func (f *fileWriter) open() error {
+  if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+    return err
+  }
+  file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+  if err != nil {
+    return err
+  }
+  stat, err := file.Stat()
+  if err != nil {
+    file.Close()
+    return err
+  }
+  f.f, f.w, f.size = file, bufio.NewWriter(file), stat.Size()
+  return nil
+}
+
+// rotate closes the current file and shifts the numbered ones. The next
+// write opens a new file.
+func (f *fileWriter) rotate() error {
+  if err := f.Close(); err != nil {
+    return err
+  }
+  if f.maxFiles <= 0 {
+    return os.Remove(f.path)
+  }
+  _ = os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+  for i := f.maxFiles - 1; i >= 1; i-- {
+    _ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+  }
+  return os.Rename(f.path, f.path+".1")
+}
+
+func (f *fileWriter) Flush() error {
+  if f.w == nil {
+    return nil
+  }
+  return f.w.Flush()
+}
+
+func (f *fileWriter) Close() error {
+  if f.f == nil {
+    return nil
+  }
+  err := f.w.Flush()
+  if cerr := f.f.Close(); err == nil {
+    err = cerr
+  }
+  f.f, f.w = nil, nil
+  return err
+}
@@ -0,0 +1,88 @@
+package sink
+
+import (
+  "bufio"
+  "encoding/json"
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+  "time"
+
+  "netmon_agent/internal/event"
+)
+
+func readLines(t *testing.T, path string) []string {
+  t.Helper()
+  f, err := os.Open(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer f.Close()
+  var lines []string
+  sc := bufio.NewScanner(f)
+  for sc.Scan() {
+    lines = append(lines, sc.Text())
+  }
+  return lines
+}
+
+func TestFileWriterRecords(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "events", "events.ndjson")
+  w := &fileWriter{path: path, maxBytes: 1 << 20, maxFiles: 2, routerID: "router-01"}
+  ev := event.Event{ID: "router-01:7", Type: "flow", TS: time.Date(2026, 3, 8, 14, 20, 0, 0, time.UTC), Data: map[string]int{"dst_port": 443}}
+  if err := w.WriteEvent(ev); err != nil {
+    t.Fatal(err)
+  }
+  if err := w.Close(); err != nil {
+    t.Fatal(err)
+  }
+  lines := readLines(t, path)
+  want := `{"router_id":"router-01","id":"router-01:7","type":"flow","ts":"2026-03-08T14:20:00Z","data":{"dst_port":443}}`
+  if len(lines) != 1 || lines[0] != want {
+    t.Fatalf("got %q\nwant %q", lines, want)
+  }
+}
+
+func TestFileWriterRotates(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "events.ndjson")
+  // Each line is 77 bytes, so a file holds two.
+  w := &fileWriter{path: path, maxBytes: 200, maxFiles: 2, routerID: "router-01"}
+  for i := 0; i < 7; i++ {
+    if err := w.WriteEvent(event.Event{Type: "flow", Data: i}); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := w.Close(); err != nil {
+    t.Fatal(err)
+  }
+
+  var data []int
+  for _, p := range []string{path + ".2", path + ".1", path} {
+    for _, line := range readLines(t, p) {
+      var r struct{ Data int }
+      if err := json.Unmarshal([]byte(line), &r); err != nil {
+        t.Fatal(err)
+      }
+      data = append(data, r.Data)
+    }
+  }
+  if want := []int{2, 3, 4, 5, 6}; !reflect.DeepEqual(data, want) {
+    t.Fatalf("kept events %v, want %v", data, want)
+  }
+  if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+    t.Fatalf("%s.3 exists", path)
+  }
+
+  // A restarted writer appends to the current file and counts what is in it.
+  w = &fileWriter{path: path, maxBytes: 200, maxFiles: 2, routerID: "router-01"}
+  for i := 7; i < 9; i++ {
+    if err := w.WriteEvent(event.Event{Type: "flow", Data: i}); err != nil {
+      t.Fatal(err)
+    }
+  }
+  w.Close()
+  if a, b := len(readLines(t, path+".1")), len(readLines(t, path)); a != 2 || b != 1 {
+    t.Fatalf("after restart: %d and %d lines, want 2 and 1", a, b)
+  }
+}
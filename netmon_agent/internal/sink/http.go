@@ -0,0 +1,46 @@
+package sink
+
+import (
+  "context"
+
+  "netmon_agent/internal/event"
+  "netmon_agent/internal/httpclient"
+)
+
+// HTTP adapts the batching upload client, which keeps its own queues, spool
+// and retries. Heartbeats take its priority queue so a flow backlog cannot
+// delay them.
+type HTTP struct {
+  name     string
+  client   *httpclient.Client
+  routerID string
+}
+
+func NewHTTP(name string, client *httpclient.Client, routerID string) *HTTP {
+  return &HTTP{name: name, client: client, routerID: routerID}
+}
+
+func (h *HTTP) Name() string {
+  return h.name
+}
+
+func (h *HTTP) Start(ctx context.Context) {
+  h.client.Start(ctx, h.routerID)
+}
+
+func (h *HTTP) Ingest(ev event.Event) bool {
+  if ev.Type == "heartbeat" {
+    return h.client.IngestPriority(ev)
+  }
+  return h.client.Ingest(ev)
+}
+
+func (h *HTTP) QueueDepth() int {
+  return h.client.QueueDepth() + h.client.PriorityDepth()
+}
+
+// Wait blocks until the upload client has spooled its pending batch and
+// queues.
+func (h *HTTP) Wait() {
+  h.client.Wait()
+}
@@ -0,0 +1,211 @@
+package sink
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "log"
+  "sync"
+  "time"
+
+  "netmon_agent/internal/event"
+  "netmon_agent/internal/metrics"
+)
+
+// Sink is an event output. Ingest must not block: a sink queues events and
+// delivers them from its own goroutines, started by Start.
+type Sink interface {
+  Name() string
+  Start(ctx context.Context)
+  // Ingest queues an event and reports false if the queue was full.
+  Ingest(ev event.Event) bool
+  QueueDepth() int
+  // Wait blocks until the sink has stopped after its ctx was cancelled.
+  Wait()
+}
+
+// Fanout hands every event to each sink that takes its type.
+type Fanout struct {
+  metrics *metrics.Metrics
+  routes  []route
+}
+
+type route struct {
+  sink  Sink
+  types map[string]bool // nil takes all types
+}
+
+func NewFanout(m *metrics.Metrics) *Fanout {
+  return &Fanout{metrics: m}
+}
+
+// Add registers a sink for the given event types, or all if types is empty.
+// Add must not be called once events are sent.
+func (f *Fanout) Add(s Sink, types []string) {
+  r := route{sink: s}
+  if len(types) > 0 {
+    r.types = make(map[string]bool, len(types))
+    for _, t := range types {
+      r.types[t] = true
+    }
+  }
+  f.routes = append(f.routes, r)
+}
+
+// Send queues ev on every matching sink. It is safe for concurrent use.
+func (f *Fanout) Send(ev event.Event) {
+  for _, r := range f.routes {
+    if r.types != nil && !r.types[ev.Type] {
+      continue
+    }
+    result := "queued"
+    if !r.sink.Ingest(ev) {
+      result = "dropped"
+      log.Printf("sink %s: queue full; dropped event type=%s", r.sink.Name(), ev.Type)
+    }
+    if f.metrics != nil {
+      f.metrics.SinkEvents.WithLabelValues(r.sink.Name(), result).Inc()
+    }
+  }
+}
+
+// record is an event as written by the file, stdout and syslog sinks, which
+// have no batch envelope to carry the router.
+type record struct {
+  RouterID string `json:"router_id"`
+  event.Event
+}
+
+func marshalRecord(routerID string, ev event.Event) ([]byte, error) {
+  return json.Marshal(record{RouterID: routerID, Event: ev})
+}
+
+// errTooLarge is returned by an eventWriter for an event its transport cannot
+// carry. The event is dropped and counted apart from write errors.
+var errTooLarge = errors.New("message too large")
+
+// eventWriter is the synchronous part of a queued sink. Flush is called when
+// the queue runs empty, Close when the sink stops.
+type eventWriter interface {
+  WriteEvent(ev event.Event) error
+  Flush() error
+  Close() error
+}
+
+// queued runs an eventWriter behind its own bounded queue.
+type queued struct {
+  name    string
+  w       eventWriter
+  queue   chan event.Event
+  metrics *metrics.Metrics
+  done    chan struct{}
+
+  mu      sync.Mutex
+  lastLog time.Time
+}
+
+func newQueued(name string, w eventWriter, depth int, m *metrics.Metrics) *queued {
+  if depth <= 0 {
+    depth = 1
+  }
+  return &queued{name: name, w: w, queue: make(chan event.Event, depth), metrics: m, done: make(chan struct{})}
+}
+
+func (q *queued) Name() string {
+  return q.name
+}
+
+func (q *queued) Ingest(ev event.Event) bool {
+  select {
+  case q.queue <- ev:
+    return true
+  default:
+    return false
+  }
+}
+
+func (q *queued) QueueDepth() int {
+  return len(q.queue)
+}
+
+func (q *queued) Start(ctx context.Context) {
+  go q.run(ctx)
+}
+
+func (q *queued) Wait() {
+  <-q.done
+}
+
+func (q *queued) run(ctx context.Context) {
+  defer close(q.done)
+  defer func() {
+    if err := q.w.Close(); err != nil {
+      log.Printf("sink %s: close: %v", q.name, err)
+    }
+  }()
+  for {
+    select {
+    case <-ctx.Done():
+      q.drain()
+      return
+    case ev := <-q.queue:
+      // select may pick the queue over a stop that already happened; a
+      // failed write then ends the drain just as it would in drain.
+      if !q.write(ev) && ctx.Err() != nil {
+        return
+      }
+      if len(q.queue) == 0 {
+        if err := q.w.Flush(); err != nil {
+          q.fail(err)
+        }
+      }
+    }
+  }
+}
+
+// drain writes what is still queued when the sink stops. A write error ends
+// it, since the rest would most likely fail the same way.
+func (q *queued) drain() {
+  for {
+    select {
+    case ev := <-q.queue:
+      if !q.write(ev) {
+        return
+      }
+    default:
+      if err := q.w.Flush(); err != nil {
+        q.fail(err)
+      }
+      return
+    }
+  }
+}
+
+// write writes one event and reports false on a write error. An event too
+// large for the transport is dropped and does not count as one.
+func (q *queued) write(ev event.Event) bool {
+  err := q.w.WriteEvent(ev)
+  if err == nil {
+    return true
+  }
+  q.fail(err)
+  return errors.Is(err, errTooLarge)
+}
+
+// fail counts a write error, or an oversized event, and logs at most one a
+// minute.
+func (q *queued) fail(err error) {
+  if q.metrics != nil {
+    if errors.Is(err, errTooLarge) {
+      q.metrics.SinkOversized.WithLabelValues(q.name).Inc()
+    } else {
+      q.metrics.SinkWriteErrors.WithLabelValues(q.name).Inc()
+    }
+  }
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if time.Since(q.lastLog) >= time.Minute {
+    q.lastLog = time.Now()
+    log.Printf("sink %s: %v", q.name, err)
+  }
+}
@@ -0,0 +1,200 @@
+package sink
+
+import (
+  "context"
+  "errors"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/prometheus/client_golang/prometheus/testutil"
+
+  "netmon_agent/internal/event"
+  "netmon_agent/internal/metrics"
+)
+
+var (
+  testMetricsOnce sync.Once
+  testMetrics     *metrics.Metrics
+)
+
+func getMetrics() *metrics.Metrics {
+  testMetricsOnce.Do(func() { testMetrics = metrics.New() })
+  return testMetrics
+}
+
+// memWriter records events; block, if set, holds writes until closed. Events
+// of type tooLarge are refused with errTooLarge.
+type memWriter struct {
+  mu       sync.Mutex
+  events   []event.Event
+  flushes  int
+  closed   bool
+  block    chan struct{}
+  tooLarge string
+}
+
+func (w *memWriter) WriteEvent(ev event.Event) error {
+  if w.block != nil {
+    <-w.block
+  }
+  if w.tooLarge != "" && ev.Type == w.tooLarge {
+    return errTooLarge
+  }
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.events = append(w.events, ev)
+  return nil
+}
+
+func (w *memWriter) Flush() error {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.flushes++
+  return nil
+}
+
+func (w *memWriter) Close() error {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.closed = true
+  return nil
+}
+
+func (w *memWriter) types() []string {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  var out []string
+  for _, ev := range w.events {
+    out = append(out, ev.Type)
+  }
+  return out
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+  t.Helper()
+  deadline := time.Now().Add(2 * time.Second)
+  for !cond() {
+    if time.Now().After(deadline) {
+      t.Fatal("timed out")
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
+
+func TestFanoutFiltersByType(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  all, drops := &memWriter{}, &memWriter{}
+  f := NewFanout(getMetrics())
+  for _, r := range []struct {
+    sink  *queued
+    types []string
+  }{
+    {newQueued("all", all, 10, getMetrics()), nil},
+    {newQueued("drops", drops, 10, getMetrics()), []string{"firewall_drop"}},
+  } {
+    r.sink.Start(ctx)
+    f.Add(r.sink, r.types)
+  }
+
+  for _, typ := range []string{"flow", "firewall_drop", "heartbeat"} {
+    f.Send(event.Event{Type: typ})
+  }
+  waitFor(t, func() bool { return len(all.types()) == 3 && len(drops.types()) == 1 })
+  if got := drops.types(); got[0] != "firewall_drop" {
+    t.Fatalf("drops sink got %v", got)
+  }
+}
+
+func TestFanoutCountsDrops(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  m := getMetrics()
+  stuck, ok := &memWriter{block: make(chan struct{})}, &memWriter{}
+  f := NewFanout(m)
+  for _, s := range []*queued{newQueued("stuck", stuck, 2, m), newQueued("ok", ok, 10, m)} {
+    s.Start(ctx)
+    f.Add(s, nil)
+  }
+
+  // stuck holds one event in WriteEvent and two in its queue; a slow sink
+  // costs only its own events.
+  dropped := func(name string) float64 {
+    return testutil.ToFloat64(m.SinkEvents.WithLabelValues(name, "dropped"))
+  }
+  stuckBefore, okBefore := dropped("stuck"), dropped("ok")
+  f.Send(event.Event{Type: "flow"})
+  waitFor(t, func() bool { return f.routes[0].sink.QueueDepth() == 0 })
+  for i := 0; i < 4; i++ {
+    f.Send(event.Event{Type: "flow"})
+  }
+  if d := dropped("stuck") - stuckBefore; d != 2 {
+    t.Fatalf("stuck dropped %v, want 2", d)
+  }
+  if d := dropped("ok") - okBefore; d != 0 {
+    t.Fatalf("ok dropped %v, want 0", d)
+  }
+  waitFor(t, func() bool { return len(ok.types()) == 5 })
+  close(stuck.block)
+  waitFor(t, func() bool { return len(stuck.types()) == 3 })
+}
+
+func TestQueuedDrainsOnStop(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  m := getMetrics()
+  w := &memWriter{block: make(chan struct{}), tooLarge: "flow_table"}
+  q := newQueued("drain", w, 10, m)
+  q.Start(ctx)
+  oversized := testutil.ToFloat64(m.SinkOversized.WithLabelValues("drain"))
+  writeErrors := testutil.ToFloat64(m.SinkWriteErrors.WithLabelValues("drain"))
+
+  // One event is held in WriteEvent, the rest wait in the queue when the
+  // sink is stopped.
+  for _, typ := range []string{"flow", "flow", "flow_table", "dns_anomaly"} {
+    if !q.Ingest(event.Event{Type: typ}) {
+      t.Fatal("queue full")
+    }
+  }
+  waitFor(t, func() bool { return q.QueueDepth() == 3 })
+  cancel()
+  close(w.block)
+  q.Wait()
+
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  if len(w.events) != 3 || w.flushes == 0 || !w.closed {
+    t.Fatalf("wrote %d events, %d flushes, closed %v; want 3 written, flushed and closed", len(w.events), w.flushes, w.closed)
+  }
+  if got := testutil.ToFloat64(m.SinkOversized.WithLabelValues("drain")) - oversized; got != 1 {
+    t.Fatalf("oversized = %v, want 1", got)
+  }
+  if got := testutil.ToFloat64(m.SinkWriteErrors.WithLabelValues("drain")) - writeErrors; got != 0 {
+    t.Fatalf("write errors = %v, want 0", got)
+  }
+}
+
+// failWriter fails every write.
+type failWriter struct{ writes int }
+
+func (w *failWriter) WriteEvent(event.Event) error {
+  w.writes++
+  return errors.New("connection refused")
+}
+func (w *failWriter) Flush() error { return nil }
+func (w *failWriter) Close() error { return nil }
+
+func TestQueuedDrainStopsOnError(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  w := &failWriter{}
+  q := newQueued("failing", w, 10, getMetrics())
+  for i := 0; i < 5; i++ {
+    q.Ingest(event.Event{Type: "flow"})
+  }
+  q.Start(ctx)
+  q.Wait()
+  if w.writes != 1 {
+    t.Fatalf("drain tried %d writes after an error, want 1", w.writes)
+  }
+}
@@ -0,0 +1,117 @@
+package sink
+
+import (
+  "fmt"
+  "net"
+  "os"
+  "strings"
+  "time"
+
+  "netmon_agent/internal/event"
+  "netmon_agent/internal/metrics"
+)
+
+const (
+  syslogAppName = "netmon-agent"
+  syslogTimeout = 5 * time.Second
+  // syslogMaxUDP is the largest UDP payload over IPv4. Larger messages,
+  // typically flow_table chunks, cannot be sent as one datagram.
+  syslogMaxUDP = 65507
+
+  severityWarning = 4
+  severityInfo    = 6
+)
+
+// NewSyslog returns a sink sending each event as an RFC 5424 message over
+// udp or tcp. The message is the event as JSON, MSGID its type and HOSTNAME
+// the router ID. TCP uses octet-counting framing (RFC 6587) and reconnects
+// after an error; the event being written is lost. Over UDP, events that do
+// not fit in one datagram are dropped.
+func NewSyslog(name, network, address string, facility int, routerID string, queueDepth int, m *metrics.Metrics) Sink {
+  w := &syslogWriter{network: network, address: address, facility: facility, routerID: routerID, pid: os.Getpid()}
+  return newQueued(name, w, queueDepth, m)
+}
+
+type syslogWriter struct {
+  network  string
+  address  string
+  facility int
+  routerID string
+  pid      int
+
+  conn net.Conn
+}
+
+func (s *syslogWriter) WriteEvent(ev event.Event) error {
+  msg, err := s.format(ev)
+  if err != nil {
+    return err
+  }
+  if s.network == "udp" && len(msg) > syslogMaxUDP {
+    return fmt.Errorf("%w: %s event of %d bytes over udp", errTooLarge, ev.Type, len(msg))
+  }
+  if s.conn == nil {
+    conn, err := net.DialTimeout(s.network, s.address, syslogTimeout)
+    if err != nil {
+      return err
+    }
+    s.conn = conn
+  }
+  if s.network == "tcp" {
+    msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+  }
+  _ = s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+  if _, err := s.conn.Write(msg); err != nil {
+    s.Close()
+    return err
+  }
+  return nil
+}
+
+func (s *syslogWriter) format(ev event.Event) ([]byte, error) {
+  body, err := marshalRecord(s.routerID, ev)
+  if err != nil {
+    return nil, err
+  }
+  severity := severityInfo
+  if ev.Type == "dns_anomaly" {
+    severity = severityWarning
+  }
+  ts := "-"
+  if !ev.TS.IsZero() {
+    ts = ev.TS.UTC().Format("2006-01-02T15:04:05.000000Z07:00")
+  }
+  header := fmt.Sprintf("<%d>1 %s %s %s %d %s - ", s.facility*8+severity, ts, headerField(s.routerID, 255), syslogAppName, s.pid, headerField(ev.Type, 32))
+  return append([]byte(header), body...), nil
+}
+
+func (s *syslogWriter) Flush() error {
+  return nil
+}
+
+func (s *syslogWriter) Close() error {
+  if s.conn == nil {
+    return nil
+  }
+  err := s.conn.Close()
+  s.conn = nil
+  return err
+}
+
+// headerField makes v a valid RFC 5424 header field: printable ASCII without
+// spaces, at most max bytes, "-" if empty.
+func headerField(v string, max int) string {
+  v = strings.Map(func(r rune) rune {
+    if r < 33 || r > 126 {
+      return '_'
+    }
+    return r
+  }, v)
+  if len(v) > max {
+    v = v[:max]
+  }
+  if v == "" {
+    return "-"
+  }
+  return v
+}
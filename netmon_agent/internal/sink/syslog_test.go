@@ -0,0 +1,162 @@
+package sink
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "reflect"
+  "sort"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+
+  "netmon_agent/internal/event"
+)
+
+var syslogEvents = []event.Event{
+  {ID: "router-01:1", Type: "flow", TS: time.Date(2026, 3, 8, 14, 20, 0, 123456000, time.UTC), Data: map[string]int{"dst_port": 443}},
+  {ID: "router-01:2", Type: "dns_anomaly", TS: time.Date(2026, 3, 8, 14, 21, 0, 0, time.UTC), Data: map[string]string{"kind": "dga"}},
+}
+
+func syslogWant(pid int) []string {
+  return []string{
+    fmt.Sprintf(`<134>1 2026-03-08T14:20:00.123456Z router-01 netmon-agent %d flow - {"router_id":"router-01","id":"router-01:1","type":"flow","ts":"2026-03-08T14:20:00.123456Z","data":{"dst_port":443}}`, pid),
+    fmt.Sprintf(`<132>1 2026-03-08T14:21:00.000000Z router-01 netmon-agent %d dns_anomaly - {"router_id":"router-01","id":"router-01:2","type":"dns_anomaly","ts":"2026-03-08T14:21:00Z","data":{"kind":"dga"}}`, pid),
+  }
+}
+
+func TestSyslogUDP(t *testing.T) {
+  pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pc.Close()
+  w := &syslogWriter{network: "udp", address: pc.LocalAddr().String(), facility: 16, routerID: "router-01", pid: 42}
+  defer w.Close()
+  for _, ev := range syslogEvents {
+    if err := w.WriteEvent(ev); err != nil {
+      t.Fatal(err)
+    }
+  }
+  buf := make([]byte, 4096)
+  for i, want := range syslogWant(42) {
+    _ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+    n, _, err := pc.ReadFrom(buf)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if got := string(buf[:n]); got != want {
+      t.Fatalf("message %d:\ngot  %s\nwant %s", i, got, want)
+    }
+  }
+}
+
+func TestSyslogUDPOversized(t *testing.T) {
+  pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pc.Close()
+  w := &syslogWriter{network: "udp", address: pc.LocalAddr().String(), facility: 16, routerID: "router-01", pid: 42}
+  defer w.Close()
+
+  big := event.Event{ID: "router-01:3", Type: "flow_table", Data: map[string]string{"flows": strings.Repeat("x", syslogMaxUDP)}}
+  if err := w.WriteEvent(big); !errors.Is(err, errTooLarge) {
+    t.Fatalf("oversized event: err = %v", err)
+  }
+  // The next event still goes out.
+  if err := w.WriteEvent(syslogEvents[0]); err != nil {
+    t.Fatal(err)
+  }
+  buf := make([]byte, 4096)
+  _ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+  n, _, err := pc.ReadFrom(buf)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if got, want := string(buf[:n]), syslogWant(42)[0]; got != want {
+    t.Fatalf("got  %s\nwant %s", got, want)
+  }
+}
+
+func TestSyslogTCPFramingAndReconnect(t *testing.T) {
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer ln.Close()
+  got := make(chan string, 10)
+  go func() {
+    for {
+      conn, err := ln.Accept()
+      if err != nil {
+        return
+      }
+      go func(conn net.Conn) {
+        defer conn.Close()
+        r := bufio.NewReader(conn)
+        for {
+          size, err := r.ReadString(' ')
+          if err != nil {
+            return
+          }
+          n, _ := strconv.Atoi(strings.TrimSpace(size))
+          msg := make([]byte, n)
+          if _, err := io.ReadFull(r, msg); err != nil {
+            return
+          }
+          got <- string(msg)
+        }
+      }(conn)
+    }
+  }()
+
+  w := &syslogWriter{network: "tcp", address: ln.Addr().String(), facility: 16, routerID: "router-01", pid: 42}
+  defer w.Close()
+  want := syslogWant(42)
+  if err := w.WriteEvent(syslogEvents[0]); err != nil {
+    t.Fatal(err)
+  }
+  // A dropped connection is redialed for the next event.
+  w.conn.Close()
+  if err := w.WriteEvent(syslogEvents[1]); err == nil {
+    t.Fatal("write on closed connection succeeded")
+  }
+  if err := w.WriteEvent(syslogEvents[1]); err != nil {
+    t.Fatal(err)
+  }
+  // The two connections are read concurrently, in no particular order.
+  var msgs []string
+  for range want {
+    select {
+    case msg := <-got:
+      msgs = append(msgs, msg)
+    case <-time.After(2 * time.Second):
+      t.Fatalf("got %d of %d messages", len(msgs), len(want))
+    }
+  }
+  sort.Strings(msgs)
+  sort.Strings(want)
+  if !reflect.DeepEqual(msgs, want) {
+    t.Fatalf("got  %q\nwant %q", msgs, want)
+  }
+}
+
+func TestHeaderField(t *testing.T) {
+  for in, want := range map[string]string{
+    "":             "-",
+    "router 01":    "router_01",
+    "röuter":       "r_uter",
+    "flow_snapshot": "flow_snapshot",
+  } {
+    if got := headerField(in, 32); got != want {
+      t.Errorf("headerField(%q) = %q, want %q", in, got, want)
+    }
+  }
+  if got := headerField(strings.Repeat("a", 40), 32); len(got) != 32 {
+    t.Errorf("not truncated: %q", got)
+  }
+}
@@ -10,20 +10,38 @@ import (
   "strings"
   "sync"
   "time"
+
+  "netmon_agent/internal/metrics"
+  "netmon_agent/internal/util"
 )
 
 type Spool struct {
   dir     string
   maxBytes int64
+  encoding string
+  metrics *metrics.Metrics
   mu      sync.Mutex
 }
 
+// spoolExt maps a content coding to its batch file suffix. Files are read
+// back by suffix, so changing spool_compression keeps older files readable.
+var spoolExt = map[string]string{
+  util.EncodingIdentity: ".json",
+  util.EncodingGzip:     ".json.gz",
+  util.EncodingZstd:     ".json.zst",
+}
+
 type Batch struct {
   Payload json.RawMessage
 }
 
-func New(dir string, maxBytes int64) *Spool {
-  return &Spool{dir: dir, maxBytes: maxBytes}
+// New returns a spool in dir that compresses batches with encoding
+// (identity, gzip or zstd).
+func New(dir string, maxBytes int64, encoding string, metrics *metrics.Metrics) *Spool {
+  if _, ok := spoolExt[encoding]; !ok {
+    encoding = util.EncodingIdentity
+  }
+  return &Spool{dir: dir, maxBytes: maxBytes, encoding: encoding, metrics: metrics}
 }
 
 func (s *Spool) Ensure() error {
@@ -34,16 +52,26 @@ func (s *Spool) Enqueue(batch []byte) error {
   if len(batch) == 0 {
     return nil
   }
+  encoding := s.encoding
+  data, err := util.Encode(encoding, batch)
+  if err != nil {
+    encoding, data = util.EncodingIdentity, batch
+  }
+  if s.metrics != nil {
+    s.metrics.PayloadBytes.WithLabelValues("spool", "raw").Add(float64(len(batch)))
+    s.metrics.PayloadBytes.WithLabelValues("spool", "encoded").Add(float64(len(data)))
+  }
+
   s.mu.Lock()
   defer s.mu.Unlock()
 
-  if err := s.ensureCap(int64(len(batch))); err != nil {
+  if err := s.ensureCap(int64(len(data))); err != nil {
     return err
   }
 
-  name := fmt.Sprintf("batch_%d.json", time.Now().UnixNano())
+  name := fmt.Sprintf("batch_%d%s", time.Now().UnixNano(), spoolExt[encoding])
   path := filepath.Join(s.dir, name)
-  return os.WriteFile(path, batch, 0o600)
+  return os.WriteFile(path, data, 0o600)
 }
 
 func (s *Spool) DequeueOldest() (string, []byte, error) {
@@ -71,9 +99,23 @@ func (s *Spool) DequeueOldest() (string, []byte, error) {
   if err != nil {
     return "", nil, err
   }
+  data, err = util.Decode(fileEncoding(oldest), data)
+  if err != nil {
+    return path, nil, fmt.Errorf("%s: %w", oldest, err)
+  }
   return path, data, nil
 }
 
+func fileEncoding(name string) string {
+  switch {
+  case strings.HasSuffix(name, spoolExt[util.EncodingGzip]):
+    return util.EncodingGzip
+  case strings.HasSuffix(name, spoolExt[util.EncodingZstd]):
+    return util.EncodingZstd
+  }
+  return util.EncodingIdentity
+}
+
 func (s *Spool) Ack(path string) error {
   return os.Remove(path)
 }
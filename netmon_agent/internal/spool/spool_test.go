@@ -0,0 +1,68 @@
+package spool
+
+import (
+  "bytes"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestSpoolCompression(t *testing.T) {
+  payload := bytes.Repeat([]byte(`{"type":"flow","data":{"src_ip":"10.0.0.20","dst_port":443}},`), 200)
+  for _, tt := range []struct {
+    encoding string
+    ext      string
+  }{
+    {"identity", ".json"},
+    {"gzip", ".json.gz"},
+    {"zstd", ".json.zst"},
+  } {
+    s := New(t.TempDir(), 1<<20, tt.encoding, nil)
+    if err := s.Ensure(); err != nil {
+      t.Fatal(err)
+    }
+    if err := s.Enqueue(payload); err != nil {
+      t.Fatal(err)
+    }
+    path, got, err := s.DequeueOldest()
+    if err != nil {
+      t.Fatalf("%s: %v", tt.encoding, err)
+    }
+    if !strings.HasSuffix(path, tt.ext) || !bytes.Equal(got, payload) {
+      t.Fatalf("%s: %s, %d bytes", tt.encoding, path, len(got))
+    }
+    if tt.encoding != "identity" && s.SizeBytes()*10 > int64(len(payload)) {
+      t.Fatalf("%s: spool holds %d bytes for a %d byte batch", tt.encoding, s.SizeBytes(), len(payload))
+    }
+  }
+}
+
+func TestSpoolReadsOlderFiles(t *testing.T) {
+  dir := t.TempDir()
+  // Written before spool_compression existed.
+  if err := os.WriteFile(filepath.Join(dir, "batch_1.json"), []byte(`{"events":[]}`), 0o600); err != nil {
+    t.Fatal(err)
+  }
+  s := New(dir, 1<<20, "zstd", nil)
+  if err := s.Enqueue([]byte(`{"events":[1]}`)); err != nil {
+    t.Fatal(err)
+  }
+  for _, want := range []string{`{"events":[]}`, `{"events":[1]}`} {
+    path, got, err := s.DequeueOldest()
+    if err != nil || string(got) != want {
+      t.Fatalf("got %q, %v; want %q", got, err, want)
+    }
+    if err := s.Ack(path); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  // A corrupt file is reported with its path so the caller can drop it.
+  if err := os.WriteFile(filepath.Join(dir, "batch_2.json.gz"), []byte("not gzip"), 0o600); err != nil {
+    t.Fatal(err)
+  }
+  if path, _, err := s.DequeueOldest(); err == nil || path == "" {
+    t.Fatalf("corrupt file: path %q, err %v", path, err)
+  }
+}
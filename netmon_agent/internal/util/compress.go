@@ -0,0 +1,94 @@
+package util
+
+import (
+  "bytes"
+  "compress/gzip"
+  "fmt"
+  "io"
+  "sync"
+
+  "github.com/klauspost/compress/zstd"
+)
+
+// Content codings shared by the HTTP client and the spool.
+const (
+  EncodingIdentity = "identity"
+  EncodingGzip     = "gzip"
+  EncodingZstd     = "zstd"
+)
+
+// maxDecodedBytes bounds what Decode inflates, so a corrupt or hostile body
+// cannot exhaust memory.
+const maxDecodedBytes = 64 << 20
+
+var (
+  zstdOnce    sync.Once
+  zstdEncoder *zstd.Encoder
+  zstdDecoder *zstd.Decoder
+  zstdErr     error
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+  zstdOnce.Do(func() {
+    zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+    if zstdErr == nil {
+      zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxDecodedBytes))
+    }
+  })
+  return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// Encode compresses data with a content coding. "" and identity return data
+// unchanged.
+func Encode(encoding string, data []byte) ([]byte, error) {
+  switch encoding {
+  case "", EncodingIdentity:
+    return data, nil
+  case EncodingGzip:
+    var buf bytes.Buffer
+    w := gzip.NewWriter(&buf)
+    if _, err := w.Write(data); err != nil {
+      return nil, err
+    }
+    if err := w.Close(); err != nil {
+      return nil, err
+    }
+    return buf.Bytes(), nil
+  case EncodingZstd:
+    enc, _, err := zstdCodec()
+    if err != nil {
+      return nil, err
+    }
+    return enc.EncodeAll(data, nil), nil
+  }
+  return nil, fmt.Errorf("unknown encoding %q", encoding)
+}
+
+// Decode reverses Encode. Output beyond maxDecodedBytes is an error.
+func Decode(encoding string, data []byte) ([]byte, error) {
+  switch encoding {
+  case "", EncodingIdentity:
+    return data, nil
+  case EncodingGzip:
+    r, err := gzip.NewReader(bytes.NewReader(data))
+    if err != nil {
+      return nil, err
+    }
+    defer r.Close()
+    out, err := io.ReadAll(io.LimitReader(r, maxDecodedBytes+1))
+    if err != nil {
+      return nil, err
+    }
+    if len(out) > maxDecodedBytes {
+      return nil, fmt.Errorf("gzip: decoded size exceeds %d bytes", maxDecodedBytes)
+    }
+    return out, nil
+  case EncodingZstd:
+    _, dec, err := zstdCodec()
+    if err != nil {
+      return nil, err
+    }
+    return dec.DecodeAll(data, nil)
+  }
+  return nil, fmt.Errorf("unknown encoding %q", encoding)
+}
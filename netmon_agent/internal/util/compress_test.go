@@ -0,0 +1,42 @@
+package util
+
+import (
+  "bytes"
+  "testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+  data := bytes.Repeat([]byte(`{"type":"flow","data":{}}`), 1000)
+  for _, enc := range []string{"", EncodingIdentity, EncodingGzip, EncodingZstd} {
+    body, err := Encode(enc, data)
+    if err != nil {
+      t.Fatalf("%q: %v", enc, err)
+    }
+    got, err := Decode(enc, body)
+    if err != nil || !bytes.Equal(got, data) {
+      t.Fatalf("%q: round trip = %d bytes, %v", enc, len(got), err)
+    }
+  }
+  if _, err := Encode("br", data); err == nil {
+    t.Fatal("unknown encoding accepted")
+  }
+}
+
+func TestDecodeBounded(t *testing.T) {
+  // A small body that inflates past the limit.
+  bomb := make([]byte, maxDecodedBytes+1)
+  for _, enc := range []string{EncodingGzip, EncodingZstd} {
+    body, err := Encode(enc, bomb)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if _, err := Decode(enc, body); err == nil {
+      t.Fatalf("%s: decoded %d bytes past the limit", enc, len(bomb))
+    }
+  }
+  ok := make([]byte, maxDecodedBytes)
+  body, _ := Encode(EncodingGzip, ok)
+  if got, err := Decode(EncodingGzip, body); err != nil || len(got) != len(ok) {
+    t.Fatalf("at the limit: %d bytes, %v", len(got), err)
+  }
+}
@@ -0,0 +1,130 @@
+package util
+
+import (
+  "container/list"
+  "time"
+)
+
+const (
+  EvictCapacity = "capacity"
+  EvictExpired  = "expired"
+)
+
+// LRU is a map bounded by entry count and age. Putting a new key into a full
+// LRU evicts the least recently used entry; entries not written for ttl are
+// dropped on access or by Prune. A zero max or ttl disables that bound. LRU is
+// not safe for concurrent use.
+type LRU[K comparable, V any] struct {
+  max     int
+  ttl     time.Duration
+  order   *list.List // *lruEntry, most recently used first
+  entries map[K]*list.Element
+  // OnEvict, if set, is called for entries dropped by capacity or age with
+  // EvictCapacity or EvictExpired, not for Remove.
+  OnEvict func(key K, value V, reason string)
+}
+
+type lruEntry[K comparable, V any] struct {
+  key     K
+  value   V
+  written time.Time
+}
+
+func NewLRU[K comparable, V any](max int, ttl time.Duration) *LRU[K, V] {
+  return &LRU[K, V]{max: max, ttl: ttl, order: list.New(), entries: make(map[K]*list.Element)}
+}
+
+// Get returns the value for key and marks it recently used.
+func (l *LRU[K, V]) Get(key K, now time.Time) (V, bool) {
+  el, ok := l.entries[key]
+  if !ok {
+    var zero V
+    return zero, false
+  }
+  e := el.Value.(*lruEntry[K, V])
+  if l.expired(e, now) {
+    l.evict(el, EvictExpired)
+    var zero V
+    return zero, false
+  }
+  l.order.MoveToFront(el)
+  return e.value, true
+}
+
+// Peek is Get without touching the entry, for readers sharing a lock.
+func (l *LRU[K, V]) Peek(key K, now time.Time) (V, bool) {
+  el, ok := l.entries[key]
+  if !ok || l.expired(el.Value.(*lruEntry[K, V]), now) {
+    var zero V
+    return zero, false
+  }
+  return el.Value.(*lruEntry[K, V]).value, true
+}
+
+// Put sets key, restarting its ttl, and evicts the least recently used
+// entries beyond max.
+func (l *LRU[K, V]) Put(key K, value V, now time.Time) {
+  if el, ok := l.entries[key]; ok {
+    e := el.Value.(*lruEntry[K, V])
+    e.value, e.written = value, now
+    l.order.MoveToFront(el)
+    return
+  }
+  l.entries[key] = l.order.PushFront(&lruEntry[K, V]{key: key, value: value, written: now})
+  for l.max > 0 && l.order.Len() > l.max {
+    l.evict(l.order.Back(), EvictCapacity)
+  }
+}
+
+// Remove deletes key if present.
+func (l *LRU[K, V]) Remove(key K) {
+  if el, ok := l.entries[key]; ok {
+    l.order.Remove(el)
+    delete(l.entries, key)
+  }
+}
+
+// Prune evicts every expired entry and returns how many it dropped.
+func (l *LRU[K, V]) Prune(now time.Time) int {
+  if l.ttl <= 0 {
+    return 0
+  }
+  n := 0
+  for el := l.order.Back(); el != nil; {
+    prev := el.Prev()
+    if l.expired(el.Value.(*lruEntry[K, V]), now) {
+      l.evict(el, EvictExpired)
+      n++
+    }
+    el = prev
+  }
+  return n
+}
+
+// Range calls fn for each entry, most recently used first, until fn returns
+// false. fn must not modify the LRU.
+func (l *LRU[K, V]) Range(fn func(key K, value V) bool) {
+  for el := l.order.Front(); el != nil; el = el.Next() {
+    e := el.Value.(*lruEntry[K, V])
+    if !fn(e.key, e.value) {
+      return
+    }
+  }
+}
+
+func (l *LRU[K, V]) Len() int {
+  return l.order.Len()
+}
+
+func (l *LRU[K, V]) expired(e *lruEntry[K, V], now time.Time) bool {
+  return l.ttl > 0 && now.Sub(e.written) > l.ttl
+}
+
+func (l *LRU[K, V]) evict(el *list.Element, reason string) {
+  e := el.Value.(*lruEntry[K, V])
+  l.order.Remove(el)
+  delete(l.entries, e.key)
+  if l.OnEvict != nil {
+    l.OnEvict(e.key, e.value, reason)
+  }
+}
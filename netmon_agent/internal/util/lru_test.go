@@ -0,0 +1,67 @@
+package util
+
+import (
+  "reflect"
+  "testing"
+  "time"
+)
+
+func TestLRUCapacity(t *testing.T) {
+  now := time.Date(2026, 3, 8, 14, 20, 0, 0, time.UTC)
+  var evicted []string
+  l := NewLRU[string, int](2, 0)
+  l.OnEvict = func(k string, v int, reason string) { evicted = append(evicted, k+":"+reason) }
+  l.Put("a", 1, now)
+  l.Put("b", 2, now)
+  l.Get("a", now)
+  l.Put("c", 3, now)
+  if _, ok := l.Get("b", now); ok {
+    t.Fatal("least recently used entry kept")
+  }
+  // Peek does not protect "a" from eviction.
+  l.Peek("a", now)
+  l.Put("d", 4, now)
+  if !reflect.DeepEqual(evicted, []string{"b:capacity", "a:capacity"}) {
+    t.Fatalf("evicted = %v", evicted)
+  }
+  var keys []string
+  l.Range(func(k string, _ int) bool {
+    keys = append(keys, k)
+    return true
+  })
+  if !reflect.DeepEqual(keys, []string{"d", "c"}) || l.Len() != 2 {
+    t.Fatalf("keys = %v", keys)
+  }
+  l.Remove("d")
+  if l.Len() != 1 || len(evicted) != 2 {
+    t.Fatalf("Remove: len %d, evicted %v", l.Len(), evicted)
+  }
+}
+
+func TestLRUTTL(t *testing.T) {
+  now := time.Date(2026, 3, 8, 14, 20, 0, 0, time.UTC)
+  var evicted []string
+  l := NewLRU[string, int](0, time.Minute)
+  l.OnEvict = func(k string, v int, reason string) { evicted = append(evicted, k+":"+reason) }
+  l.Put("a", 1, now)
+  l.Put("b", 2, now)
+  l.Put("c", 3, now)
+  // Reading does not extend the ttl, writing does.
+  l.Get("a", now.Add(50*time.Second))
+  l.Put("b", 20, now.Add(50*time.Second))
+  if _, ok := l.Peek("a", now.Add(61*time.Second)); ok {
+    t.Fatal("Peek returned an expired entry")
+  }
+  if _, ok := l.Get("a", now.Add(61*time.Second)); ok {
+    t.Fatal("Get returned an expired entry")
+  }
+  if n := l.Prune(now.Add(61 * time.Second)); n != 1 {
+    t.Fatalf("Prune dropped %d, want 1", n)
+  }
+  if v, ok := l.Get("b", now.Add(61*time.Second)); !ok || v != 20 {
+    t.Fatalf("b = %v, %v", v, ok)
+  }
+  if !reflect.DeepEqual(evicted, []string{"a:expired", "c:expired"}) {
+    t.Fatalf("evicted = %v", evicted)
+  }
+}
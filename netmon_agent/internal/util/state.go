@@ -0,0 +1,69 @@
+package util
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// ReadStateFile returns a state file's contents, or "" if there is none. State
+// files in state_dir carry positions and counters across restarts, such as
+// where the DNS inputs stopped.
+func ReadStateFile(path string) string {
+  if path == "" {
+    return ""
+  }
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return ""
+  }
+  return strings.TrimSpace(string(data))
+}
+
+// WriteStateFile replaces a state file atomically so a crash leaves either the
+// old or the new contents. The file and the rename are synced, so a power loss
+// after it returns keeps the new contents.
+func WriteStateFile(path, data string) error {
+  if path == "" || data == "" {
+    return nil
+  }
+  dir := filepath.Dir(path)
+  if err := os.MkdirAll(dir, 0o755); err != nil {
+    return err
+  }
+  tmp := path + ".tmp"
+  f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+  if err != nil {
+    return err
+  }
+  _, err = f.WriteString(data + "\n")
+  if err == nil {
+    err = f.Sync()
+  }
+  if cerr := f.Close(); err == nil {
+    err = cerr
+  }
+  if err != nil {
+    return err
+  }
+  if err := os.Rename(tmp, path); err != nil {
+    return err
+  }
+  return syncDir(dir)
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+  d, err := os.Open(dir)
+  if err != nil {
+    return err
+  }
+  defer d.Close()
+  return d.Sync()
+}
+
+func RemoveStateFile(path string) {
+  if path != "" {
+    _ = os.Remove(path)
+  }
+}
@@ -93,8 +93,21 @@ func (nflog *Nflog) Close() error {
 // To stop receiving messages on this HookFunc, return something different than 0
 type HookFunc func(m Msg) int
 
+// ErrorFunc is called when receiving from the netlink socket fails.
+// Return something different than 0 to stop receiving messages.
+type ErrorFunc func(e error) int
+
 // Register your own function as callback for a netfilter log group
 func (nflog *Nflog) Register(ctx context.Context, fn HookFunc) error {
+	return nflog.RegisterWithErrorFunc(ctx, fn, func(e error) int {
+		nflog.logger.Printf("Could not receive message: %v", e)
+		return 0
+	})
+}
+
+// RegisterWithErrorFunc is like Register, but receive errors are handed to
+// errfn instead of only being logged.
+func (nflog *Nflog) RegisterWithErrorFunc(ctx context.Context, fn HookFunc, errfn ErrorFunc) error {
 
 	// unbinding existing handler (if any)
 	seq, err := nflog.setConfig(unix.AF_UNSPEC, 0, 0, []netlink.Attribute{
@@ -150,9 +163,9 @@ func (nflog *Nflog) Register(ctx context.Context, fn HookFunc) error {
 
 	}
 
-	if nflog.qthresh[0] != 0 || nflog.qthresh[1] != 1 || nflog.qthresh[2] != 0 || nflog.qthresh[3] != 0 {
+	if nflog.qthresh[0] != 0 || nflog.qthresh[1] != 0 || nflog.qthresh[2] != 0 || nflog.qthresh[3] != 0 {
 		// set qthresh
-		attrs = append(attrs, netlink.Attribute{Type: nfUlACfgQThresh, Data: nflog.timeout})
+		attrs = append(attrs, netlink.Attribute{Type: nfUlACfgQThresh, Data: nflog.qthresh})
 	}
 
 	if len(attrs) != 0 {
@@ -175,7 +188,12 @@ func (nflog *Nflog) Register(ctx context.Context, fn HookFunc) error {
 		for {
 			reply, err := nflog.Con.Receive()
 			if err != nil {
-				nflog.logger.Printf("Could not receive message: %v", err)
+				if ctx.Err() != nil {
+					return
+				}
+				if ret := errfn(err); ret != 0 {
+					return
+				}
 				continue
 			}
 
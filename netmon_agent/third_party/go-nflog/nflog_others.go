@@ -25,6 +25,14 @@ func (_ *Nflog) Close() error {
 // HookFunc is a function, that receives events from a Netlinkgroup
 type HookFunc func(_ Msg) int
 
+// ErrorFunc is called when receiving from the netlink socket fails.
+type ErrorFunc func(e error) int
+
+// RegisterWithErrorFunc is not implemented for OS other than Linux
+func (_ *Nflog) RegisterWithErrorFunc(_ context.Context, _ HookFunc, _ ErrorFunc) error {
+	return errNotLinux
+}
+
 // Register is not implemented for OS other than Linux
 func (_ *Nflog) Register(_ context.Context, _ HookFunc) error {
 	return errNotLinux